@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/concourse/atc"
+	"github.com/pkg/errors"
+)
+
+var pipelineName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// bindParameters are the parameters the broker understands on bind. An app
+// binding with a pipeline sets that pipeline in the team for as long as the
+// binding exists. A binding with a drain forwards the build events of the team
+// to it.
+type bindParameters struct {
+	Pipeline string          `json:"pipeline"`
+	Config   json.RawMessage `json:"config"`
+	Paused   bool            `json:"paused"`
+	Drain    string          `json:"drain"`
+}
+
+func parseBindParameters(raw json.RawMessage) (bindParameters, error) {
+	var params bindParameters
+	if len(raw) == 0 {
+		return params, nil
+	}
+	err := json.Unmarshal(raw, &params)
+	if err != nil {
+		err = errors.Wrap(err, "Invalid parameters")
+		return params, classify(err, kindInvalidInput, err.Error())
+	}
+	if params.Pipeline == "" && len(params.Config) > 0 {
+		err := errors.New("A pipeline config needs a pipeline name")
+		return params, classify(err, kindInvalidInput, err.Error())
+	}
+	if params.Pipeline != "" && !pipelineName.MatchString(params.Pipeline) {
+		err := errors.Errorf("Invalid pipeline name %q", params.Pipeline)
+		return params, classify(err, kindInvalidInput, err.Error())
+	}
+	if params.Drain != "" {
+		if params.Pipeline != "" {
+			err := errors.New("A binding can set a pipeline or a drain, not both")
+			return params, classify(err, kindInvalidInput, err.Error())
+		}
+		_, err := parseDrainURL(params.Drain)
+		if err != nil {
+			return params, classify(err, kindInvalidInput, err.Error())
+		}
+	}
+	return params, nil
+}
+
+// pipelineCredentials point the bound app to its pipeline.
+type pipelineCredentials struct {
+	ConcourseURL string `json:"concourse_url"`
+	Team         string `json:"team"`
+	Pipeline     string `json:"pipeline"`
+	PipelineURL  string `json:"pipeline_url"`
+}
+
+// checkNewPipeline checks that the team has no pipeline called pipelineName
+// yet, which a binding would take over, and that quota allows one more.
+func (b *broker) checkNewPipeline(ctx context.Context, teamName, pipelineName string, quota quotaConfig) error {
+	pipelines, err := b.concourse.ListPipelines(ctx, teamName)
+	if err != nil {
+		return err
+	}
+	for _, pipeline := range pipelines {
+		if pipeline.Name == pipelineName {
+			err := errors.Errorf("Pipeline %s exists already in team %s", pipelineName, teamName)
+			return classify(err, kindConflict, err.Error())
+		}
+	}
+	if quota.MaxPipelinesPerTeam > 0 && len(pipelines) >= quota.MaxPipelinesPerTeam {
+		return quotaExceeded("Quota exceeded: the team has %d pipelines, the plan allows %d", len(pipelines), quota.MaxPipelinesPerTeam)
+	}
+	return nil
+}
+
+// bindPipeline sets the pipeline of a binding in the team, pinned to the worker
+// tags of the plan. A pipeline belongs to one binding, and pipelines of the
+// plan or set in Concourse otherwise can't be replaced.
+func (b *broker) bindPipeline(ctx context.Context, record instanceRecord, params bindParameters) (pipelineCredentials, error) {
+	plan := b.plans[record.PlanID]
+	for _, template := range plan.Pipelines {
+		if template.Name == params.Pipeline {
+			err := errors.Errorf("Pipeline %s is set by the plan", params.Pipeline)
+			return pipelineCredentials{}, classify(err, kindInvalidInput, err.Error())
+		}
+	}
+	for _, binding := range record.Bindings {
+		if binding.Pipeline == params.Pipeline {
+			err := errors.Errorf("Pipeline %s is set by another binding", params.Pipeline)
+			return pipelineCredentials{}, classify(err, kindInvalidInput, err.Error())
+		}
+	}
+
+	var config atc.Config
+	err := json.Unmarshal(params.Config, &config)
+	if err != nil || len(config.Jobs) == 0 {
+		err = errors.Errorf("Invalid config of pipeline %s", params.Pipeline)
+		return pipelineCredentials{}, classify(err, kindInvalidInput, err.Error())
+	}
+	config, err = applyWorkerTags(config, plan.WorkerTags)
+	if err != nil {
+		return pipelineCredentials{}, classify(err, kindInvalidInput, err.Error())
+	}
+	err = b.checkNewPipeline(ctx, record.TeamName, params.Pipeline, plan.Quota)
+	if err != nil {
+		return pipelineCredentials{}, err
+	}
+	err = b.concourse.SetPipeline(ctx, record.TeamName, params.Pipeline, config, params.Paused)
+	if err != nil {
+		return pipelineCredentials{}, err
+	}
+
+	url := strings.TrimSuffix(b.env.ConcourseURL, "/")
+	return pipelineCredentials{
+		ConcourseURL: url,
+		Team:         record.TeamName,
+		Pipeline:     params.Pipeline,
+		PipelineURL:  url + "/teams/" + record.TeamName + "/pipelines/" + params.Pipeline,
+	}, nil
+}
@@ -2,67 +2,650 @@ package main
 
 import (
 	"context"
-	"errors"
+	"net/http"
+	"sync"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/pivotal-cf/brokerapi"
+	"github.com/pkg/errors"
 )
 
 type broker struct {
-	services []brokerapi.Service
 	logger   lager.Logger
-	env      brokerConfig
+	store    IinstanceStore
+	notifier *notifier
+
+	// mu guards the fields replaced when the config and catalog are reloaded.
+	mu          sync.RWMutex
+	services    []brokerapi.Service
+	plans       map[string]planConfig
+	env         brokerConfig
+	resolver    IplatformResolver
+	cfCache     IcfCache
+	concourse   IccClient
+	credentials IcredentialManager
+}
+
+// configure replaces the catalog, the config and the clients depending on it.
+func (b *broker) configure(config brokerConfig, services []brokerapi.Service, plans map[string]planConfig) {
+	cfClient := newCFCachingClient(newCFLazyClient(config), config.CFCacheTTL, config.CFCacheSize)
+	resolver := newPlatformResolver(config, cfClient)
+	concourseClient := concourseNewClient(config, b.logger)
+	credentials := newCredentialManager(config)
+	if b.notifier != nil {
+		b.notifier.configure(config)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.services = services
+	b.plans = plans
+	b.env = config
+	b.resolver = resolver
+	b.cfCache = cfClient
+	b.concourse = concourseClient
+	b.credentials = credentials
+}
+
+// current returns a snapshot of the broker, so a request is handled with the
+// same config and clients throughout even if they are reloaded meanwhile.
+func (b *broker) current() *broker {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return &broker{
+		logger:      b.logger,
+		store:       b.store,
+		notifier:    b.notifier,
+		services:    b.services,
+		plans:       b.plans,
+		env:         b.env,
+		resolver:    b.resolver,
+		cfCache:     b.cfCache,
+		concourse:   b.concourse,
+		credentials: b.credentials,
+	}
 }
 
 func (b *broker) Services(context context.Context) []brokerapi.Service {
-	return b.services
+	return b.current().services
 }
 
 func (b *broker) Provision(context context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
-	cfClient, err := cfNewClient(b.env)
+	b = b.current()
+	ctx, cancel := b.withDeadline(context)
+	defer cancel()
+	err := b.provision(ctx, instanceID, details)
+	if err != nil {
+		b.notifier.emit(newTeamEvent(eventTeamCreated, instanceRecord{
+			InstanceID: instanceID,
+			PlanID:     details.PlanID,
+			OrgGUID:    details.OrganizationGUID,
+			SpaceGUID:  details.SpaceGUID,
+			Namespace:  platformContextFrom(ctx).Namespace,
+		}, err))
+	}
+	return brokerapi.ProvisionedServiceSpec{}, b.failure(ctx, operationProvision, err)
+}
+
+func (b *broker) provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails) error {
+	if !b.planExists(details.ServiceID, details.PlanID) {
+		err := errors.Errorf("Plan %s of service %s not found in catalog", details.PlanID, details.ServiceID)
+		return classify(err, kindInvalidInput, err.Error())
+	}
+	record := instanceRecord{
+		InstanceID: instanceID,
+		ServiceID:  details.ServiceID,
+		PlanID:     details.PlanID,
+		OrgGUID:    details.OrganizationGUID,
+		SpaceGUID:  details.SpaceGUID,
+		Namespace:  platformContextFrom(ctx).Namespace,
+		Parameters: redactSecrets(details.RawParameters),
+	}
+	params, err := parseProvisionParameters(details.RawParameters)
+	if err != nil {
+		return err
+	}
+	if len(params.Secrets) > 0 && b.credentials == nil {
+		err := errors.New("Secrets can't be seeded without a credential manager")
+		return classify(err, kindInvalidInput, err.Error())
+	}
+	existing, found, err := b.store.Get(instanceID)
+	if err != nil {
+		return err
+	}
+	if found {
+		if !existing.sameRequest(record) {
+			return brokerapi.ErrInstanceAlreadyExists
+		}
+		overrideResponse(ctx, http.StatusOK, nil)
+		return nil
+	}
+
+	platformDetails, err := b.resolver.GetProvisionDetails(ctx, details)
+	if err != nil {
+		return err
+	}
+	record.Details = platformDetails
+	record.TeamName = getTeamName(platformDetails)
+	err = b.checkInstanceQuota(record, b.plans[details.PlanID].Quota)
+	if err != nil {
+		return err
+	}
+	_, found, err = b.store.FindByTeam(record.TeamName)
+	if err != nil {
+		return err
+	}
+	if found {
+		return brokerapi.ErrInstanceAlreadyExists
+	}
+	return b.createTeam(ctx, record, params)
+}
+
+// createTeam creates the team of record with everything its plan comes with,
+// and stores the record. Auth and a worker key the record already has are
+// kept, so credentials handed out before stay valid.
+func (b *broker) createTeam(ctx context.Context, record instanceRecord, params provisionParameters) error {
+	plan := b.plans[record.PlanID]
+	var err error
+	if record.Auth == nil {
+		record.Auth, err = newTeamAuthConfig(plan.Auth, params.Auth)
+		if err != nil {
+			return err
+		}
+	}
+	if plan.DedicatedWorkers && record.Workers == nil {
+		if b.env.TSAHost == "" {
+			return errWorkersNotConfigured
+		}
+		record.Workers, err = newWorkerKey(plan.WorkerTags)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = b.concourse.CreateTeam(ctx, record.Details, record.Auth)
+	if err != nil {
+		return err
+	}
+	err = b.setUpTeam(ctx, record, plan)
 	if err != nil {
-		return brokerapi.ProvisionedServiceSpec{}, err
+		b.rollBack(ctx, record)
+		return err
 	}
-	cfDetails, err := cfClient.GetProvisionDetails(details.SpaceGUID)
-	cfDetails.SpaceGUID = details.SpaceGUID
+	if b.credentials != nil {
+		err = b.credentials.CreateTeam(ctx, record.TeamName, params.Secrets, record.Credentials)
+		if err != nil {
+			b.logger.Error("provision.credentials-error", err, lager.Data{"instance-id": record.InstanceID})
+			// Secrets that existed before belong to someone else and are
+			// left alone.
+			if kind, _ := errorKindOf(err); kind != kindConflict {
+				record.Credentials = true
+			}
+			b.rollBack(ctx, record)
+			return err
+		}
+		record.Credentials = true
+	}
+	err = b.store.Put(record)
 	if err != nil {
-		return brokerapi.ProvisionedServiceSpec{}, err
+		b.logger.Error("provision.store-error", err, lager.Data{"instance-id": record.InstanceID})
+		b.rollBack(ctx, record)
+		return err
+	}
+	b.notifier.emit(newTeamEvent(eventTeamCreated, record, nil))
+	return nil
+}
+
+// setUpTeam prepares everything the plan comes with for a newly created team.
+func (b *broker) setUpTeam(ctx context.Context, record instanceRecord, plan planConfig) error {
+	logData := lager.Data{"instance-id": record.InstanceID}
+	if record.Workers != nil {
+		err := authorizeWorkers(b.env, record.TeamName, record.Workers)
+		if err != nil {
+			b.logger.Error("provision.authorize-workers-error", err, logData)
+			return err
+		}
 	}
-	concourseClient := concourseNewClient(b.env, b.logger)
-	err = concourseClient.CreateTeam(cfDetails)
+	err := b.setPipelines(ctx, record.TeamName, plan)
 	if err != nil {
-		return brokerapi.ProvisionedServiceSpec{}, err
+		b.logger.Error("provision.set-pipelines-error", err, logData)
+		return err
 	}
-	return brokerapi.ProvisionedServiceSpec{}, nil
+	return nil
 }
 
+// rollBack removes a team whose provisioning failed halfway. It is best
+// effort, the error that caused it is the one reported.
+func (b *broker) rollBack(ctx context.Context, record instanceRecord) {
+	b.concourse.DeleteTeam(ctx, record.Details)
+	if record.Workers != nil {
+		unauthorizeWorkers(b.env, record.TeamName)
+	}
+	if b.credentials != nil && record.Credentials {
+		b.credentials.DeleteTeam(ctx, record.TeamName)
+	}
+}
+
+// setPipelines sets the pipelines of the plan in the team, pinned to the
+// worker tags of the plan.
+func (b *broker) setPipelines(ctx context.Context, teamName string, plan planConfig) error {
+	for _, template := range plan.Pipelines {
+		config, err := applyWorkerTags(template.Config, plan.WorkerTags)
+		if err != nil {
+			return classify(err, kindInvalidInput, err.Error())
+		}
+		err = b.concourse.SetPipeline(ctx, teamName, template.Name, config, template.Paused)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deprovision falls back to resolving the instance on its platform for
+// instances provisioned before the broker kept their state.
 func (b *broker) Deprovision(context context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (brokerapi.DeprovisionServiceSpec, error) {
-	cfClient, err := cfNewClient(b.env)
+	b = b.current()
+	ctx, cancel := b.withDeadline(context)
+	defer cancel()
+	err := b.deprovision(ctx, instanceID)
 	if err != nil {
-		return brokerapi.DeprovisionServiceSpec{}, err
+		b.notifyFailure(eventTeamDeleted, instanceID, err)
 	}
-	cfDetails, err := cfClient.GetDeprovisionDetails(instanceID)
+	return brokerapi.DeprovisionServiceSpec{}, b.failure(ctx, operationDeprovision, err)
+}
+
+func (b *broker) deprovision(ctx context.Context, instanceID string) error {
+	record, found, err := b.store.Get(instanceID)
 	if err != nil {
-		return brokerapi.DeprovisionServiceSpec{}, err
+		return err
+	}
+	platformDetails := record.Details
+	if !found {
+		platformDetails, err = b.resolver.GetDeprovisionDetails(ctx, instanceID)
+		if err != nil {
+			return err
+		}
+	}
+	if record.Workers != nil {
+		// Workers that are still running keep their registration until they
+		// stall, pruning them is best effort.
+		pruneErr := b.concourse.PruneTeamWorkers(ctx, record.TeamName)
+		if pruneErr != nil {
+			b.logger.Error("deprovision.prune-workers-error", pruneErr, lager.Data{"instance-id": instanceID})
+		}
+	}
+	err = b.concourse.DeleteTeam(ctx, platformDetails)
+	if kind, _ := errorKindOf(err); kind == kindNotFound && found {
+		// The team is already gone, only the record is left to clean up.
+		err = nil
 	}
-	concourseClient := concourseNewClient(b.env, b.logger)
-	err = concourseClient.DeleteTeam(cfDetails)
 	if err != nil {
-		return brokerapi.DeprovisionServiceSpec{}, err
+		return err
 	}
-	return brokerapi.DeprovisionServiceSpec{}, nil
+	if record.Workers != nil {
+		err = unauthorizeWorkers(b.env, record.TeamName)
+		if err != nil {
+			b.logger.Error("deprovision.unauthorize-workers-error", err, lager.Data{"instance-id": instanceID})
+			return err
+		}
+	}
+	if b.credentials != nil && record.Credentials {
+		err = b.credentials.DeleteTeam(ctx, getTeamName(platformDetails))
+		if err != nil {
+			b.logger.Error("deprovision.credentials-error", err, lager.Data{"instance-id": instanceID})
+			return err
+		}
+	}
+	if b.cfCache != nil {
+		b.cfCache.InvalidateInstance(instanceID)
+	}
+	err = b.store.Delete(instanceID)
+	if err != nil {
+		return err
+	}
+	record.InstanceID = instanceID
+	record.TeamName = getTeamName(platformDetails)
+	b.notifier.emit(newTeamEvent(eventTeamDeleted, record, nil))
+	return nil
 }
 
+// notifyFailure emits a failed event for an instance, with the details of
+// its record if the broker still has it.
+func (b *broker) notifyFailure(eventType, instanceID string, err error) {
+	if b.notifier == nil {
+		return
+	}
+	record, found, _ := b.store.Get(instanceID)
+	if !found {
+		record = instanceRecord{InstanceID: instanceID}
+	}
+	b.notifier.emit(newTeamEvent(eventType, record, err))
+}
+
+// withDeadline bounds the upstream calls made for a request by the configured
+// request timeout. They are cancelled as well when the platform disconnects.
+func (b *broker) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if b.env.RequestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, b.env.RequestTimeout)
+}
+
+// The operations of the Service Broker API, which failure answers errors of.
+const (
+	operationProvision   = "provision"
+	operationDeprovision = "deprovision"
+	operationUpdate      = "update"
+	operationBind        = "bind"
+	operationUnbind      = "unbind"
+)
+
+// brokerAPIErrors are the errors brokerapi answers itself, with responses the
+// Service Broker API defines.
+var brokerAPIErrors = map[error]bool{
+	brokerapi.ErrInstanceAlreadyExists:  true,
+	brokerapi.ErrInstanceDoesNotExist:   true,
+	brokerapi.ErrBindingAlreadyExists:   true,
+	brokerapi.ErrBindingDoesNotExist:    true,
+	brokerapi.ErrPlanChangeNotSupported: true,
+	brokerapi.ErrAsyncRequired:          true,
+	brokerapi.ErrRawParamsInvalid:       true,
+	brokerapi.ErrAppGuidNotProvided:     true,
+}
+
+// failure maps an error of operation to the matching response of the Service
+// Broker API, with a description that doesn't leak internal details. Errors
+// that are neither classified nor those of brokerapi are answered with a
+// generic description, brokerapi logs them.
+func (b *broker) failure(ctx context.Context, operation string, err error) error {
+	if err == nil || brokerAPIErrors[err] {
+		return err
+	}
+	kind, description := errorKindOf(err)
+	status := http.StatusInternalServerError
+	switch kind {
+	case kindConflict:
+		if operation == operationProvision {
+			// Answered without a body, as the Service Broker API asks.
+			return brokerapi.ErrInstanceAlreadyExists
+		}
+		status = http.StatusConflict
+	case kindNotFound:
+		if operation == operationDeprovision {
+			return brokerapi.ErrInstanceDoesNotExist
+		}
+	case kindInvalidInput:
+		status = http.StatusBadRequest
+	case kindQuotaExceeded:
+		status = http.StatusUnprocessableEntity
+	case kindUnavailable:
+		status = http.StatusServiceUnavailable
+	}
+	if description == "" {
+		description = "Internal error, see the logs of the broker"
+	}
+	overrideResponse(ctx, status, &brokerapi.ErrorResponse{Description: description})
+	return err
+}
+
+func (b *broker) planExists(serviceID, planID string) bool {
+	for _, service := range b.services {
+		if service.ID != serviceID {
+			continue
+		}
+		for _, plan := range service.Plans {
+			if plan.ID == planID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Bind hands out a service key with a fly target for the team to bindings
+// without an app. App bindings passing a pipeline get it set in the team.
+// Bindings passing a drain get the build events of the team forwarded to it.
+// Other app bindings get access to the secrets of the team if the credential
+// manager supports it, and the worker registration of dedicated workers.
 func (b *broker) Bind(context context.Context, instanceID, bindingID string, details brokerapi.BindDetails) (brokerapi.Binding, error) {
-	return brokerapi.Binding{}, errors.New("This service does not support bind")
+	b = b.current()
+	binder, ok := b.credentials.(IcredentialBinder)
+	params, err := parseBindParameters(details.RawParameters)
+	if err == nil && details.AppGUID != "" && params.Pipeline == "" && params.Drain == "" && !ok {
+		record, err := b.workersRecord(details.PlanID, instanceID)
+		if err != nil {
+			return brokerapi.Binding{}, err
+		}
+		return brokerapi.Binding{Credentials: newWorkerCredentials(b.env, record)}, nil
+	}
+	ctx, cancel := b.withDeadline(context)
+	defer cancel()
+	var binding brokerapi.Binding
+	if err == nil {
+		binding, err = b.bind(ctx, binder, instanceID, bindingID, details.AppGUID, params)
+	}
+	return binding, b.failure(ctx, operationBind, err)
+}
+
+// bind records a service key, a pipeline binding, or an app binding made
+// through binder.
+func (b *broker) bind(ctx context.Context, binder IcredentialBinder, instanceID, bindingID, appGUID string, params bindParameters) (brokerapi.Binding, error) {
+	record, found, err := b.store.Get(instanceID)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	if !found {
+		return brokerapi.Binding{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	if _, ok := record.Bindings[bindingID]; ok {
+		return brokerapi.Binding{}, brokerapi.ErrBindingAlreadyExists
+	}
+
+	binding := bindingRecord{AppGUID: appGUID, Pipeline: params.Pipeline, Drain: params.Drain}
+	var credentials interface{}
+	switch {
+	case params.Pipeline != "" && appGUID == "":
+		err = errors.New("Pipelines can only be set by app bindings")
+		return brokerapi.Binding{}, classify(err, kindInvalidInput, err.Error())
+	case params.Pipeline != "":
+		credentials, err = b.bindPipeline(ctx, record, params)
+	case params.Drain != "":
+		credentials = newDrainCredentials(record.TeamName, params.Drain)
+	case appGUID == "":
+		credentials, err = newServiceKeyCredentials(b.env, record)
+	default:
+		var appCredentials map[string]interface{}
+		appCredentials, err = binder.BindApp(ctx, record.TeamName, appGUID)
+		if err == nil && record.Workers != nil {
+			appCredentials, err = newWorkerCredentials(b.env, record).addTo(appCredentials)
+		}
+		credentials = appCredentials
+	}
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
+	// Another request may have recorded the binding, or the pipeline, since
+	// the record was read. What it set up is not released then.
+	recorded := false
+	found, err = b.store.Update(instanceID, func(record *instanceRecord) error {
+		for _, other := range record.Bindings {
+			recorded = recorded || other == binding
+		}
+		if _, ok := record.Bindings[bindingID]; ok {
+			return brokerapi.ErrBindingAlreadyExists
+		}
+		for _, other := range record.Bindings {
+			if binding.Pipeline != "" && other.Pipeline == binding.Pipeline {
+				err := errors.Errorf("Pipeline %s exists already in team %s", binding.Pipeline, record.TeamName)
+				return classify(err, kindConflict, err.Error())
+			}
+		}
+		if record.Bindings == nil {
+			record.Bindings = make(map[string]bindingRecord)
+		}
+		record.Bindings[bindingID] = binding
+		return nil
+	})
+	if err == nil && !found {
+		err = brokerapi.ErrInstanceDoesNotExist
+	}
+	if err != nil {
+		if recorded {
+			return brokerapi.Binding{}, err
+		}
+		if releaseErr := b.releaseBinding(ctx, record.TeamName, binding); releaseErr != nil {
+			b.logger.Error("bind.release-error", releaseErr, lager.Data{"team": record.TeamName})
+		}
+		return brokerapi.Binding{}, err
+	}
+	return brokerapi.Binding{Credentials: credentials}, nil
 }
 
 func (b *broker) Unbind(context context.Context, instanceID, bindingID string, details brokerapi.UnbindDetails) error {
-	return errors.New("This service does not support bind")
+	b = b.current()
+	ctx, cancel := b.withDeadline(context)
+	defer cancel()
+	return b.failure(ctx, operationUnbind, b.unbind(ctx, instanceID, bindingID))
 }
 
+// unbind removes a recorded binding, deleting its pipeline or revoking the
+// access of the bound app. Worker bindings of apps are not recorded and need
+// no cleanup.
+func (b *broker) unbind(ctx context.Context, instanceID, bindingID string) error {
+	record, found, err := b.store.Get(instanceID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	binding, ok := record.Bindings[bindingID]
+	if !ok {
+		if record.Workers != nil {
+			return nil
+		}
+		return brokerapi.ErrBindingDoesNotExist
+	}
+	err = b.releaseBinding(ctx, record.TeamName, binding)
+	if err != nil {
+		return err
+	}
+	_, err = b.store.Update(instanceID, func(record *instanceRecord) error {
+		delete(record.Bindings, bindingID)
+		return nil
+	})
+	return err
+}
+
+// releaseBinding undoes what a binding set up in the team.
+func (b *broker) releaseBinding(ctx context.Context, teamName string, binding bindingRecord) error {
+	if binding.Pipeline != "" {
+		return b.concourse.DeletePipeline(ctx, teamName, binding.Pipeline)
+	}
+	if binder, ok := b.credentials.(IcredentialBinder); ok && binding.AppGUID != "" {
+		return binder.UnbindApp(ctx, teamName, binding.AppGUID)
+	}
+	return nil
+}
+
+// workersRecord returns the record of an instance with dedicated workers, the
+// only instances apps can be bound to without a credential manager.
+func (b *broker) workersRecord(planID, instanceID string) (instanceRecord, error) {
+	if !b.plans[planID].DedicatedWorkers {
+		return instanceRecord{}, errors.New("This service does not support bind")
+	}
+	record, found, err := b.store.Get(instanceID)
+	if err != nil {
+		return instanceRecord{}, err
+	}
+	if !found {
+		return instanceRecord{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	if record.Workers == nil {
+		return instanceRecord{}, errors.New("This service does not support bind")
+	}
+	return record, nil
+}
+
+// Update enforces the quotas of the new plan when the plan changes, which
+// requires a record of the instance. When the platform sends a space other
+// than the recorded one, the instance moved: the record takes the new space
+// and the cached CF metadata of the instance is dropped.
 func (b *broker) Update(context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
-	return brokerapi.UpdateServiceSpec{}, nil
+	b = b.current()
+	ctx, cancel := b.withDeadline(context)
+	defer cancel()
+	err := b.update(ctx, instanceID, details)
+	if err != nil {
+		b.notifyFailure(eventTeamUpdated, instanceID, err)
+	}
+	return brokerapi.UpdateServiceSpec{}, b.failure(ctx, operationUpdate, err)
+}
+
+func (b *broker) update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails) error {
+	record, found, err := b.store.Get(instanceID)
+	if err != nil {
+		return err
+	}
+	if !found && details.PlanID != "" && details.PlanID != details.PreviousValues.PlanID {
+		// Without a record neither the quotas nor the set-up of the team can
+		// be checked against the new plan.
+		err := errors.Errorf("Instance %s is not recorded, its plan can't be changed", instanceID)
+		return classify(err, kindNotFound, "The broker has no record of this instance, its plan can't be changed")
+	}
+	if found && details.PlanID != "" && details.PlanID != record.PlanID {
+		if !b.planExists(record.ServiceID, details.PlanID) {
+			err := errors.Errorf("Plan %s of service %s not found in catalog", details.PlanID, record.ServiceID)
+			return classify(err, kindInvalidInput, err.Error())
+		}
+		if !sameTeamSetUp(b.plans[record.PlanID], b.plans[details.PlanID]) {
+			return brokerapi.ErrPlanChangeNotSupported
+		}
+		quota := b.plans[details.PlanID].Quota
+		err = b.checkInstanceQuota(record, quota)
+		if err != nil {
+			return err
+		}
+		err = b.checkPipelineQuota(ctx, record.TeamName, quota)
+		if err != nil {
+			return err
+		}
+		record.PlanID = details.PlanID
+		_, err = b.store.Update(instanceID, func(stored *instanceRecord) error {
+			stored.PlanID = details.PlanID
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		b.notifier.emit(newTeamEvent(eventTeamUpdated, record, nil))
+	}
+
+	spaceGUID := platformContextFrom(ctx).SpaceGUID
+	if spaceGUID == "" || (found && record.SpaceGUID == spaceGUID) {
+		return nil
+	}
+	if found {
+		_, err = b.store.Update(instanceID, func(stored *instanceRecord) error {
+			stored.SpaceGUID = spaceGUID
+			stored.Details.SpaceGUID = spaceGUID
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if b.cfCache == nil {
+		return nil
+	}
+	b.cfCache.InvalidateInstance(instanceID)
+	b.cfCache.InvalidateSpace(spaceGUID)
+	if found {
+		b.cfCache.InvalidateSpace(record.SpaceGUID)
+	}
+	return nil
 }
 
 func (b *broker) LastOperation(context context.Context, instanceID, operationData string) (brokerapi.LastOperation, error) {
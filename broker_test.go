@@ -1,9 +1,22 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
+	"code.cloudfoundry.org/lager"
+	"github.com/concourse/atc"
 	"github.com/pivotal-cf/brokerapi"
+	"github.com/pkg/errors"
+	"github.com/vchrisr/cf-concourse-broker/fakes/fakeatc"
 )
 
 func TestBrokerServices(t *testing.T) {
@@ -39,3 +52,527 @@ func TestBrokerBind(t *testing.T) {
 	}
 
 }
+
+func TestBrokerFailure(t *testing.T) {
+	tests := []struct {
+		name        string
+		operation   string
+		err         error
+		expected    error
+		status      int
+		description string
+	}{
+		{"unclassified error", operationUnbind, errors.New("Error writing secret docker-password"), nil, http.StatusInternalServerError, "Internal error, see the logs of the broker"},
+		{"error of brokerapi", operationUnbind, brokerapi.ErrBindingDoesNotExist, brokerapi.ErrBindingDoesNotExist, 0, ""},
+		{"conflict while provisioning", operationProvision, errTeamExists, brokerapi.ErrInstanceAlreadyExists, 0, ""},
+		{"conflict while binding", operationBind, classify(errors.New("exists"), kindConflict, "Pipeline build exists already in team my-org"), nil, http.StatusConflict, "Pipeline build exists already in team my-org"},
+		{"not found while deprovisioning", operationDeprovision, errTeamNotFound, brokerapi.ErrInstanceDoesNotExist, 0, ""},
+		{"not found while unbinding", operationUnbind, errTeamNotFound, nil, http.StatusInternalServerError, "Concourse team not found"},
+	}
+	serviceBroker := newTestBroker(t, nil, testBrokerOptions{})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			override := &responseOverride{}
+			ctx := context.WithValue(context.Background(), responseOverrideKey{}, override)
+			err := serviceBroker.failure(ctx, test.operation, test.err)
+			expected := test.expected
+			if expected == nil {
+				expected = test.err
+			}
+			if err != expected {
+				t.Errorf("Expected error %v but got: %v", expected, err)
+			}
+			description := ""
+			if override.response != nil {
+				description = override.response.Description
+			}
+			if override.status != test.status || description != test.description {
+				t.Errorf("Expected response %d %q but got: %d %q", test.status, test.description, override.status, description)
+			}
+		})
+	}
+}
+
+type fakeResolver struct {
+	details platformDetails
+}
+
+func (f *fakeResolver) GetProvisionDetails(ctx context.Context, details brokerapi.ProvisionDetails) (platformDetails, error) {
+	return f.details, nil
+}
+
+func (f *fakeResolver) GetDeprovisionDetails(ctx context.Context, instanceID string) (platformDetails, error) {
+	return f.details, nil
+}
+
+// testBrokerOptions are what tests set up on top of the broker returned by
+// newTestBroker.
+type testBrokerOptions struct {
+	// server is the Concourse the broker administers, with the credentials
+	// of fakeatc.New("admin", "password").
+	server      *fakeatc.Server
+	config      brokerConfig
+	credentials IcredentialManager
+	notifier    *notifier
+}
+
+// newTestBroker returns a broker for the catalog in catalog.json and plans,
+// with an in-memory store and a resolver placing instances in org my-org and
+// space space-guid on Cloud Foundry.
+func newTestBroker(t *testing.T, plans map[string]planConfig, opts testBrokerOptions) *broker {
+	services, err := CatalogLoad("./catalog.json")
+	if err != nil {
+		t.Fatal("Unable to load the catalog: " + err.Error())
+	}
+	store, err := newInstanceStore("", "")
+	if err != nil {
+		t.Fatal("Unable to create the instance store: " + err.Error())
+	}
+	config := opts.config
+	if opts.server != nil {
+		config.AdminUsername, config.AdminPassword, config.ConcourseURL = "admin", "password", opts.server.URL
+	}
+	return &broker{
+		services:    services,
+		plans:       plans,
+		logger:      lager.NewLogger("test"),
+		env:         config,
+		resolver:    &fakeResolver{details: platformDetails{Platform: platformCloudFoundry, OrgName: "my-org", SpaceGUID: "space-guid"}},
+		concourse:   concourseNewClient(config, lager.NewLogger("test")),
+		credentials: opts.credentials,
+		store:       store,
+		notifier:    opts.notifier,
+	}
+}
+
+func TestBrokerProvisionAndDeprovision(t *testing.T) {
+	server := fakeatc.New("admin", "password")
+	defer server.Close()
+	serviceBroker := newTestBroker(t, nil, testBrokerOptions{server: server})
+	services := serviceBroker.services
+	provisionDetails := brokerapi.ProvisionDetails{
+		ServiceID: services[0].ID,
+		PlanID:    services[0].Plans[0].ID,
+		SpaceGUID: "space-guid",
+	}
+
+	_, err := serviceBroker.Provision(context.Background(), "instance-id", provisionDetails, false)
+	if err != nil {
+		t.Fatal("Provision returned error: " + err.Error())
+	}
+	if _, found := server.Team("my-org"); !found {
+		t.Error("Provision didn't create team my-org")
+	}
+
+	_, err = serviceBroker.Deprovision(context.Background(), "instance-id", brokerapi.DeprovisionDetails{}, false)
+	if err != nil {
+		t.Fatal("Deprovision returned error: " + err.Error())
+	}
+	if _, found := server.Team("my-org"); found {
+		t.Error("Deprovision didn't delete team my-org")
+	}
+	if _, found, _ := serviceBroker.store.Get("instance-id"); found {
+		t.Error("Deprovision didn't delete the instance record")
+	}
+}
+
+func TestBrokerDedicatedWorkers(t *testing.T) {
+	server := fakeatc.New("admin", "password")
+	defer server.Close()
+	keysDir, err := ioutil.TempDir("", "authorized-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(keysDir)
+	services, _ := CatalogLoad("./catalog.json")
+	planID := services[0].Plans[0].ID
+	serviceBroker := newTestBroker(t, map[string]planConfig{planID: {DedicatedWorkers: true, WorkerTags: []string{"large"}}}, testBrokerOptions{
+		server: server,
+		config: brokerConfig{TSAHost: "ci.example.com:2222", TSATeamAuthorizedKeysDir: keysDir},
+	})
+
+	_, err = serviceBroker.Provision(context.Background(), "instance-id", brokerapi.ProvisionDetails{
+		ServiceID: services[0].ID,
+		PlanID:    planID,
+		SpaceGUID: "space-guid",
+	}, false)
+	if err != nil {
+		t.Fatal("Provision returned error: " + err.Error())
+	}
+	authorizedKey, err := ioutil.ReadFile(filepath.Join(keysDir, "my-org"))
+	if err != nil {
+		t.Fatal("Provision didn't authorize the workers of team my-org: " + err.Error())
+	}
+
+	binding, err := serviceBroker.Bind(context.Background(), "instance-id", "binding-id", brokerapi.BindDetails{PlanID: planID})
+	if err != nil {
+		t.Fatal("Bind returned error: " + err.Error())
+	}
+	credentials := binding.Credentials.(serviceKeyCredentials)
+	if credentials.workerCredentials == nil {
+		t.Fatal("Expected the service key to hold the worker registration")
+	}
+	if credentials.Team != "my-org" || credentials.TSAHost != "ci.example.com:2222" || len(credentials.Tags) != 1 {
+		t.Errorf("Unexpected worker credentials: %+v", credentials)
+	}
+	if credentials.WorkerPublicKey+"\n" != string(authorizedKey) {
+		t.Error("The bound key doesn't match the authorized key")
+	}
+
+	server.AddWorker(atc.Worker{Name: "stalled-worker", Team: "my-org", State: "stalled"})
+	server.AddWorker(atc.Worker{Name: "shared-worker", State: "stalled"})
+	_, err = serviceBroker.Deprovision(context.Background(), "instance-id", brokerapi.DeprovisionDetails{}, false)
+	if err != nil {
+		t.Fatal("Deprovision returned error: " + err.Error())
+	}
+	if workers := server.WorkerNames(); len(workers) != 1 || workers[0] != "shared-worker" {
+		t.Errorf("Expected only the worker of team my-org to be pruned but got: %v", workers)
+	}
+	if _, err := os.Stat(filepath.Join(keysDir, "my-org")); !os.IsNotExist(err) {
+		t.Error("Deprovision didn't remove the authorized key of team my-org")
+	}
+}
+
+func TestBrokerProvisionSetsPipelines(t *testing.T) {
+	server := fakeatc.New("admin", "password")
+	defer server.Close()
+	services, _ := CatalogLoad("./catalog.json")
+	planID := services[0].Plans[0].ID
+	serviceBroker := newTestBroker(t, map[string]planConfig{planID: {
+		WorkerTags: []string{"large"},
+		Pipelines:  []pipelineTemplate{{Name: "bootstrap", Config: testPipelineConfig()}},
+	}}, testBrokerOptions{server: server})
+
+	_, err := serviceBroker.Provision(context.Background(), "instance-id", brokerapi.ProvisionDetails{
+		ServiceID: services[0].ID,
+		PlanID:    planID,
+		SpaceGUID: "space-guid",
+	}, false)
+	if err != nil {
+		t.Fatal("Provision returned error: " + err.Error())
+	}
+	pipeline, found := server.PipelineConfig("my-org", "bootstrap")
+	if !found {
+		t.Fatal("Provision didn't set pipeline bootstrap")
+	}
+	if tags := pipeline.Jobs[0].Plan[0].Tags; len(tags) != 1 || tags[0] != "large" {
+		t.Errorf("Expected the steps of pipeline bootstrap to be tagged large but got: %v", tags)
+	}
+}
+
+func TestBrokerProvisionSeedsSecrets(t *testing.T) {
+	server := fakeatc.New("admin", "password")
+	defer server.Close()
+	vault, vaultClient := newTestVault()
+	defer vault.Close()
+	serviceBroker := newTestBroker(t, nil, testBrokerOptions{server: server, credentials: vaultClient})
+	services := serviceBroker.services
+
+	_, err := serviceBroker.Provision(context.Background(), "instance-id", brokerapi.ProvisionDetails{
+		ServiceID:     services[0].ID,
+		PlanID:        services[0].Plans[0].ID,
+		SpaceGUID:     "space-guid",
+		RawParameters: []byte(`{"secrets": {"docker-password": "hunter2"}}`),
+	}, false)
+	if err != nil {
+		t.Fatal("Provision returned error: " + err.Error())
+	}
+	if _, found := vault.Secret("concourse/my-org/docker-password"); !found {
+		t.Error("Provision didn't seed the secret")
+	}
+	record, _, _ := serviceBroker.store.Get("instance-id")
+	if strings.Contains(string(record.Parameters), "hunter2") {
+		t.Error("The instance record holds the secret")
+	}
+
+	_, err = serviceBroker.Deprovision(context.Background(), "instance-id", brokerapi.DeprovisionDetails{}, false)
+	if err != nil {
+		t.Fatal("Deprovision returned error: " + err.Error())
+	}
+	if len(vault.Mounts()) != 0 {
+		t.Error("Deprovision didn't remove the secrets of the team")
+	}
+}
+
+func TestBrokerProvisionLeavesForeignSecrets(t *testing.T) {
+	server := fakeatc.New("admin", "password")
+	defer server.Close()
+	vault, vaultClient := newTestVault()
+	defer vault.Close()
+	vault.Mount("concourse/my-org")
+	serviceBroker := newTestBroker(t, nil, testBrokerOptions{server: server, credentials: vaultClient})
+	services := serviceBroker.services
+
+	_, err := serviceBroker.Provision(context.Background(), "instance-id", brokerapi.ProvisionDetails{
+		ServiceID: services[0].ID,
+		PlanID:    services[0].Plans[0].ID,
+		SpaceGUID: "space-guid",
+	}, false)
+	if err != brokerapi.ErrInstanceAlreadyExists {
+		t.Errorf("Expected ErrInstanceAlreadyExists for a mount the broker didn't create but got: %v", err)
+	}
+	if mounts := vault.Mounts(); len(mounts) != 1 {
+		t.Error("Provision removed the mount it didn't create")
+	}
+	if _, found := server.Team("my-org"); found {
+		t.Error("Provision didn't roll back team my-org")
+	}
+}
+
+func TestBrokerDeprovisionWithoutRecordLeavesSecrets(t *testing.T) {
+	server := fakeatc.New("admin", "password")
+	defer server.Close()
+	server.AddTeam(atc.Team{Name: "my-org"})
+	vault, vaultClient := newTestVault()
+	defer vault.Close()
+	vault.Mount("concourse/my-org")
+	serviceBroker := newTestBroker(t, nil, testBrokerOptions{server: server, credentials: vaultClient})
+
+	_, err := serviceBroker.Deprovision(context.Background(), "instance-id", brokerapi.DeprovisionDetails{}, false)
+	if err != nil {
+		t.Fatal("Deprovision returned error: " + err.Error())
+	}
+	if mounts := vault.Mounts(); len(mounts) != 1 {
+		t.Error("Deprovision removed a mount the broker has no record of")
+	}
+}
+
+func TestBrokerBindApp(t *testing.T) {
+	credhub, credhubClient := newTestCredHub()
+	defer credhub.Close()
+	serviceBroker := newTestBroker(t, nil, testBrokerOptions{credentials: credhubClient})
+	services := serviceBroker.services
+	serviceBroker.store.Put(instanceRecord{InstanceID: "instance-id", ServiceID: services[0].ID, PlanID: services[0].Plans[0].ID, TeamName: "my-org"})
+
+	details := brokerapi.BindDetails{AppGUID: "app-guid", PlanID: services[0].Plans[0].ID, ServiceID: services[0].ID}
+	binding, err := serviceBroker.Bind(context.Background(), "instance-id", "binding-id", details)
+	if err != nil {
+		t.Fatal("Bind returned error: " + err.Error())
+	}
+	credentials := binding.Credentials.(map[string]interface{})
+	if credentials["credhub_path"] != "/concourse/my-org" {
+		t.Errorf("Expected the CredHub path of the team but got: %v", credentials)
+	}
+	if _, found := credhub.Permission("/concourse/my-org/*", "mtls-app:app-guid"); !found {
+		t.Error("Bind didn't grant the app access to the team")
+	}
+	_, err = serviceBroker.Bind(context.Background(), "instance-id", "binding-id", details)
+	if err != brokerapi.ErrBindingAlreadyExists {
+		t.Errorf("Expected ErrBindingAlreadyExists for a repeated bind but got: %v", err)
+	}
+
+	err = serviceBroker.Unbind(context.Background(), "instance-id", "binding-id", brokerapi.UnbindDetails{PlanID: details.PlanID})
+	if err != nil {
+		t.Fatal("Unbind returned error: " + err.Error())
+	}
+	if _, found := credhub.Permission("/concourse/my-org/*", "mtls-app:app-guid"); found {
+		t.Error("Unbind didn't revoke the access of the app")
+	}
+	err = serviceBroker.Unbind(context.Background(), "instance-id", "binding-id", brokerapi.UnbindDetails{PlanID: details.PlanID})
+	if err != brokerapi.ErrBindingDoesNotExist {
+		t.Errorf("Expected ErrBindingDoesNotExist for a repeated unbind but got: %v", err)
+	}
+}
+
+func TestBrokerBindAppWithWorkers(t *testing.T) {
+	credhub, credhubClient := newTestCredHub()
+	defer credhub.Close()
+	services, _ := CatalogLoad("./catalog.json")
+	planID := services[0].Plans[0].ID
+	serviceBroker := newTestBroker(t, map[string]planConfig{planID: {DedicatedWorkers: true}}, testBrokerOptions{
+		config:      brokerConfig{TSAHost: "ci.example.com:2222"},
+		credentials: credhubClient,
+	})
+	serviceBroker.store.Put(instanceRecord{InstanceID: "instance-id", ServiceID: services[0].ID, PlanID: planID, TeamName: "my-org", Workers: &workerKey{PrivateKey: "private-key", PublicKey: "public-key"}})
+
+	binding, err := serviceBroker.Bind(context.Background(), "instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "app-guid", PlanID: planID, ServiceID: services[0].ID})
+	if err != nil {
+		t.Fatal("Bind returned error: " + err.Error())
+	}
+	credentials := binding.Credentials.(map[string]interface{})
+	if credentials["credhub_path"] != "/concourse/my-org" || credentials["tsa_host"] != "ci.example.com:2222" || credentials["worker_private_key"] != "private-key" {
+		t.Errorf("Expected both the CredHub path and the worker registration but got: %v", credentials)
+	}
+}
+
+func TestBrokerServiceKey(t *testing.T) {
+	serviceBroker := newTestBroker(t, nil, testBrokerOptions{config: brokerConfig{ConcourseURL: "https://ci.example.com"}})
+	services := serviceBroker.services
+	serviceBroker.store.Put(instanceRecord{InstanceID: "instance-id", ServiceID: services[0].ID, PlanID: services[0].Plans[0].ID, TeamName: "my-org"})
+
+	details := brokerapi.BindDetails{PlanID: services[0].Plans[0].ID, ServiceID: services[0].ID}
+	binding, err := serviceBroker.Bind(context.Background(), "instance-id", "key-id", details)
+	if err != nil {
+		t.Fatal("Bind returned error: " + err.Error())
+	}
+	credentials := binding.Credentials.(serviceKeyCredentials)
+	if credentials.ConcourseURL != "https://ci.example.com" || credentials.Team != "my-org" {
+		t.Errorf("Unexpected service key: %+v", credentials)
+	}
+
+	err = serviceBroker.Unbind(context.Background(), "instance-id", "key-id", brokerapi.UnbindDetails{PlanID: details.PlanID})
+	if err != nil {
+		t.Fatal("Unbind returned error: " + err.Error())
+	}
+	err = serviceBroker.Unbind(context.Background(), "instance-id", "key-id", brokerapi.UnbindDetails{PlanID: details.PlanID})
+	if err != brokerapi.ErrBindingDoesNotExist {
+		t.Errorf("Expected ErrBindingDoesNotExist for a deleted service key but got: %v", err)
+	}
+}
+
+func TestBrokerBindConcurrently(t *testing.T) {
+	serviceBroker := newTestBroker(t, nil, testBrokerOptions{config: brokerConfig{ConcourseURL: "https://ci.example.com"}})
+	services := serviceBroker.services
+	serviceBroker.store.Put(instanceRecord{InstanceID: "instance-id", ServiceID: services[0].ID, PlanID: services[0].Plans[0].ID, TeamName: "my-org"})
+
+	details := brokerapi.BindDetails{PlanID: services[0].Plans[0].ID, ServiceID: services[0].ID}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bindingID := fmt.Sprintf("key-%d", i)
+			_, err := serviceBroker.Bind(context.Background(), "instance-id", bindingID, details)
+			if err != nil {
+				t.Errorf("Bind of %s returned error: %v", bindingID, err)
+			}
+			if i%2 == 1 {
+				serviceBroker.store.List()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	record, _, _ := serviceBroker.store.Get("instance-id")
+	if len(record.Bindings) != 8 {
+		t.Errorf("Expected 8 recorded bindings but got %d: %v", len(record.Bindings), record.Bindings)
+	}
+	record.Bindings["key-0"] = bindingRecord{Drain: "changed"}
+	stored, _, _ := serviceBroker.store.Get("instance-id")
+	if stored.Bindings["key-0"] != (bindingRecord{}) {
+		t.Errorf("Expected the stored binding to be unchanged but got: %+v", stored.Bindings["key-0"])
+	}
+}
+
+func TestBrokerBindPipeline(t *testing.T) {
+	server := fakeatc.New("admin", "password")
+	defer server.Close()
+	server.AddTeam(atc.Team{Name: "my-org"})
+	services, _ := CatalogLoad("./catalog.json")
+	planID := services[0].Plans[0].ID
+	serviceBroker := newTestBroker(t, map[string]planConfig{planID: {WorkerTags: []string{"large"}}}, testBrokerOptions{server: server})
+	serviceBroker.store.Put(instanceRecord{InstanceID: "instance-id", ServiceID: services[0].ID, PlanID: planID, TeamName: "my-org"})
+
+	pipelineConfig, _ := json.Marshal(testPipelineConfig())
+	details := brokerapi.BindDetails{
+		AppGUID:       "app-guid",
+		PlanID:        planID,
+		ServiceID:     services[0].ID,
+		RawParameters: []byte(`{"pipeline": "my-app", "config": ` + string(pipelineConfig) + `}`),
+	}
+	binding, err := serviceBroker.Bind(context.Background(), "instance-id", "binding-id", details)
+	if err != nil {
+		t.Fatal("Bind returned error: " + err.Error())
+	}
+	if credentials := binding.Credentials.(pipelineCredentials); credentials.Pipeline != "my-app" {
+		t.Errorf("Unexpected pipeline credentials: %+v", credentials)
+	}
+	pipeline, found := server.PipelineConfig("my-org", "my-app")
+	if !found {
+		t.Fatal("Bind didn't set pipeline my-app")
+	}
+	if tags := pipeline.Jobs[0].Plan[0].Tags; len(tags) != 1 || tags[0] != "large" {
+		t.Errorf("Expected the steps of pipeline my-app to be tagged large but got: %v", tags)
+	}
+	_, err = serviceBroker.Bind(context.Background(), "instance-id", "other-binding-id", details)
+	if kind, _ := errorKindOf(err); kind != kindInvalidInput {
+		t.Errorf("Expected an invalid input error for a pipeline set by another binding but got: %v", err)
+	}
+	server.SetPipeline("my-org", "set-with-fly", atc.Config{}, true)
+	details.RawParameters = []byte(`{"pipeline": "set-with-fly", "config": ` + string(pipelineConfig) + `}`)
+	_, err = serviceBroker.Bind(context.Background(), "instance-id", "fly-binding-id", details)
+	if kind, _ := errorKindOf(err); kind != kindConflict {
+		t.Errorf("Expected a conflict for a pipeline set with fly but got: %v", err)
+	}
+	if pipeline, _ := server.PipelineConfig("my-org", "set-with-fly"); len(pipeline.Jobs) != 0 {
+		t.Error("Bind replaced the pipeline set with fly")
+	}
+
+	err = serviceBroker.Unbind(context.Background(), "instance-id", "binding-id", brokerapi.UnbindDetails{PlanID: planID})
+	if err != nil {
+		t.Fatal("Unbind returned error: " + err.Error())
+	}
+	if _, found := server.PipelineConfig("my-org", "my-app"); found {
+		t.Error("Unbind didn't delete pipeline my-app")
+	}
+}
+
+func TestBrokerUpdateRejectsPlanChangeOfSetUp(t *testing.T) {
+	server := fakeatc.New("admin", "password")
+	defer server.Close()
+	server.AddTeam(atc.Team{Name: "my-org"})
+	services, _ := CatalogLoad("./catalog.json")
+	planID := services[0].Plans[0].ID
+	serviceBroker := newTestBroker(t, map[string]planConfig{
+		planID:    {WorkerTags: []string{"small"}},
+		"larger":  {WorkerTags: []string{"small"}, Quota: quotaConfig{MaxPipelinesPerTeam: 10}},
+		"workers": {DedicatedWorkers: true, WorkerTags: []string{"small"}},
+	}, testBrokerOptions{server: server})
+	serviceBroker.services[0].Plans = append(serviceBroker.services[0].Plans, brokerapi.ServicePlan{ID: "larger"}, brokerapi.ServicePlan{ID: "workers"})
+	serviceBroker.store.Put(instanceRecord{InstanceID: "instance-id", ServiceID: services[0].ID, PlanID: planID, TeamName: "my-org"})
+
+	err := serviceBroker.update(context.Background(), "instance-id", brokerapi.UpdateDetails{ServiceID: services[0].ID, PlanID: "workers"})
+	if err != brokerapi.ErrPlanChangeNotSupported {
+		t.Errorf("Expected ErrPlanChangeNotSupported for a plan with dedicated workers but got: %v", err)
+	}
+	err = serviceBroker.update(context.Background(), "instance-id", brokerapi.UpdateDetails{ServiceID: services[0].ID, PlanID: "larger"})
+	if err != nil {
+		t.Fatal("Update to a plan with other quotas returned error: " + err.Error())
+	}
+	if record, _, _ := serviceBroker.store.Get("instance-id"); record.PlanID != "larger" {
+		t.Error("Update didn't change the plan to larger but to " + record.PlanID)
+	}
+}
+
+func TestBrokerUpdateWithoutRecord(t *testing.T) {
+	serviceBroker := newTestBroker(t, nil, testBrokerOptions{})
+	services := serviceBroker.services
+	details := brokerapi.UpdateDetails{
+		ServiceID:      services[0].ID,
+		PlanID:         services[0].Plans[0].ID,
+		PreviousValues: brokerapi.PreviousValues{PlanID: "other-plan"},
+	}
+
+	err := serviceBroker.update(context.Background(), "instance-id", details)
+	if kind, _ := errorKindOf(err); kind != kindNotFound {
+		t.Errorf("Expected a plan change of an unrecorded instance to fail but got: %v", err)
+	}
+	details.PreviousValues.PlanID = details.PlanID
+	err = serviceBroker.update(context.Background(), "instance-id", details)
+	if err != nil {
+		t.Error("Update of an unrecorded instance without a plan change returned error: " + err.Error())
+	}
+}
+
+func TestBrokerUpdateRecordsMovedSpace(t *testing.T) {
+	serviceBroker := newTestBroker(t, nil, testBrokerOptions{})
+	services := serviceBroker.services
+	serviceBroker.store.Put(instanceRecord{
+		InstanceID: "instance-id",
+		ServiceID:  services[0].ID,
+		PlanID:     services[0].Plans[0].ID,
+		SpaceGUID:  "space-guid",
+		TeamName:   "my-org",
+		Details:    platformDetails{Platform: platformCloudFoundry, OrgName: "my-org", SpaceGUID: "space-guid"},
+	})
+
+	ctx := withPlatformContext(context.Background(), platformContext{SpaceGUID: "other-space-guid"})
+	err := serviceBroker.update(ctx, "instance-id", brokerapi.UpdateDetails{ServiceID: services[0].ID})
+	if err != nil {
+		t.Fatal("Update returned error: " + err.Error())
+	}
+	record, _, _ := serviceBroker.store.Get("instance-id")
+	if record.SpaceGUID != "other-space-guid" || record.Details.SpaceGUID != "other-space-guid" {
+		t.Errorf("Update didn't record the new space: %+v", record)
+	}
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"encoding/json"
 	"io/ioutil"
+	"path/filepath"
+	"reflect"
 
 	"github.com/pivotal-cf/brokerapi"
+	"github.com/pkg/errors"
 )
 
 func CatalogLoad(catalogFilePath string) ([]brokerapi.Service, error) {
@@ -21,3 +24,71 @@ func CatalogLoad(catalogFilePath string) ([]brokerapi.Service, error) {
 	}
 	return services, nil
 }
+
+// planConfig holds the settings of a plan that only concern the broker. They
+// are given under the "concourse" key of the plan in the catalog, which is not
+// served to the platform.
+type planConfig struct {
+	// DedicatedWorkers gives each team a key to register its own workers with.
+	DedicatedWorkers bool `json:"dedicated_workers"`
+	// WorkerTags are the tags the workers of the team are registered with,
+	// and which the pipelines set by the broker are pinned to.
+	WorkerTags []string `json:"worker_tags"`
+	// Pipelines are set in every team provisioned with the plan.
+	Pipelines []pipelineTemplate `json:"pipelines"`
+	Quota     quotaConfig        `json:"quota"`
+	// Auth adds auth providers to every team of the plan. Parameters can add
+	// to them, so validation waits until provisioning.
+	Auth json.RawMessage `json:"auth"`
+}
+
+// sameTeamSetUp reports whether teams of plans a and b are set up the same,
+// so an instance can change between them. Only their quotas may differ.
+func sameTeamSetUp(a, b planConfig) bool {
+	a.Quota, b.Quota = quotaConfig{}, quotaConfig{}
+	return reflect.DeepEqual(a, b)
+}
+
+// PlanConfigsLoad returns the plan configs of the catalog by plan ID, with the
+// pipeline templates they refer to loaded.
+func PlanConfigsLoad(catalogFilePath string) (map[string]planConfig, error) {
+	var services []struct {
+		Plans []struct {
+			ID        string     `json:"id"`
+			Concourse planConfig `json:"concourse"`
+		} `json:"plans"`
+	}
+
+	inBuf, err := ioutil.ReadFile(catalogFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(inBuf, &services)
+	if err != nil {
+		return nil, err
+	}
+	plans := make(map[string]planConfig)
+	for _, service := range services {
+		for _, plan := range service.Plans {
+			config := plan.Concourse
+			for i, template := range config.Pipelines {
+				config.Pipelines[i], err = loadPipelineTemplate(filepath.Dir(catalogFilePath), template, config.WorkerTags)
+				if err != nil {
+					return nil, errors.Wrapf(err, "Plan %s", plan.ID)
+				}
+			}
+			if len(config.Auth) > 0 {
+				_, err = decodeTeamAuth(config.Auth)
+				if err != nil {
+					return nil, errors.Wrapf(err, "Plan %s", plan.ID)
+				}
+			}
+			if config.Quota.MaxPipelinesPerTeam > 0 && len(config.Pipelines) > config.Quota.MaxPipelinesPerTeam {
+				return nil, errors.Errorf("Plan %s sets more pipelines than its quota allows", plan.ID)
+			}
+			plans[plan.ID] = config
+		}
+	}
+	return plans, nil
+}
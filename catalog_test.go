@@ -1,6 +1,10 @@
 package main
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
 
 func TestCatalogLoad(t *testing.T) {
 	jsonFilePath := "./catalog.json"
@@ -27,3 +31,27 @@ func TestCatalogLoadFail(t *testing.T) {
 		t.Error("Catalog array was populated even when a nonexistent json was loaded")
 	}
 }
+
+func TestPlanConfigsLoad(t *testing.T) {
+	catalog, err := ioutil.TempFile("", "catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(catalog.Name())
+	catalog.WriteString(`[{"id": "service", "plans": [
+		{"id": "shared", "name": "shared"},
+		{"id": "dedicated", "name": "dedicated", "concourse": {"dedicated_workers": true, "worker_tags": ["large"]}}
+	]}]`)
+	catalog.Close()
+
+	plans, err := PlanConfigsLoad(catalog.Name())
+	if err != nil {
+		t.Fatal("PlanConfigsLoad returned error: " + err.Error())
+	}
+	if plans["shared"].DedicatedWorkers {
+		t.Error("Expected plan shared to use the shared workers")
+	}
+	if !plans["dedicated"].DedicatedWorkers || len(plans["dedicated"].WorkerTags) != 1 {
+		t.Errorf("Expected plan dedicated to have dedicated workers tagged large but got: %+v", plans["dedicated"])
+	}
+}
@@ -1,93 +1,532 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 
 	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
 )
 
-type cfDetails struct {
-	OrgGUID   string
-	OrgName   string
-	SpaceGUID string
-	SpaceName string
+type IcfClient interface {
+	GetProvisionDetails(ctx context.Context, spaceGUID string) (platformDetails, error)
+	GetDeprovisionDetails(ctx context.Context, serviceGUID string) (platformDetails, error)
+	ListServiceInstances(ctx context.Context, planIDs []string) ([]cfServiceInstance, error)
 }
 
-type IcfClient interface {
-	GetProvisionDetails(spaceGUID string) (cfDetails, error)
-	GetDeprovisionDetails(serviceGUID string) (cfDetails, error)
+type cfServiceInstance struct {
+	GUID    string
+	Name    string
+	PlanID  string
+	Details platformDetails
 }
 
-func cfNewClient(config brokerConfig) (IcfClient, error) {
+func cfNewClient(ctx context.Context, config brokerConfig) (IcfClient, error) {
+	client, err := cfNewClientWithSecret(ctx, config, config.ClientSecret)
+	if err != nil && config.ClientSecretSecondary != "" {
+		// During a rotation UAA may still, or already, only accept the other
+		// secret. The error of the primary one is the more useful to report.
+		if secondary, secondaryErr := cfNewClientWithSecret(ctx, config, config.ClientSecretSecondary); secondaryErr == nil {
+			return secondary, nil
+		}
+	}
+	return client, err
+}
+
+func cfNewClientWithSecret(ctx context.Context, config brokerConfig, clientSecret string) (IcfClient, error) {
 	cfConfig := &cfclient.Config{
 		ClientID:     config.ClientID,
-		ClientSecret: config.ClientSecret,
+		ClientSecret: clientSecret,
 		ApiAddress:   config.CFURL,
+		HttpClient:   &http.Client{Timeout: config.CFTimeout},
 	}
 	client, err := cfclient.NewClient(cfConfig)
+	if err != nil {
+		return nil, classify(err, kindUnavailable, "Cloud Foundry is unavailable")
+	}
+	// NewClient replaces the config's HttpClient with one that is authenticated
+	// against UAA, which is reused for the requests cfclient has no support for.
+	// cfclient requires a plain *http.Transport to start from, so its transport
+	// is swapped afterwards for one that retries below the token handling: only
+	// requests to the Cloud Controller are retried and count against its
+	// breaker, and UAA rejecting the secret is reported as unauthorized.
+	tokenConfig := &clientcredentials.Config{
+		ClientID:     config.ClientID,
+		ClientSecret: clientSecret,
+		TokenURL:     client.Endpoint.TokenEndpoint + "/oauth/token",
+	}
+	tokenClient := &http.Client{Timeout: config.CFTimeout, Transport: &uaaTokenTransport{base: defaultTransport()}}
+	tokenCtx := context.WithValue(context.Background(), oauth2.HTTPClient, tokenClient)
+	cfConfig.HttpClient.Transport = &oauth2.Transport{
+		Source: tokenConfig.TokenSource(tokenCtx),
+		Base:   newRetryTransport(upstreamCloudFoundry, config, defaultTransport()),
+	}
+	c := &cfClient{
+		client:     client,
+		httpClient: cfConfig.HttpClient,
+		apiURL:     strings.TrimSuffix(config.CFURL, "/"),
+	}
+	c.v3, err = c.supportsV3(ctx)
 	if err != nil {
 		return nil, err
 	}
-	return &cfClient{client: client}, nil
+	return c, nil
+}
+
+// uaaTokenTransport turns UAA rejecting the client's credentials into an
+// unauthorized error. oauth2 would report it as a plain error, which couldn't
+// be told apart from UAA being unavailable.
+type uaaTokenTransport struct {
+	base http.RoundTripper
+}
+
+func (t *uaaTokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		return nil, classify(err, kindUnavailable, "Cloud Foundry is unavailable")
+	}
+	if resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		err := errors.Errorf("UAA rejected the client credentials: %s", resp.Status)
+		return nil, classify(err, kindUnauthorized, "The broker is not authorized to access Cloud Foundry")
+	}
+	return resp, nil
+}
+
+// cfLazyClient creates the CF client on first use and shares it between
+// requests, so UAA is only asked for a token when the current one expires.
+// When the Cloud Controller rejects the token anyway the client is dropped and
+// the call is retried once with a new one.
+type cfLazyClient struct {
+	config brokerConfig
+
+	mu     sync.Mutex
+	client IcfClient
+}
+
+func newCFLazyClient(config brokerConfig) IcfClient {
+	return &cfLazyClient{config: config}
+}
+
+func (l *cfLazyClient) get(ctx context.Context) (IcfClient, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.client == nil {
+		client, err := cfNewClient(ctx, l.config)
+		if err != nil {
+			return nil, err
+		}
+		l.client = client
+	}
+	return l.client, nil
+}
+
+func (l *cfLazyClient) reset(client IcfClient) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.client == client {
+		l.client = nil
+	}
+}
+
+func (l *cfLazyClient) do(ctx context.Context, fn func(client IcfClient) error) error {
+	for attempt := 0; ; attempt++ {
+		client, err := l.get(ctx)
+		if err != nil {
+			return err
+		}
+		err = fn(client)
+		if kind, _ := errorKindOf(err); kind == kindUnauthorized && attempt == 0 {
+			l.reset(client)
+			continue
+		}
+		return err
+	}
+}
+
+func (l *cfLazyClient) GetProvisionDetails(ctx context.Context, spaceGUID string) (details platformDetails, err error) {
+	err = l.do(ctx, func(client IcfClient) error {
+		details, err = client.GetProvisionDetails(ctx, spaceGUID)
+		return err
+	})
+	return details, err
+}
+
+func (l *cfLazyClient) GetDeprovisionDetails(ctx context.Context, serviceGUID string) (details platformDetails, err error) {
+	err = l.do(ctx, func(client IcfClient) error {
+		details, err = client.GetDeprovisionDetails(ctx, serviceGUID)
+		return err
+	})
+	return details, err
+}
+
+func (l *cfLazyClient) ListServiceInstances(ctx context.Context, planIDs []string) (instances []cfServiceInstance, err error) {
+	err = l.do(ctx, func(client IcfClient) error {
+		instances, err = client.ListServiceInstances(ctx, planIDs)
+		return err
+	})
+	return instances, err
 }
 
 type cfClient struct {
-	client *cfclient.Client
+	client     *cfclient.Client
+	httpClient *http.Client
+	apiURL     string
+	v3         bool
+}
+
+func (c *cfClient) GetProvisionDetails(ctx context.Context, spaceGUID string) (platformDetails, error) {
+	if !c.v3 {
+		return c.getSpaceDetailsV2(ctx, spaceGUID)
+	}
+	return c.getSpaceDetails(ctx, spaceGUID)
 }
 
-func (c *cfClient) GetProvisionDetails(spaceGUID string) (cfDetails, error) {
-	requestURI := fmt.Sprintf("/v2/spaces/%s", spaceGUID)
-	orgName, err := c.getOrgName(requestURI)
+func (c *cfClient) GetDeprovisionDetails(ctx context.Context, serviceGUID string) (platformDetails, error) {
+	if !c.v3 {
+		var instance cfclient.ServiceInstanceResource
+		err := c.get(ctx, "/v2/service_instances/"+serviceGUID, &instance)
+		if err != nil {
+			return platformDetails{}, errors.Wrap(err, "Error requesting service instance")
+		}
+		return c.getSpaceDetailsV2(ctx, instance.Entity.SpaceGuid)
+	}
+	var instance v3ServiceInstance
+	err := c.get(ctx, "/v3/service_instances/"+serviceGUID, &instance)
 	if err != nil {
-		return cfDetails{}, err
+		return platformDetails{}, errors.Wrap(err, "Error requesting service instance")
 	}
-	return cfDetails{OrgName: orgName}, nil
+	return c.getSpaceDetails(ctx, instance.Relationships.Space.Data.GUID)
 }
 
-func (c *cfClient) GetDeprovisionDetails(serviceGUID string) (cfDetails, error) {
-	serviceInstance, err := c.client.ServiceInstanceByGuid(serviceGUID)
+// ListServiceInstances returns every instance of the given catalog plans
+// together with the org and space it lives in.
+func (c *cfClient) ListServiceInstances(ctx context.Context, planIDs []string) ([]cfServiceInstance, error) {
+	if !c.v3 {
+		return c.listServiceInstancesV2(ctx, planIDs)
+	}
+	var planGUIDs []string
+	catalogIDs := make(map[string]string)
+	query := url.Values{"broker_catalog_ids": {strings.Join(planIDs, ",")}}
+	err := c.list(ctx, "/v3/service_plans?"+query.Encode(), func(page v3Page) error {
+		var plans []v3ServicePlan
+		if err := json.Unmarshal(page.Resources, &plans); err != nil {
+			return err
+		}
+		for _, plan := range plans {
+			planGUIDs = append(planGUIDs, plan.GUID)
+			catalogIDs[plan.GUID] = plan.BrokerCatalog.ID
+		}
+		return nil
+	})
 	if err != nil {
-		return cfDetails{}, err
+		return nil, errors.Wrap(err, "Error requesting service plans")
+	}
+	if len(planGUIDs) == 0 {
+		return nil, nil
 	}
-	orgName, err := c.getOrgName(serviceInstance.SpaceUrl)
+
+	var instances []cfServiceInstance
+	query = url.Values{
+		"service_plan_guids":         {strings.Join(planGUIDs, ",")},
+		"fields[space]":              {"guid,name,relationships.organization"},
+		"fields[space.organization]": {"guid,name"},
+	}
+	err = c.list(ctx, "/v3/service_instances?"+query.Encode(), func(page v3Page) error {
+		var resources []v3ServiceInstance
+		if err := json.Unmarshal(page.Resources, &resources); err != nil {
+			return err
+		}
+		spaces := make(map[string]v3Space)
+		for _, space := range page.Included.Spaces {
+			spaces[space.GUID] = space
+		}
+		orgs := make(map[string]v3Resource)
+		for _, org := range page.Included.Organizations {
+			orgs[org.GUID] = org
+		}
+		for _, resource := range resources {
+			space := spaces[resource.Relationships.Space.Data.GUID]
+			org := orgs[space.Relationships.Organization.Data.GUID]
+			instances = append(instances, cfServiceInstance{
+				GUID:   resource.GUID,
+				Name:   resource.Name,
+				PlanID: catalogIDs[resource.Relationships.ServicePlan.Data.GUID],
+				Details: platformDetails{
+					Platform:  platformCloudFoundry,
+					OrgGUID:   org.GUID,
+					OrgName:   org.Name,
+					SpaceGUID: space.GUID,
+					SpaceName: space.Name,
+				},
+			})
+		}
+		return nil
+	})
 	if err != nil {
-		return cfDetails{}, err
+		return nil, errors.Wrap(err, "Error requesting service instances")
 	}
-	return cfDetails{OrgName: orgName}, nil
+	return instances, nil
 }
 
-func (c *cfClient) getOrgName(requestUrl string) (string, error) {
+type v3Relationship struct {
+	Data struct {
+		GUID string `json:"guid"`
+	} `json:"data"`
+}
+
+type v3Resource struct {
+	GUID string `json:"guid"`
+	Name string `json:"name"`
+}
+
+type v3Space struct {
+	v3Resource
+	Relationships struct {
+		Organization v3Relationship `json:"organization"`
+	} `json:"relationships"`
+	Included struct {
+		Organizations []v3Resource `json:"organizations"`
+	} `json:"included"`
+}
+
+type v3ServiceInstance struct {
+	v3Resource
+	Relationships struct {
+		Space       v3Relationship `json:"space"`
+		ServicePlan v3Relationship `json:"service_plan"`
+	} `json:"relationships"`
+}
+
+type v3ServicePlan struct {
+	v3Resource
+	BrokerCatalog struct {
+		ID string `json:"id"`
+	} `json:"broker_catalog"`
+}
+
+type v3Page struct {
+	Pagination struct {
+		Next *struct {
+			Href string `json:"href"`
+		} `json:"next"`
+	} `json:"pagination"`
+	Resources json.RawMessage `json:"resources"`
+	Included  struct {
+		Spaces        []v3Space    `json:"spaces"`
+		Organizations []v3Resource `json:"organizations"`
+	} `json:"included"`
+}
+
+// getSpaceDetails resolves a space and its org in a single round trip.
+func (c *cfClient) getSpaceDetails(ctx context.Context, spaceGUID string) (platformDetails, error) {
+	var space v3Space
+	err := c.get(ctx, "/v3/spaces/"+spaceGUID+"?include=organization", &space)
+	if err != nil {
+		return platformDetails{}, spaceError(err, spaceGUID)
+	}
+	if len(space.Included.Organizations) == 0 {
+		return platformDetails{}, errors.Errorf("No organization included for space %s", spaceGUID)
+	}
+	org := space.Included.Organizations[0]
+	return platformDetails{
+		Platform:  platformCloudFoundry,
+		OrgGUID:   org.GUID,
+		OrgName:   org.Name,
+		SpaceGUID: space.GUID,
+		SpaceName: space.Name,
+	}, nil
+}
+
+func (c *cfClient) getSpaceDetailsV2(ctx context.Context, spaceGUID string) (platformDetails, error) {
 	var spaceResp cfclient.SpaceResource
-	r := c.client.NewRequest("GET", requestUrl)
-	resp, err := c.client.DoRequest(r)
+	err := c.get(ctx, "/v2/spaces/"+spaceGUID+"?inline-relations-depth=1", &spaceResp)
 	if err != nil {
-		return "", fmt.Errorf("Error requesting spaces %v", err)
+		return platformDetails{}, spaceError(err, spaceGUID)
 	}
-	resBody, err := ioutil.ReadAll(resp.Body)
-	defer resp.Body.Close()
+	return platformDetails{
+		Platform:  platformCloudFoundry,
+		OrgGUID:   spaceResp.Entity.OrgData.Meta.Guid,
+		OrgName:   spaceResp.Entity.OrgData.Entity.Name,
+		SpaceGUID: spaceResp.Meta.Guid,
+		SpaceName: spaceResp.Entity.Name,
+	}, nil
+}
+
+// spaceError turns a missing space into invalid input, as spaces are looked
+// up by the GUID the platform sent along with the request.
+func spaceError(err error, spaceGUID string) error {
+	if kind, _ := errorKindOf(err); kind == kindNotFound {
+		err = classify(err, kindInvalidInput, "Space "+spaceGUID+" does not exist")
+	}
+	return errors.Wrap(err, "Error requesting space")
+}
+
+// listServiceInstancesV2 relies on cfclient's helpers, which take no context.
+// Only the client's timeout bounds their requests.
+func (c *cfClient) listServiceInstancesV2(ctx context.Context, planIDs []string) ([]cfServiceInstance, error) {
+	plans, err := c.client.ListServicePlansByQuery(url.Values{
+		"q": {"unique_id IN " + strings.Join(planIDs, ",")},
+	})
 	if err != nil {
-		return "", fmt.Errorf("Error reading space request %v", err)
+		return nil, err
 	}
-	err = json.Unmarshal(resBody, &spaceResp)
+	if len(plans) == 0 {
+		return nil, nil
+	}
+	var planGUIDs []string
+	catalogIDs := make(map[string]string)
+	for _, plan := range plans {
+		planGUIDs = append(planGUIDs, plan.Guid)
+		catalogIDs[plan.Guid] = plan.UniqueId
+	}
+	serviceInstances, err := c.client.ListServiceInstancesByQuery(url.Values{
+		"q": {"service_plan_guid IN " + strings.Join(planGUIDs, ",")},
+	})
 	if err != nil {
-		return "", fmt.Errorf("Error unmarshalling space %v", err)
+		return nil, err
 	}
-	var orgResp cfclient.OrgResource
-	r = c.client.NewRequest("GET", spaceResp.Entity.OrgURL)
-	resp, err = c.client.DoRequest(r)
+	var instances []cfServiceInstance
+	for _, serviceInstance := range serviceInstances {
+		details, err := c.getSpaceDetailsV2(ctx, serviceInstance.SpaceGuid)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, cfServiceInstance{
+			GUID:    serviceInstance.Guid,
+			Name:    serviceInstance.Name,
+			PlanID:  catalogIDs[serviceInstance.ServicePlanGuid],
+			Details: details,
+		})
+	}
+	return instances, nil
+}
+
+// supportsV3 detects foundations that predate the v3 API, for which the
+// broker falls back to the v2 endpoints.
+func (c *cfClient) supportsV3(ctx context.Context) (bool, error) {
+	req, err := http.NewRequest("GET", c.apiURL+"/v3", nil)
 	if err != nil {
-		return "", fmt.Errorf("Error requesting orgs %v", err)
+		return false, err
 	}
-	resBody, err = ioutil.ReadAll(resp.Body)
-	defer resp.Body.Close()
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, classifyCFRequestError(errors.Wrap(err, "Error requesting v3 root"))
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// list follows the pagination links of a v3 list endpoint, handing every page
+// to fn.
+func (c *cfClient) list(ctx context.Context, path string, fn func(page v3Page) error) error {
+	for path != "" {
+		var page v3Page
+		err := c.get(ctx, path, &page)
+		if err != nil {
+			return err
+		}
+		err = fn(page)
+		if err != nil {
+			return err
+		}
+		path = ""
+		if page.Pagination.Next != nil {
+			path = page.Pagination.Next.Href
+		}
+	}
+	return nil
+}
+
+func (c *cfClient) get(ctx context.Context, path string, out interface{}) error {
+	if !strings.HasPrefix(path, "http") {
+		path = c.apiURL + path
+	}
+	req, err := http.NewRequest("GET", path, nil)
 	if err != nil {
-		return "", fmt.Errorf("Error reading org request %v", err)
+		return err
 	}
-	err = json.Unmarshal(resBody, &orgResp)
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
 	if err != nil {
-		return "", fmt.Errorf("Error unmarshalling org %v", err)
+		return classifyCFRequestError(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return classify(err, kindUnavailable, "Cloud Foundry is unavailable")
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return classifyCFError(resp.StatusCode, decodeCFError(resp.StatusCode, body))
+	}
+	return json.Unmarshal(body, out)
+}
+
+// classifyCFRequestError classifies a request that got no response, keeping
+// the classification of the token transport if UAA rejected the credentials.
+func classifyCFRequestError(err error) error {
+	if kind, _ := errorKindOf(err); kind != "" {
+		return err
+	}
+	return classify(err, kindUnavailable, "Cloud Foundry is unavailable")
+}
+
+// classifyCFError classifies an error response of the Cloud Controller by its
+// status code.
+func classifyCFError(statusCode int, err error) error {
+	switch {
+	case isCFNotFound(err):
+		return classify(err, kindNotFound, "The Cloud Foundry resource does not exist")
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return classify(err, kindUnauthorized, "The broker is not authorized to access Cloud Foundry")
+	case statusCode >= http.StatusInternalServerError:
+		return classify(err, kindUnavailable, "Cloud Foundry is unavailable")
+	}
+	return err
+}
+
+// isCFNotFound reports whether err is the Cloud Controller's response for a
+// resource that doesn't exist.
+func isCFNotFound(err error) bool {
+	cfErr, ok := errors.Cause(err).(cfclient.CloudFoundryError)
+	if !ok {
+		return false
+	}
+	switch cfErr.Code {
+	case 10010, 40004, 60004, http.StatusNotFound:
+		return true
+	}
+	return false
+}
+
+// decodeCFError turns an error response of either API version into a
+// cfclient.CloudFoundryError.
+func decodeCFError(statusCode int, body []byte) error {
+	var v3Errors cfclient.CloudFoundryErrors
+	if json.Unmarshal(body, &v3Errors) == nil && len(v3Errors.Errors) > 0 {
+		return v3Errors.Errors[0]
+	}
+	var v2Error struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+		ErrorCode   string `json:"error_code"`
+	}
+	if json.Unmarshal(body, &v2Error) == nil && v2Error.ErrorCode != "" {
+		return cfclient.CloudFoundryError{
+			Code:   v2Error.Code,
+			Title:  v2Error.ErrorCode,
+			Detail: v2Error.Description,
+		}
+	}
+	return cfclient.CloudFoundryError{
+		Code:   statusCode,
+		Title:  http.StatusText(statusCode),
+		Detail: string(body),
 	}
-	return orgResp.Entity.Name, nil
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/pkg/errors"
+	"github.com/vchrisr/cf-concourse-broker/fakes/fakecf"
+)
+
+func TestDecodeCFErrorV3(t *testing.T) {
+	body := []byte(`{"errors":[{"code":10010,"title":"CF-ResourceNotFound","detail":"Space not found"}]}`)
+	err := decodeCFError(404, body)
+	cfErr, ok := err.(cfclient.CloudFoundryError)
+	if !ok {
+		t.Fatalf("Expected a cfclient.CloudFoundryError but got: %T", err)
+	}
+	if cfErr.Code != 10010 || cfErr.Title != "CF-ResourceNotFound" {
+		t.Errorf("Unexpected error decoded: %+v", cfErr)
+	}
+}
+
+func TestDecodeCFErrorV2(t *testing.T) {
+	body := []byte(`{"code":40004,"description":"The app space could not be found","error_code":"CF-SpaceNotFound"}`)
+	err := decodeCFError(404, body)
+	cfErr, ok := err.(cfclient.CloudFoundryError)
+	if !ok {
+		t.Fatalf("Expected a cfclient.CloudFoundryError but got: %T", err)
+	}
+	if cfErr.Code != 40004 || cfErr.Title != "CF-SpaceNotFound" {
+		t.Errorf("Unexpected error decoded: %+v", cfErr)
+	}
+}
+
+func TestDecodeCFErrorUnknownBody(t *testing.T) {
+	err := decodeCFError(502, []byte("Bad Gateway"))
+	cfErr, ok := err.(cfclient.CloudFoundryError)
+	if !ok {
+		t.Fatalf("Expected a cfclient.CloudFoundryError but got: %T", err)
+	}
+	if cfErr.Code != 502 {
+		t.Errorf("Expected the status code to be used but got: %d", cfErr.Code)
+	}
+}
+
+func newTestCF(t *testing.T) *fakecf.Server {
+	server := fakecf.New("concourse", "secret")
+	server.AddOrg(fakecf.Org{GUID: "org-guid", Name: "my-org"})
+	server.AddSpace(fakecf.Space{GUID: "space-guid", Name: "dev", OrgGUID: "org-guid"})
+	server.AddServicePlan(fakecf.ServicePlan{GUID: "plan-guid", CatalogID: "catalog-plan-id"})
+	server.AddServiceInstance(fakecf.ServiceInstance{GUID: "instance-guid", Name: "ci", SpaceGUID: "space-guid", ServicePlanGUID: "plan-guid"})
+	return server
+}
+
+func testCFConfig(server *fakecf.Server) brokerConfig {
+	return brokerConfig{CFURL: server.URL, ClientID: "concourse", ClientSecret: "secret"}
+}
+
+func TestCFProvisionAndDeprovisionDetails(t *testing.T) {
+	for _, v2Only := range []bool{false, true} {
+		server := newTestCF(t)
+		if v2Only {
+			server.DisableV3()
+		}
+
+		client, err := cfNewClient(context.Background(), testCFConfig(server))
+		if err != nil {
+			t.Fatal("cfNewClient returned error: " + err.Error())
+		}
+		details, err := client.GetProvisionDetails(context.Background(), "space-guid")
+		if err != nil {
+			t.Fatal("GetProvisionDetails returned error: " + err.Error())
+		}
+		if details.OrgName != "my-org" || details.OrgGUID != "org-guid" || details.SpaceName != "dev" {
+			t.Errorf("Unexpected provision details (v2 only: %t): %+v", v2Only, details)
+		}
+
+		details, err = client.GetDeprovisionDetails(context.Background(), "instance-guid")
+		if err != nil {
+			t.Fatal("GetDeprovisionDetails returned error: " + err.Error())
+		}
+		if details.OrgName != "my-org" || details.SpaceGUID != "space-guid" {
+			t.Errorf("Unexpected deprovision details (v2 only: %t): %+v", v2Only, details)
+		}
+		server.Close()
+	}
+}
+
+func TestCFProvisionDetailsSingleRoundTrip(t *testing.T) {
+	server := newTestCF(t)
+	defer server.Close()
+	client, err := cfNewClient(context.Background(), testCFConfig(server))
+	if err != nil {
+		t.Fatal("cfNewClient returned error: " + err.Error())
+	}
+
+	before := len(server.Requests())
+	_, err = client.GetProvisionDetails(context.Background(), "space-guid")
+	if err != nil {
+		t.Fatal("GetProvisionDetails returned error: " + err.Error())
+	}
+	if requests := server.Requests()[before:]; len(requests) != 1 {
+		t.Errorf("Expected a single request but got: %v", requests)
+	}
+}
+
+func TestCFUnknownSpace(t *testing.T) {
+	server := newTestCF(t)
+	defer server.Close()
+	client, err := cfNewClient(context.Background(), testCFConfig(server))
+	if err != nil {
+		t.Fatal("cfNewClient returned error: " + err.Error())
+	}
+
+	_, err = client.GetProvisionDetails(context.Background(), "unknown")
+	cfErr, ok := errors.Cause(err).(cfclient.CloudFoundryError)
+	if !ok || cfErr.Code != 10010 {
+		t.Errorf("Expected a CF-ResourceNotFound error but got: %v", err)
+	}
+}
+
+func TestCFBadClientCredentials(t *testing.T) {
+	server := newTestCF(t)
+	defer server.Close()
+	config := testCFConfig(server)
+	config.ClientSecret = "wrong"
+
+	_, err := cfNewClient(context.Background(), config)
+	if err == nil {
+		t.Error("cfNewClient didn't return an error for bad client credentials")
+	}
+}
+
+func TestCFSecondaryClientSecret(t *testing.T) {
+	server := newTestCF(t)
+	defer server.Close()
+	config := testCFConfig(server)
+	config.ClientSecret = "new-secret"
+	config.ClientSecretSecondary = "secret"
+
+	client, err := cfNewClient(context.Background(), config)
+	if err != nil {
+		t.Fatal("cfNewClient returned error with the secondary secret: " + err.Error())
+	}
+	_, err = client.GetProvisionDetails(context.Background(), "space-guid")
+	if err != nil {
+		t.Error("GetProvisionDetails returned error: " + err.Error())
+	}
+}
+
+func TestCFLazyClientFollowsSecretRotation(t *testing.T) {
+	server := newTestCF(t)
+	defer server.Close()
+	server.SetTokenLifetime(1)
+	config := testCFConfig(server)
+	rotated := newCFLazyClient(config)
+	config.ClientSecretSecondary = "new-secret"
+	rotating := newCFLazyClient(config)
+
+	for _, client := range []IcfClient{rotated, rotating} {
+		_, err := client.GetProvisionDetails(context.Background(), "space-guid")
+		if err != nil {
+			t.Fatal("GetProvisionDetails returned error: " + err.Error())
+		}
+	}
+	server.RotateClientSecret("new-secret")
+
+	_, err := rotated.GetProvisionDetails(context.Background(), "space-guid")
+	if kind, _ := errorKindOf(err); kind != kindUnauthorized {
+		t.Errorf("Expected the rejected token refresh to be unauthorized but got: %v", err)
+	}
+	_, err = rotating.GetProvisionDetails(context.Background(), "space-guid")
+	if err != nil {
+		t.Error("Expected the client to switch to the secondary secret but got: " + err.Error())
+	}
+}
+
+func TestCFListServiceInstancesPaginated(t *testing.T) {
+	for _, v2Only := range []bool{false, true} {
+		server := newTestCF(t)
+		if v2Only {
+			server.DisableV3()
+		}
+		server.AddServiceInstance(fakecf.ServiceInstance{GUID: "instance-guid-2", Name: "ci-2", SpaceGUID: "space-guid", ServicePlanGUID: "plan-guid"})
+		server.AddServiceInstance(fakecf.ServiceInstance{GUID: "instance-guid-3", Name: "other", SpaceGUID: "space-guid", ServicePlanGUID: "other-plan-guid"})
+		server.SetPageSize(1)
+
+		client, err := cfNewClient(context.Background(), testCFConfig(server))
+		if err != nil {
+			t.Fatal("cfNewClient returned error: " + err.Error())
+		}
+		instances, err := client.ListServiceInstances(context.Background(), []string{"catalog-plan-id"})
+		if err != nil {
+			t.Fatal("ListServiceInstances returned error: " + err.Error())
+		}
+		if len(instances) != 2 {
+			t.Fatalf("Expected 2 instances (v2 only: %t) but got: %+v", v2Only, instances)
+		}
+		if instances[1].GUID != "instance-guid-2" || instances[1].Details.OrgName != "my-org" || instances[1].PlanID != "catalog-plan-id" {
+			t.Errorf("Unexpected instance (v2 only: %t): %+v", v2Only, instances[1])
+		}
+		server.Close()
+	}
+}
+
+func TestCFLazyClientReusesClient(t *testing.T) {
+	server := newTestCF(t)
+	defer server.Close()
+	client := newCFLazyClient(testCFConfig(server))
+
+	for i := 0; i < 2; i++ {
+		_, err := client.GetProvisionDetails(context.Background(), "space-guid")
+		if err != nil {
+			t.Fatal("GetProvisionDetails returned error: " + err.Error())
+		}
+	}
+	logins := 0
+	for _, request := range server.Requests() {
+		if request == "/oauth/token" {
+			logins++
+		}
+	}
+	if logins != 1 {
+		t.Errorf("Expected a single login to UAA but got %d", logins)
+	}
+}
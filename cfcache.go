@@ -0,0 +1,152 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+var (
+	cfCacheHits      = newCounter("cf_cache_hits_total", "Lookups of CF spaces and service instances answered from the cache.")
+	cfCacheMisses    = newCounter("cf_cache_misses_total", "Lookups of CF spaces and service instances sent to the Cloud Controller.")
+	cfCacheEvictions = newCounter("cf_cache_evictions_total", "Cache entries evicted to stay within the size bound.")
+)
+
+// IcfCache drops cached CF metadata that is known to be outdated.
+type IcfCache interface {
+	InvalidateSpace(spaceGUID string)
+	InvalidateInstance(serviceGUID string)
+}
+
+// cfCachingClient caches the space to org and the instance to space lookups
+// of an IcfClient for ttl, keeping at most maxEntries of them. A ttl of 0
+// disables the cache.
+type cfCachingClient struct {
+	client     IcfClient
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cfCacheEntry struct {
+	key     string
+	details platformDetails
+	expires time.Time
+}
+
+func newCFCachingClient(client IcfClient, ttl time.Duration, maxEntries int) *cfCachingClient {
+	return &cfCachingClient{
+		client:     client,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func spaceCacheKey(spaceGUID string) string      { return "space/" + spaceGUID }
+func instanceCacheKey(serviceGUID string) string { return "instance/" + serviceGUID }
+
+func (c *cfCachingClient) GetProvisionDetails(ctx context.Context, spaceGUID string) (platformDetails, error) {
+	if details, ok := c.get(spaceCacheKey(spaceGUID)); ok {
+		return details, nil
+	}
+	details, err := c.client.GetProvisionDetails(ctx, spaceGUID)
+	if err != nil {
+		return platformDetails{}, err
+	}
+	c.put(spaceCacheKey(spaceGUID), details)
+	return details, nil
+}
+
+func (c *cfCachingClient) GetDeprovisionDetails(ctx context.Context, serviceGUID string) (platformDetails, error) {
+	if details, ok := c.get(instanceCacheKey(serviceGUID)); ok {
+		return details, nil
+	}
+	details, err := c.client.GetDeprovisionDetails(ctx, serviceGUID)
+	if err != nil {
+		return platformDetails{}, err
+	}
+	c.put(instanceCacheKey(serviceGUID), details)
+	c.put(spaceCacheKey(details.SpaceGUID), details)
+	return details, nil
+}
+
+// ListServiceInstances always asks the Cloud Controller, but warms the cache
+// with the instances and spaces it returns.
+func (c *cfCachingClient) ListServiceInstances(ctx context.Context, planIDs []string) ([]cfServiceInstance, error) {
+	instances, err := c.client.ListServiceInstances(ctx, planIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range instances {
+		c.put(instanceCacheKey(instance.GUID), instance.Details)
+		c.put(spaceCacheKey(instance.Details.SpaceGUID), instance.Details)
+	}
+	return instances, nil
+}
+
+func (c *cfCachingClient) InvalidateSpace(spaceGUID string) {
+	c.remove(spaceCacheKey(spaceGUID))
+}
+
+func (c *cfCachingClient) InvalidateInstance(serviceGUID string) {
+	c.remove(instanceCacheKey(serviceGUID))
+}
+
+func (c *cfCachingClient) get(key string) (platformDetails, bool) {
+	if c.ttl <= 0 {
+		return platformDetails{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		cfCacheMisses.Inc()
+		return platformDetails{}, false
+	}
+	entry := element.Value.(*cfCacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		cfCacheMisses.Inc()
+		return platformDetails{}, false
+	}
+	c.lru.MoveToFront(element)
+	cfCacheHits.Inc()
+	return entry.details, true
+}
+
+func (c *cfCachingClient) put(key string, details platformDetails) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &cfCacheEntry{key: key, details: details, expires: time.Now().Add(c.ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cfCacheEntry).key)
+		cfCacheEvictions.Inc()
+	}
+}
+
+func (c *cfCachingClient) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+	}
+}
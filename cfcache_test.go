@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type countingCFClient struct {
+	calls int
+}
+
+func (f *countingCFClient) GetProvisionDetails(ctx context.Context, spaceGUID string) (platformDetails, error) {
+	f.calls++
+	return platformDetails{Platform: platformCloudFoundry, OrgName: "my-org", SpaceGUID: spaceGUID}, nil
+}
+
+func (f *countingCFClient) GetDeprovisionDetails(ctx context.Context, serviceGUID string) (platformDetails, error) {
+	f.calls++
+	return platformDetails{Platform: platformCloudFoundry, OrgName: "my-org", SpaceGUID: "space-guid"}, nil
+}
+
+func (f *countingCFClient) ListServiceInstances(ctx context.Context, planIDs []string) ([]cfServiceInstance, error) {
+	f.calls++
+	return nil, nil
+}
+
+func TestCFCacheServesRepeatedLookups(t *testing.T) {
+	client := &countingCFClient{}
+	cache := newCFCachingClient(client, time.Minute, 10)
+	hits := cfCacheHits.Value()
+
+	for i := 0; i < 3; i++ {
+		cache.GetProvisionDetails(context.Background(), "space-guid")
+		cache.GetDeprovisionDetails(context.Background(), "instance-guid")
+	}
+	if client.calls != 2 {
+		t.Errorf("Expected 2 lookups to reach the client but got %d", client.calls)
+	}
+	if cfCacheHits.Value()-hits != 4 {
+		t.Errorf("Expected 4 cache hits but got %d", cfCacheHits.Value()-hits)
+	}
+
+	cache.InvalidateInstance("instance-guid")
+	cache.GetDeprovisionDetails(context.Background(), "instance-guid")
+	if client.calls != 3 {
+		t.Error("An invalidated instance was still served from the cache")
+	}
+}
+
+func TestCFCacheExpiresEntries(t *testing.T) {
+	client := &countingCFClient{}
+	cache := newCFCachingClient(client, 10*time.Millisecond, 10)
+
+	cache.GetProvisionDetails(context.Background(), "space-guid")
+	time.Sleep(20 * time.Millisecond)
+	cache.GetProvisionDetails(context.Background(), "space-guid")
+	if client.calls != 2 {
+		t.Errorf("Expected an expired entry to be looked up again, got %d calls", client.calls)
+	}
+}
+
+func TestCFCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	client := &countingCFClient{}
+	cache := newCFCachingClient(client, time.Minute, 2)
+
+	cache.GetProvisionDetails(context.Background(), "space-1")
+	cache.GetProvisionDetails(context.Background(), "space-2")
+	cache.GetProvisionDetails(context.Background(), "space-1")
+	cache.GetProvisionDetails(context.Background(), "space-3")
+	cache.GetProvisionDetails(context.Background(), "space-1")
+	if client.calls != 3 {
+		t.Errorf("Expected the recently used space-1 to stay cached, got %d calls", client.calls)
+	}
+	cache.GetProvisionDetails(context.Background(), "space-2")
+	if client.calls != 4 {
+		t.Errorf("Expected space-2 to have been evicted, got %d calls", client.calls)
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var commands map[string]func(args []string) error
+
+var commandUsage = map[string]string{
+	"serve":            "Start the service broker (default)",
+	"list-teams":       "List the Concourse teams and the service instances they belong to",
+	"reconcile":        "Create missing teams for service instances and report orphaned teams",
+	"rotate-team-auth": "Push the current auth config, e.g. a rotated client secret, to every team",
+	"archive-team":     "Export a team and its pipelines to a file and destroy it",
+	"restore-team":     "Recreate a team and its pipelines from an archive file",
+	"validate-config":  "Validate the configuration and catalog",
+	"render-catalog":   "Print the catalog as served on /v2/catalog",
+}
+
+func init() {
+	commands = map[string]func(args []string) error{
+		"serve":            serve,
+		"list-teams":       listTeamsCommand,
+		"reconcile":        reconcileCommand,
+		"rotate-team-auth": rotateTeamAuthCommand,
+		"archive-team":     archiveTeamCommand,
+		"restore-team":     restoreTeamCommand,
+		"validate-config":  validateConfigCommand,
+		"render-catalog":   renderCatalogCommand,
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n\nCommands:\n", os.Args[0])
+	var names []string
+	for name := range commandUsage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%s\n", name, commandUsage[name])
+	}
+	w.Flush()
+}
+
+// adminClients loads the configuration and catalog and creates the clients the
+// admin commands work with.
+func adminClients() ([]brokerapi.Service, IcfClient, IccClient, error) {
+	config, err := brokerConfigLoad()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	services, err := CatalogLoad(catalogPath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cfClient, err := cfNewClient(context.Background(), config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	logger := newLogger(config, os.Stderr)
+	return services, cfClient, concourseNewClient(config, logger), nil
+}
+
+// adminConcourseClient creates the Concourse client for the admin commands that
+// don't need Cloud Foundry.
+func adminConcourseClient() (IccClient, error) {
+	config, err := brokerConfigLoad()
+	if err != nil {
+		return nil, err
+	}
+	return concourseNewClient(config, newLogger(config, os.Stderr)), nil
+}
+
+// adminBroker returns a broker on the instance store, for the admin commands
+// that create teams the way provisioning does.
+func adminBroker() (*broker, IcfClient, error) {
+	config, err := brokerConfigLoad()
+	if err != nil {
+		return nil, nil, err
+	}
+	services, err := CatalogLoad(catalogPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	plans, err := PlanConfigsLoad(catalogPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := newInstanceStore(config.InstanceStorePath, config.InstanceStoreKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfClient, err := cfNewClient(context.Background(), config)
+	if err != nil {
+		return nil, nil, err
+	}
+	b := &broker{logger: newLogger(config, os.Stderr), store: store}
+	b.configure(config, services, plans)
+	return b, cfClient, nil
+}
+
+func catalogPlanIDs(services []brokerapi.Service) []string {
+	var planIDs []string
+	for _, service := range services {
+		for _, plan := range service.Plans {
+			planIDs = append(planIDs, plan.ID)
+		}
+	}
+	return planIDs
+}
+
+func listTeamsCommand(args []string) error {
+	services, cfClient, concourseClient, err := adminClients()
+	if err != nil {
+		return err
+	}
+	teams, err := concourseClient.ListTeams(context.Background())
+	if err != nil {
+		return err
+	}
+	instances, err := cfClient.ListServiceInstances(context.Background(), catalogPlanIDs(services))
+	if err != nil {
+		return err
+	}
+	instancesByTeam := make(map[string]cfServiceInstance)
+	for _, instance := range instances {
+		instancesByTeam[getTeamName(instance.Details)] = instance
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TEAM\tINSTANCE\tORG\tSPACE")
+	for _, team := range teams {
+		instance := instancesByTeam[team.Name]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", team.Name, instance.GUID, instance.Details.OrgName, instance.Details.SpaceName)
+	}
+	return w.Flush()
+}
+
+func reconcileCommand(args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Only report the differences")
+	flags.Parse(args)
+
+	b, cfClient, err := adminBroker()
+	if err != nil {
+		return err
+	}
+	teams, err := b.concourse.ListTeams(context.Background())
+	if err != nil {
+		return err
+	}
+	instances, err := cfClient.ListServiceInstances(context.Background(), catalogPlanIDs(b.services))
+	if err != nil {
+		return err
+	}
+
+	existingTeams := make(map[string]bool)
+	for _, team := range teams {
+		existingTeams[team.Name] = true
+	}
+	instanceTeams := make(map[string]bool)
+	failed := 0
+	for _, instance := range instances {
+		teamName := getTeamName(instance.Details)
+		instanceTeams[teamName] = true
+		if existingTeams[teamName] {
+			continue
+		}
+		fmt.Printf("missing team %s for instance %s\n", teamName, instance.GUID)
+		if *dryRun {
+			continue
+		}
+		err := reconcileTeam(context.Background(), b, instance)
+		if err != nil {
+			fmt.Printf("  failed to create team %s: %s\n", teamName, err)
+			failed++
+			continue
+		}
+		fmt.Printf("  created team %s\n", teamName)
+	}
+	for _, team := range teams {
+		if team.Name != adminTeam && !instanceTeams[team.Name] {
+			fmt.Printf("orphaned team %s has no service instance\n", team.Name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("Failed to create %d teams", failed)
+	}
+	return nil
+}
+
+// reconcileTeam recreates the team of instance with everything its plan comes
+// with. The store record is reused if there is one, so the team gets back the
+// auth and worker key it was provisioned with.
+func reconcileTeam(ctx context.Context, b *broker, instance cfServiceInstance) error {
+	record, found, err := b.store.Get(instance.GUID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		record = instanceRecord{
+			InstanceID: instance.GUID,
+			ServiceID:  serviceOfPlan(b.services, instance.PlanID),
+			PlanID:     instance.PlanID,
+			OrgGUID:    instance.Details.OrgGUID,
+			SpaceGUID:  instance.Details.SpaceGUID,
+			TeamName:   getTeamName(instance.Details),
+			Details:    instance.Details,
+		}
+	}
+	return b.createTeam(ctx, record, provisionParameters{})
+}
+
+// serviceOfPlan returns the ID of the catalog service offering the plan.
+func serviceOfPlan(services []brokerapi.Service, planID string) string {
+	for _, service := range services {
+		for _, plan := range service.Plans {
+			if plan.ID == planID {
+				return service.ID
+			}
+		}
+	}
+	return ""
+}
+
+// rotateTeamAuthCommand pushes the current auth config to the team of every
+// service instance, so the teams keep working once the secondary credentials
+// they were created with are revoked.
+func rotateTeamAuthCommand(args []string) error {
+	flags := flag.NewFlagSet("rotate-team-auth", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Only list the teams that would be updated")
+	flags.Parse(args)
+
+	services, cfClient, concourseClient, err := adminClients()
+	if err != nil {
+		return err
+	}
+	records, err := adminInstanceRecords()
+	if err != nil {
+		return err
+	}
+	instances, err := cfClient.ListServiceInstances(context.Background(), catalogPlanIDs(services))
+	if err != nil {
+		return err
+	}
+
+	teams := managedTeams(records, instances)
+	auth := make(map[string]*teamAuthConfig)
+	for _, record := range records {
+		auth[record.TeamName] = record.Auth
+	}
+	failed, missing := 0, 0
+	for i, details := range teams {
+		teamName := getTeamName(details)
+		progress := fmt.Sprintf("[%d/%d]", i+1, len(teams))
+		if *dryRun {
+			fmt.Printf("%s would update team %s\n", progress, teamName)
+			continue
+		}
+		err := concourseClient.UpdateTeamAuth(context.Background(), details, auth[teamName])
+		if kind, _ := errorKindOf(err); kind == kindNotFound {
+			fmt.Printf("%s missing team %s, run reconcile to create it\n", progress, teamName)
+			missing++
+			continue
+		}
+		if err != nil {
+			fmt.Printf("%s failed to update team %s: %s\n", progress, teamName, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s updated team %s\n", progress, teamName)
+	}
+	if *dryRun {
+		return nil
+	}
+	fmt.Printf("updated %d of %d teams, %d missing, %d failed\n", len(teams)-failed-missing, len(teams), missing, failed)
+	if failed > 0 {
+		return fmt.Errorf("Failed to update %d teams", failed)
+	}
+	return nil
+}
+
+// adminInstanceRecords returns the records of the instance store, if the
+// broker keeps one.
+func adminInstanceRecords() ([]instanceRecord, error) {
+	config, err := brokerConfigLoad()
+	if err != nil {
+		return nil, err
+	}
+	if config.InstanceStorePath == "" {
+		return nil, nil
+	}
+	store, err := newInstanceStore(config.InstanceStorePath, config.InstanceStoreKey)
+	if err != nil {
+		return nil, err
+	}
+	return store.List()
+}
+
+// managedTeams returns the details of every team the broker manages, once per
+// team. The store records come first, as only they know the groups of
+// Kubernetes teams.
+func managedTeams(records []instanceRecord, instances []cfServiceInstance) []platformDetails {
+	var teams []platformDetails
+	seen := make(map[string]bool)
+	add := func(details platformDetails) {
+		teamName := getTeamName(details)
+		if teamName == "" || seen[teamName] {
+			return
+		}
+		seen[teamName] = true
+		teams = append(teams, details)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].TeamName < records[j].TeamName })
+	for _, record := range records {
+		add(record.Details)
+	}
+	for _, instance := range instances {
+		add(instance.Details)
+	}
+	return teams
+}
+
+func archiveTeamCommand(args []string) error {
+	flags := flag.NewFlagSet("archive-team", flag.ExitOnError)
+	file := flags.String("file", "", "File to write the archive to (defaults to <team>.json)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage: archive-team [-file FILE] TEAM")
+	}
+	teamName := flags.Arg(0)
+	if *file == "" {
+		*file = teamName + ".json"
+	}
+
+	services, cfClient, concourseClient, err := adminClients()
+	if err != nil {
+		return err
+	}
+	records, err := adminInstanceRecords()
+	if err != nil {
+		return err
+	}
+	instances, err := cfClient.ListServiceInstances(context.Background(), catalogPlanIDs(services))
+	if err != nil {
+		return err
+	}
+	var details platformDetails
+	found := false
+	for _, team := range managedTeams(records, instances) {
+		if getTeamName(team) == teamName {
+			details, found = team, true
+		}
+	}
+	if !found {
+		return fmt.Errorf("Team %s is not managed by the broker", teamName)
+	}
+	var auth *teamAuthConfig
+	for _, record := range records {
+		if record.TeamName == teamName {
+			auth = record.Auth
+		}
+	}
+	archive, err := concourseClient.ArchiveTeam(context.Background(), details, auth)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(archive, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(*file, data, 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("archived team %s with %d pipelines to %s\n", teamName, len(archive.Pipelines), *file)
+	return nil
+}
+
+func restoreTeamCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: restore-team FILE")
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	var archive teamArchive
+	err = json.Unmarshal(data, &archive)
+	if err != nil {
+		return err
+	}
+
+	concourseClient, err := adminConcourseClient()
+	if err != nil {
+		return err
+	}
+	err = concourseClient.RestoreTeam(context.Background(), archive)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored team %s with %d pipelines\n", archive.Team.Name, len(archive.Pipelines))
+	return nil
+}
+
+// validateConfigCommand reports every problem of the configuration and the
+// catalog at once.
+func validateConfigCommand(args []string) error {
+	flags := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	catalog := flags.String("catalog", catalogPath, "Path to the catalog")
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "Path to the YAML config file")
+	flags.Parse(args)
+
+	var problems configErrors
+	config, err := brokerConfigLoadFile(*configFile)
+	configValid := err == nil
+	if configProblems, ok := err.(configErrors); ok {
+		problems = append(problems, configProblems...)
+	} else if err != nil {
+		problems = append(problems, err.Error())
+	}
+	_, err = CatalogLoad(*catalog)
+	var plans map[string]planConfig
+	if err == nil {
+		plans, err = PlanConfigsLoad(*catalog)
+	}
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("%s: %v", *catalog, err))
+	}
+	if configValid {
+		err = checkInstanceStore(config, plans)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	fmt.Println("configuration is valid")
+	return nil
+}
+
+func renderCatalogCommand(args []string) error {
+	flags := flag.NewFlagSet("render-catalog", flag.ExitOnError)
+	catalog := flags.String("catalog", catalogPath, "Path to the catalog")
+	flags.Parse(args)
+
+	services, err := CatalogLoad(*catalog)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(brokerapi.CatalogResponse{Services: services}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
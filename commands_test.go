@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/vchrisr/cf-concourse-broker/fakes/fakeatc"
+)
+
+func TestCatalogPlanIDs(t *testing.T) {
+	services := []brokerapi.Service{
+		{Plans: []brokerapi.ServicePlan{{ID: "plan-a"}, {ID: "plan-b"}}},
+		{Plans: []brokerapi.ServicePlan{{ID: "plan-c"}}},
+	}
+	planIDs := catalogPlanIDs(services)
+	if len(planIDs) != 3 || planIDs[2] != "plan-c" {
+		t.Errorf("Expected the IDs of all plans but got: %v", planIDs)
+	}
+}
+
+func TestManagedTeams(t *testing.T) {
+	records := []instanceRecord{
+		{TeamName: "dev", Details: platformDetails{Platform: platformKubernetes, Namespace: "dev", Groups: []string{"devs"}}},
+	}
+	instances := []cfServiceInstance{
+		{GUID: "a", Details: platformDetails{Platform: platformCloudFoundry, OrgName: "my-org", SpaceGUID: "space-a"}},
+		{GUID: "b", Details: platformDetails{Platform: platformCloudFoundry, OrgName: "my-org", SpaceGUID: "space-b"}},
+		{GUID: "c", Details: platformDetails{Platform: platformKubernetes, Namespace: "dev"}},
+	}
+	teams := managedTeams(records, instances)
+	if len(teams) != 2 {
+		t.Fatalf("Expected 2 teams but got: %v", teams)
+	}
+	if len(teams[0].Groups) != 1 {
+		t.Error("Expected the details of the store record to win but got: " + teams[0].Namespace)
+	}
+	if teams[1].OrgName != "my-org" {
+		t.Error("Expected team my-org but got: " + teams[1].OrgName)
+	}
+}
+
+func TestCommandsHaveUsage(t *testing.T) {
+	for name := range commands {
+		if commandUsage[name] == "" {
+			t.Error("No usage found for command " + name)
+		}
+	}
+}
+
+func TestRenderCatalogFail(t *testing.T) {
+	err := renderCatalogCommand([]string{"-catalog", "./nonexistentfile"})
+	if err == nil {
+		t.Error("render-catalog didn't return an error for a nonexistent catalog")
+	}
+}
+
+func TestReconcileTeamAppliesPlan(t *testing.T) {
+	server := fakeatc.New("admin", "password")
+	defer server.Close()
+	services, _ := CatalogLoad("./catalog.json")
+	planID := services[0].Plans[0].ID
+	b := newTestBroker(t, map[string]planConfig{planID: {
+		Pipelines: []pipelineTemplate{{Name: "bootstrap", Config: testPipelineConfig()}},
+		Auth:      []byte(`{"basic_auth": {"username": "ci"}}`),
+	}}, testBrokerOptions{server: server})
+
+	err := reconcileTeam(context.Background(), b, cfServiceInstance{
+		GUID:    "instance-id",
+		PlanID:  planID,
+		Details: platformDetails{Platform: platformCloudFoundry, OrgGUID: "org-guid", OrgName: "my-org", SpaceGUID: "space-guid"},
+	})
+	if err != nil {
+		t.Fatal("reconcileTeam returned error: " + err.Error())
+	}
+	if _, found := server.PipelineConfig("my-org", "bootstrap"); !found {
+		t.Error("reconcileTeam didn't set the pipelines of the plan")
+	}
+	record, found, _ := b.store.Get("instance-id")
+	if !found {
+		t.Fatal("reconcileTeam didn't store a record")
+	}
+	if record.ServiceID != services[0].ID || record.TeamName != "my-org" || record.Auth == nil || record.Auth.BasicAuth == nil {
+		t.Errorf("Unexpected record: %+v", record)
+	}
+}
@@ -1,60 +1,132 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
-	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/concourse/atc"
 	"github.com/concourse/atc/auth/uaa"
 	"github.com/concourse/go-concourse/concourse"
+	"github.com/pkg/errors"
 )
 
 const adminTeam = "main"
 
+var (
+	errTeamExists   = classify(errors.New("Team already exists"), kindConflict, "A Concourse team for this org or namespace already exists")
+	errTeamNotFound = classify(errors.New("Team not found"), kindNotFound, "Concourse team not found")
+)
+
 // IccClient defines the capabilities that any concourse client should be able to do.
 type IccClient interface {
-	CreateTeam(details cfDetails) error
-	DeleteTeam(details cfDetails) error
+	CreateTeam(ctx context.Context, details platformDetails, auth *teamAuthConfig) error
+	DeleteTeam(ctx context.Context, details platformDetails) error
+	UpdateTeamAuth(ctx context.Context, details platformDetails, auth *teamAuthConfig) error
+	PruneTeamWorkers(ctx context.Context, teamName string) error
+	SetPipeline(ctx context.Context, teamName, pipelineName string, config atc.Config, paused bool) error
+	ListPipelines(ctx context.Context, teamName string) ([]atc.Pipeline, error)
+	PausePipeline(ctx context.Context, teamName, pipelineName string) error
+	DeletePipeline(ctx context.Context, teamName, pipelineName string) error
+	ListJobs(ctx context.Context, teamName, pipelineName string) ([]atc.Job, error)
+	ListJobBuilds(ctx context.Context, teamName, pipelineName, jobName string, since int) ([]atc.Build, error)
+	BuildEvents(ctx context.Context, buildID int) (concourse.Events, error)
+	ListTeams(ctx context.Context) ([]atc.Team, error)
+	ArchiveTeam(ctx context.Context, details platformDetails, auth *teamAuthConfig) (teamArchive, error)
+	RestoreTeam(ctx context.Context, archive teamArchive) error
+}
+
+// teamArchive holds everything needed to recreate a team and its pipelines.
+type teamArchive struct {
+	Team      atc.Team          `json:"team"`
+	Pipelines []pipelineArchive `json:"pipelines"`
+}
+
+type pipelineArchive struct {
+	Name   string     `json:"name"`
+	Paused bool       `json:"paused"`
+	Config atc.Config `json:"config"`
 }
 
 // NewClient returns a client that can be used to interface with a deployed Concourse CI instance.
+// The client is safe for concurrent use and meant to be shared for the lifetime
+// of the broker, reusing its connections and auth token.
 func concourseNewClient(env brokerConfig, logger lager.Logger) IccClient {
-	httpClient := newBasicAuthClient(env.AdminUsername, env.AdminPassword)
-
 	return &concourseClient{
-		client: concourse.NewClient(env.ConcourseURL, httpClient),
 		env:    env,
-		logger: logger.Session("concourse-client")}
+		logger: logger.Session("concourse-client"),
+		transport: &concourseTokenTransport{
+			env:  env,
+			base: newRetryTransport(upstreamConcourse, env, defaultTransport()),
+		},
+	}
 }
 
 type concourseClient struct {
-	client concourse.Client
-	env    brokerConfig
-	logger lager.Logger
+	env       brokerConfig
+	logger    lager.Logger
+	transport *concourseTokenTransport
+}
+
+// getAuthClient returns a client of the main team whose requests are bound to
+// ctx, as go-concourse takes no context itself.
+func (c *concourseClient) getAuthClient(ctx context.Context) (concourse.Client, error) {
+	return c.newAuthClient(ctx, c.env.ConcourseTimeout)
 }
 
-func (c *concourseClient) getAuthClient(concourseURL string) (concourse.Client, error) {
-	team := c.client.Team(adminTeam)
-	token, err := team.AuthToken()
+// newAuthClient returns a client of the main team whose requests are bound to
+// ctx and time out after timeout, if it is set.
+func (c *concourseClient) newAuthClient(ctx context.Context, timeout time.Duration) (concourse.Client, error) {
+	_, err := c.transport.authToken(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
-	httpClient := newOAuthClient(token.Type, token.Value)
-	return concourse.NewClient(concourseURL, httpClient), nil
+	httpClient := &http.Client{
+		Transport: contextTransport{ctx: ctx, base: c.transport},
+		Timeout:   timeout,
+	}
+	return concourse.NewClient(c.env.ConcourseURL, httpClient), nil
 }
 
-func (c *concourseClient) getTeamName(details cfDetails) string {
+// getTeamName returns the name of the team that belongs to the CF org or
+// Kubernetes namespace.
+func getTeamName(details platformDetails) string {
+	if details.Platform == platformKubernetes {
+		return details.Namespace
+	}
 	return details.OrgName
 }
 
-func (c *concourseClient) CreateTeam(details cfDetails) error {
-	teamName := c.getTeamName(details)
-	team := atc.Team{}
-	teamAuth := make(map[string]*json.RawMessage)
+// oidcAuthConfig mirrors the team auth config of Concourse's generic OIDC
+// provider, which is not part of the vendored atc.
+type oidcAuthConfig struct {
+	DisplayName  string   `json:"display_name,omitempty"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Issuer       string   `json:"issuer"`
+	Groups       []string `json:"groups,omitempty"`
+	GroupsClaim  string   `json:"groups_claim,omitempty"`
+}
 
-	uaaAuthConfig := uaa.UAAAuthConfig{
+// getTeamAuth returns the provider name and config that grants the members of
+// the CF space or the Kubernetes groups access to the team.
+func (c *concourseClient) getTeamAuth(details platformDetails) (string, interface{}) {
+	if details.Platform == platformKubernetes {
+		return "oauth_oidc", oidcAuthConfig{
+			DisplayName:  "Kubernetes",
+			ClientID:     c.env.OIDCClientID,
+			ClientSecret: c.env.OIDCClientSecret,
+			Issuer:       c.env.OIDCIssuer,
+			Groups:       details.Groups,
+			GroupsClaim:  c.env.OIDCGroupsClaim,
+		}
+	}
+	return "uaa", uaa.UAAAuthConfig{
 		ClientID:     c.env.ClientID,
 		ClientSecret: c.env.ClientSecret,
 		AuthURL:      c.env.AuthURL,
@@ -63,26 +135,46 @@ func (c *concourseClient) CreateTeam(details cfDetails) error {
 		CFCACert:     "",
 		CFURL:        c.env.CFURL,
 	}
+}
+
+// newTeam returns the team with the auth config for details and the extra
+// providers in auth, if any.
+func (c *concourseClient) newTeam(details platformDetails, auth *teamAuthConfig) (atc.Team, error) {
+	teamAuth := make(map[string]*json.RawMessage)
 
-	data, err := json.Marshal(uaaAuthConfig)
+	providerName, authConfig := c.getTeamAuth(details)
+
+	data, err := json.Marshal(authConfig)
 	if err != nil {
-		fmt.Println("Invalid UAA config")
-		panic(err)
+		return atc.Team{}, classify(errors.Wrap(err, "Invalid auth config"), "", "Unable to configure the auth of the Concourse team")
 	}
 
-	teamAuth["uaa"] = (*json.RawMessage)(&data)
-	/*fmt.Printf("{ClientID:%v,ClientSecret:%v,AuthURL:%v,TokenURL:%v,CFSpaces:%v,CFCACert:\"\",CFURL:%v}", c.env.ClientID, c.env.ClientSecret, c.env.AuthURL, c.env.TokenURL, []string{details.SpaceGUID}, c.env.CFURL)*/
+	teamAuth[providerName] = (*json.RawMessage)(&data)
+
+	team := atc.Team{Auth: teamAuth}
+	err = auth.apply(&team)
+	if err != nil {
+		return atc.Team{}, classify(errors.Wrap(err, "Invalid auth config"), "", "Unable to configure the auth of the Concourse team")
+	}
+	return team, nil
+}
 
-	team.Auth = teamAuth
+func (c *concourseClient) CreateTeam(ctx context.Context, details platformDetails, auth *teamAuthConfig) error {
+	teamName := getTeamName(details)
+	team, err := c.newTeam(details, auth)
+	if err != nil {
+		c.logger.Error("create-team.auth-config-error", err)
+		return err
+	}
 
-	client, err := c.getAuthClient(c.env.ConcourseURL)
+	client, err := c.getAuthClient(ctx)
 	if err != nil {
 		c.logger.Error("create-team.auth-client-error", err)
 		return err
 	}
 	authMethods, err := client.Team(teamName).ListAuthMethods()
 	if err == nil || len(authMethods) > 0 {
-		err := fmt.Errorf("Team %s already exists", teamName)
+		err := errTeamExists
 		c.logger.Error("create-team.existing-team-error", err,
 			lager.Data{
 				"team-name":         teamName,
@@ -90,13 +182,20 @@ func (c *concourseClient) CreateTeam(details cfDetails) error {
 			})
 		return err
 	}
+	// A retried PUT whose first response got lost would find the team and
+	// report it as updated, so the team is created with a single request.
+	client, err = c.getAuthClient(withoutRetries(ctx))
+	if err != nil {
+		c.logger.Error("create-team.auth-client-error", err)
+		return err
+	}
 	_, created, updated, err := client.Team(teamName).CreateOrUpdate(team)
 	if err != nil {
 		c.logger.Error("create-team.unknown-create-error", err,
 			lager.Data{
 				"team-name": teamName,
 			})
-		return err
+		return classifyConcourseError(errors.Wrap(err, "Error creating team"), "Unable to create the Concourse team")
 	}
 	if !created || updated {
 		err := errors.New("Unable to provision instance")
@@ -109,20 +208,354 @@ func (c *concourseClient) CreateTeam(details cfDetails) error {
 	return nil
 }
 
-func (c *concourseClient) DeleteTeam(details cfDetails) error {
-	teamName := c.getTeamName(details)
-	client, err := c.getAuthClient(c.env.ConcourseURL)
+func (c *concourseClient) DeleteTeam(ctx context.Context, details platformDetails) error {
+	teamName := getTeamName(details)
+	client, err := c.getAuthClient(ctx)
 	if err != nil {
 		c.logger.Error("delete-team.auth-client-error", err)
 		return err
 	}
-	err = client.Team(details.OrgName).DestroyTeam(teamName)
+	teams, err := client.ListTeams()
+	if err != nil {
+		c.logger.Error("delete-team.list-teams-error", err)
+		return classifyConcourseError(errors.Wrap(err, "Error listing teams"), "Unable to list the Concourse teams")
+	}
+	if !containsTeam(teams, teamName) {
+		return errTeamNotFound
+	}
+	err = client.Team(teamName).DestroyTeam(teamName)
 	if err != nil {
 		c.logger.Error("delete-team.unknown-delete-error", err,
 			lager.Data{
 				"team-name": teamName,
 			})
+		return classifyConcourseError(errors.Wrap(err, "Error deleting team"), "Unable to delete the Concourse team")
+	}
+	return nil
+}
+
+// UpdateTeamAuth replaces the auth config of an existing team with the current
+// one, e.g. to push a rotated client secret to the team.
+func (c *concourseClient) UpdateTeamAuth(ctx context.Context, details platformDetails, auth *teamAuthConfig) error {
+	teamName := getTeamName(details)
+	team, err := c.newTeam(details, auth)
+	if err != nil {
+		c.logger.Error("update-team-auth.auth-config-error", err)
 		return err
 	}
+	client, err := c.getAuthClient(ctx)
+	if err != nil {
+		c.logger.Error("update-team-auth.auth-client-error", err)
+		return err
+	}
+	teams, err := client.ListTeams()
+	if err != nil {
+		c.logger.Error("update-team-auth.list-teams-error", err)
+		return classifyConcourseError(errors.Wrap(err, "Error listing teams"), "Unable to list the Concourse teams")
+	}
+	if !containsTeam(teams, teamName) {
+		return errTeamNotFound
+	}
+	_, _, _, err = client.Team(teamName).CreateOrUpdate(team)
+	if err != nil {
+		c.logger.Error("update-team-auth.unknown-update-error", err,
+			lager.Data{
+				"team-name": teamName,
+			})
+		return classifyConcourseError(errors.Wrap(err, "Error updating team"), "Unable to update the Concourse team")
+	}
+	return nil
+}
+
+// PruneTeamWorkers prunes the workers registered for the team. Concourse only
+// prunes stalled workers, the names of the others are reported in the error.
+func (c *concourseClient) PruneTeamWorkers(ctx context.Context, teamName string) error {
+	client, err := c.getAuthClient(ctx)
+	if err != nil {
+		c.logger.Error("prune-team-workers.auth-client-error", err)
+		return err
+	}
+	workers, err := client.ListWorkers()
+	if err != nil {
+		c.logger.Error("prune-team-workers.list-workers-error", err)
+		return classifyConcourseError(errors.Wrap(err, "Error listing workers"), "Unable to list the Concourse workers")
+	}
+	var failed []string
+	for _, worker := range workers {
+		if worker.Team != teamName {
+			continue
+		}
+		err := client.PruneWorker(worker.Name)
+		if err != nil {
+			c.logger.Error("prune-team-workers.prune-error", err,
+				lager.Data{
+					"team-name":   teamName,
+					"worker-name": worker.Name,
+				})
+			failed = append(failed, worker.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("Unable to prune workers %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// SetPipeline creates or replaces the config of a pipeline and pauses or
+// unpauses it.
+func (c *concourseClient) SetPipeline(ctx context.Context, teamName, pipelineName string, config atc.Config, paused bool) error {
+	client, err := c.getAuthClient(ctx)
+	if err != nil {
+		c.logger.Error("set-pipeline.auth-client-error", err)
+		return err
+	}
+	team := client.Team(teamName)
+	_, _, version, _, err := team.PipelineConfig(pipelineName)
+	if err != nil {
+		c.logger.Error("set-pipeline.get-config-error", err, lager.Data{"team-name": teamName, "pipeline": pipelineName})
+		return classifyConcourseError(errors.Wrap(err, "Error getting pipeline config"), "Unable to set the Concourse pipeline")
+	}
+	_, _, _, err = team.CreateOrUpdatePipelineConfig(pipelineName, version, config)
+	if err != nil {
+		c.logger.Error("set-pipeline.save-config-error", err, lager.Data{"team-name": teamName, "pipeline": pipelineName})
+		return classifyConcourseError(errors.Wrap(err, "Error setting pipeline"), "Unable to set the Concourse pipeline")
+	}
+	if paused {
+		_, err = team.PausePipeline(pipelineName)
+	} else {
+		_, err = team.UnpausePipeline(pipelineName)
+	}
+	if err != nil {
+		c.logger.Error("set-pipeline.pause-error", err, lager.Data{"team-name": teamName, "pipeline": pipelineName})
+		return classifyConcourseError(errors.Wrap(err, "Error pausing or unpausing pipeline"), "Unable to set the Concourse pipeline")
+	}
+	return nil
+}
+
+func (c *concourseClient) ListPipelines(ctx context.Context, teamName string) ([]atc.Pipeline, error) {
+	client, err := c.getAuthClient(ctx)
+	if err != nil {
+		c.logger.Error("list-pipelines.auth-client-error", err)
+		return nil, err
+	}
+	pipelines, err := client.Team(teamName).ListPipelines()
+	if err != nil {
+		c.logger.Error("list-pipelines.unknown-list-error", err, lager.Data{"team-name": teamName})
+		return nil, classifyConcourseError(errors.Wrap(err, "Error listing pipelines"), "Unable to list the Concourse pipelines")
+	}
+	return pipelines, nil
+}
+
+func (c *concourseClient) PausePipeline(ctx context.Context, teamName, pipelineName string) error {
+	client, err := c.getAuthClient(ctx)
+	if err != nil {
+		c.logger.Error("pause-pipeline.auth-client-error", err)
+		return err
+	}
+	_, err = client.Team(teamName).PausePipeline(pipelineName)
+	if err != nil {
+		c.logger.Error("pause-pipeline.unknown-pause-error", err, lager.Data{"team-name": teamName, "pipeline": pipelineName})
+		return classifyConcourseError(errors.Wrap(err, "Error pausing pipeline"), "Unable to pause the Concourse pipeline")
+	}
+	return nil
+}
+
+// DeletePipeline deletes a pipeline, succeeding if it doesn't exist.
+func (c *concourseClient) DeletePipeline(ctx context.Context, teamName, pipelineName string) error {
+	client, err := c.getAuthClient(ctx)
+	if err != nil {
+		c.logger.Error("delete-pipeline.auth-client-error", err)
+		return err
+	}
+	_, err = client.Team(teamName).DeletePipeline(pipelineName)
+	if err != nil {
+		c.logger.Error("delete-pipeline.unknown-delete-error", err, lager.Data{"team-name": teamName, "pipeline": pipelineName})
+		return classifyConcourseError(errors.Wrap(err, "Error deleting pipeline"), "Unable to delete the Concourse pipeline")
+	}
+	return nil
+}
+
+func (c *concourseClient) ListJobs(ctx context.Context, teamName, pipelineName string) ([]atc.Job, error) {
+	client, err := c.getAuthClient(ctx)
+	if err != nil {
+		c.logger.Error("list-jobs.auth-client-error", err)
+		return nil, err
+	}
+	jobs, err := client.Team(teamName).ListJobs(pipelineName)
+	if err != nil {
+		c.logger.Error("list-jobs.unknown-list-error", err, lager.Data{"team-name": teamName, "pipeline": pipelineName})
+		return nil, classifyConcourseError(errors.Wrap(err, "Error listing jobs"), "Unable to list the Concourse jobs")
+	}
+	return jobs, nil
+}
+
+// jobBuildsPageSize is the number of builds ListJobBuilds asks for at once.
+const jobBuildsPageSize = 100
+
+// ListJobBuilds returns the builds of a job newer than the build with ID
+// since, oldest first, paging through them. Without since it returns the
+// newest page.
+func (c *concourseClient) ListJobBuilds(ctx context.Context, teamName, pipelineName, jobName string, since int) ([]atc.Build, error) {
+	client, err := c.getAuthClient(ctx)
+	if err != nil {
+		c.logger.Error("list-job-builds.auth-client-error", err)
+		return nil, err
+	}
+	var builds []atc.Build
+	for {
+		// Pages forward from since: a page holds the builds right after the
+		// build passed as Until, and since moves on to the newest of them.
+		page, _, found, err := client.Team(teamName).JobBuilds(pipelineName, jobName, concourse.Page{Until: since, Limit: jobBuildsPageSize})
+		if err != nil {
+			c.logger.Error("list-job-builds.unknown-list-error", err, lager.Data{"team-name": teamName, "pipeline": pipelineName, "job": jobName})
+			return nil, classifyConcourseError(errors.Wrap(err, "Error listing builds"), "Unable to list the Concourse builds")
+		}
+		if !found {
+			return builds, nil
+		}
+		sort.Slice(page, func(i, j int) bool { return page[i].ID < page[j].ID })
+		for _, build := range page {
+			if build.ID > since {
+				builds = append(builds, build)
+				since = build.ID
+			}
+		}
+		if len(page) < jobBuildsPageSize {
+			return builds, nil
+		}
+	}
+}
+
+// BuildEvents streams the events of a build until it ends or ctx is done. The
+// stream is not subject to the Concourse timeout, as builds run for long.
+func (c *concourseClient) BuildEvents(ctx context.Context, buildID int) (concourse.Events, error) {
+	client, err := c.newAuthClient(ctx, 0)
+	if err != nil {
+		c.logger.Error("build-events.auth-client-error", err)
+		return nil, err
+	}
+	events, err := client.BuildEvents(strconv.Itoa(buildID))
+	if err != nil {
+		c.logger.Error("build-events.unknown-stream-error", err, lager.Data{"build-id": buildID})
+		return nil, classifyConcourseError(errors.Wrap(err, "Error streaming build events"), "Unable to stream the Concourse build events")
+	}
+	return events, nil
+}
+
+func containsTeam(teams []atc.Team, teamName string) bool {
+	for _, team := range teams {
+		if team.Name == teamName {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *concourseClient) ListTeams(ctx context.Context) ([]atc.Team, error) {
+	client, err := c.getAuthClient(ctx)
+	if err != nil {
+		c.logger.Error("list-teams.auth-client-error", err)
+		return nil, err
+	}
+	teams, err := client.ListTeams()
+	if err != nil {
+		c.logger.Error("list-teams.unknown-list-error", err)
+		return nil, classifyConcourseError(errors.Wrap(err, "Error listing teams"), "Unable to list the Concourse teams")
+	}
+	return teams, nil
+}
+
+// ArchiveTeam exports the team's auth and pipeline configs and destroys the
+// team afterwards. Concourse doesn't hand out the auth of teams, so the
+// archive holds the auth for details and auth, as the team was created with.
+func (c *concourseClient) ArchiveTeam(ctx context.Context, details platformDetails, auth *teamAuthConfig) (teamArchive, error) {
+	teamName := getTeamName(details)
+	teamConfig, err := c.newTeam(details, auth)
+	if err != nil {
+		c.logger.Error("archive-team.auth-config-error", err)
+		return teamArchive{}, err
+	}
+	client, err := c.getAuthClient(ctx)
+	if err != nil {
+		c.logger.Error("archive-team.auth-client-error", err)
+		return teamArchive{}, err
+	}
+	teams, err := client.ListTeams()
+	if err != nil {
+		c.logger.Error("archive-team.list-teams-error", err)
+		return teamArchive{}, classifyConcourseError(errors.Wrap(err, "Error listing teams"), "Unable to list the Concourse teams")
+	}
+	if !containsTeam(teams, teamName) {
+		return teamArchive{}, errTeamNotFound
+	}
+	teamConfig.Name = teamName
+	archive := teamArchive{Team: teamConfig}
+
+	team := client.Team(teamName)
+	pipelines, err := team.ListPipelines()
+	if err != nil {
+		c.logger.Error("archive-team.list-pipelines-error", err)
+		return teamArchive{}, classifyConcourseError(errors.Wrap(err, "Error listing pipelines"), "Unable to list the Concourse pipelines")
+	}
+	for _, pipeline := range pipelines {
+		config, _, _, found, err := team.PipelineConfig(pipeline.Name)
+		if err != nil {
+			c.logger.Error("archive-team.pipeline-config-error", err, lager.Data{"pipeline": pipeline.Name})
+			return teamArchive{}, classifyConcourseError(errors.Wrap(err, "Error getting pipeline config"), "Unable to read the Concourse pipeline")
+		}
+		if !found {
+			continue
+		}
+		archive.Pipelines = append(archive.Pipelines, pipelineArchive{
+			Name:   pipeline.Name,
+			Paused: pipeline.Paused,
+			Config: config,
+		})
+	}
+
+	err = team.DestroyTeam(teamName)
+	if err != nil {
+		c.logger.Error("archive-team.unknown-delete-error", err,
+			lager.Data{
+				"team-name": teamName,
+			})
+		return teamArchive{}, classifyConcourseError(errors.Wrap(err, "Error deleting team"), "Unable to delete the Concourse team")
+	}
+	return archive, nil
+}
+
+// RestoreTeam recreates an archived team and sets its pipelines again.
+func (c *concourseClient) RestoreTeam(ctx context.Context, archive teamArchive) error {
+	client, err := c.getAuthClient(ctx)
+	if err != nil {
+		c.logger.Error("restore-team.auth-client-error", err)
+		return err
+	}
+	team := client.Team(archive.Team.Name)
+	_, _, _, err = team.CreateOrUpdate(archive.Team)
+	if err != nil {
+		c.logger.Error("restore-team.unknown-create-error", err,
+			lager.Data{
+				"team-name": archive.Team.Name,
+			})
+		return classifyConcourseError(errors.Wrap(err, "Error creating team"), "Unable to create the Concourse team")
+	}
+	for _, pipeline := range archive.Pipelines {
+		_, _, _, err = team.CreateOrUpdatePipelineConfig(pipeline.Name, "", pipeline.Config)
+		if err != nil {
+			c.logger.Error("restore-team.set-pipeline-error", err,
+				lager.Data{
+					"team-name": archive.Team.Name,
+					"pipeline":  pipeline.Name,
+				})
+			return classifyConcourseError(errors.Wrap(err, "Error setting pipeline"), "Unable to set the Concourse pipeline")
+		}
+		if !pipeline.Paused {
+			_, err = team.UnpausePipeline(pipeline.Name)
+			if err != nil {
+				return classifyConcourseError(errors.Wrap(err, "Error unpausing pipeline"), "Unable to set the Concourse pipeline")
+			}
+		}
+	}
 	return nil
 }
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/concourse/atc"
+	"github.com/concourse/go-concourse/concourse"
+	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
 )
 
@@ -21,40 +26,131 @@ func (t basicAuthTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 	return t.base.RoundTrip(r)
 }
 
-func newBasicAuthClient(username, password string) *http.Client {
+// contextTransport sends requests with ctx, for clients that don't take a
+// context themselves.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t contextTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(r.WithContext(t.ctx))
+}
+
+func newBasicAuthClient(username, password string, base http.RoundTripper) *http.Client {
 	httpClient := &http.Client{
 		Transport: basicAuthTransport{
 			username: username,
 			password: password,
-			base:     defaultTransport(),
+			base:     base,
 		},
 	}
 	return httpClient
 }
 
-func newOAuthClient(tokenType, tokenValue string) *http.Client {
+func newOAuthClient(tokenType, tokenValue string, base http.RoundTripper) *http.Client {
 	var oAuthToken *oauth2.Token
 	oAuthToken = &oauth2.Token{
 		TokenType:   tokenType,
 		AccessToken: tokenValue,
 	}
 
-	transport := defaultTransport()
-
-	transport = &oauth2.Transport{
+	transport := &oauth2.Transport{
 		Source: oauth2.StaticTokenSource(oAuthToken),
-		Base:   transport,
+		Base:   base,
 	}
 	return &http.Client{Transport: transport}
 }
 
+// defaultTransport pools and keeps alive connections. Clients hold on to their
+// transport for the lifetime of the broker to make use of that.
 func defaultTransport() http.RoundTripper {
-	var transport http.RoundTripper
-	transport = &http.Transport{
-		Dial: (&net.Dialer{
-			Timeout: 10 * time.Second,
-		}).Dial,
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+// concourseTokenTransport authenticates requests with a token of the main team
+// that is shared by all requests. When Concourse rejects the token, e.g. after
+// it expired, the transport logs in again and retries the request once.
+type concourseTokenTransport struct {
+	env  brokerConfig
+	base http.RoundTripper
+
+	mu    sync.Mutex
+	token *atc.AuthToken
+}
+
+func (t *concourseTokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	token, err := t.authToken(r.Context(), nil)
+	if err != nil {
+		return nil, err
 	}
+	resp, err := t.send(r, token)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if r.Body != nil && r.Body != http.NoBody && r.GetBody == nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+	token, err = t.authToken(r.Context(), &token)
+	if err != nil {
+		return nil, err
+	}
+	// A RoundTripper must not modify the caller's request, the retry is sent
+	// as a clone with a fresh body.
+	retry := r.Clone(r.Context())
+	if r.GetBody != nil {
+		retry.Body, err = r.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t.send(retry, token)
+}
+
+func (t *concourseTokenTransport) send(r *http.Request, token atc.AuthToken) (*http.Response, error) {
+	authenticated := r.WithContext(r.Context())
+	authenticated.Header = make(http.Header, len(r.Header))
+	for key, values := range r.Header {
+		authenticated.Header[key] = values
+	}
+	authenticated.Header.Set("Authorization", token.Type+" "+token.Value)
+	return t.base.RoundTrip(authenticated)
+}
+
+// authToken returns the shared token, logging in first if there is none yet
+// or if it is still the rejected one.
+func (t *concourseTokenTransport) authToken(ctx context.Context, rejected *atc.AuthToken) (atc.AuthToken, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != nil && (rejected == nil || *t.token != *rejected) {
+		return *t.token, nil
+	}
+	t.token = nil
+	token, err := t.login(ctx, t.env.AdminPassword)
+	if errors.Cause(err) == concourse.ErrUnauthorized && t.env.AdminPasswordSecondary != "" {
+		// During a rotation Concourse may still, or already, only accept the
+		// other password.
+		token, err = t.login(ctx, t.env.AdminPasswordSecondary)
+	}
+	if err != nil {
+		return atc.AuthToken{}, classifyConcourseError(errors.Wrap(err, "Error requesting auth token"), "Unable to authenticate with Concourse")
+	}
+	t.token = &token
+	return token, nil
+}
 
-	return transport
+func (t *concourseTokenTransport) login(ctx context.Context, password string) (atc.AuthToken, error) {
+	httpClient := newBasicAuthClient(t.env.AdminUsername, password, contextTransport{ctx: ctx, base: t.base})
+	httpClient.Timeout = t.env.ConcourseTimeout
+	return concourse.NewClient(t.env.ConcourseURL, httpClient).Team(adminTeam).AuthToken()
 }
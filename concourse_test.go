@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/concourse/atc"
+	"github.com/concourse/atc/auth/uaa"
+	"github.com/vchrisr/cf-concourse-broker/fakes/fakeatc"
+)
+
+func newTestConcourse(t *testing.T) (*fakeatc.Server, IccClient) {
+	server := fakeatc.New("admin", "password")
+	config := brokerConfig{
+		AdminUsername: "admin",
+		AdminPassword: "password",
+		ConcourseURL:  server.URL,
+		CFURL:         "https://api.example.com",
+		ClientID:      "concourse",
+		ClientSecret:  "secret",
+	}
+	return server, concourseNewClient(config, lager.NewLogger("test"))
+}
+
+func TestConcourseCreateAndDeleteTeam(t *testing.T) {
+	server, client := newTestConcourse(t)
+	defer server.Close()
+	details := platformDetails{Platform: platformCloudFoundry, OrgName: "my-org", SpaceGUID: "space-guid"}
+
+	err := client.CreateTeam(context.Background(), details, nil)
+	if err != nil {
+		t.Fatal("CreateTeam returned error: " + err.Error())
+	}
+	team, found := server.Team("my-org")
+	if !found {
+		t.Fatal("Team my-org was not created")
+	}
+	if team.Auth["uaa"] == nil {
+		t.Error("Team my-org has no uaa auth")
+	}
+
+	err = client.CreateTeam(context.Background(), details, nil)
+	if err == nil {
+		t.Error("CreateTeam didn't return an error for an existing team")
+	}
+
+	err = client.DeleteTeam(context.Background(), details)
+	if err != nil {
+		t.Fatal("DeleteTeam returned error: " + err.Error())
+	}
+	if _, found := server.Team("my-org"); found {
+		t.Error("Team my-org was not deleted")
+	}
+}
+
+func TestConcourseCreateTeamUpstreamFailure(t *testing.T) {
+	server, client := newTestConcourse(t)
+	defer server.Close()
+	server.Inject(fakeatc.Fault{Route: atc.SetTeam, Status: http.StatusInternalServerError})
+
+	err := client.CreateTeam(context.Background(), platformDetails{OrgName: "my-org"}, nil)
+	if err == nil {
+		t.Error("CreateTeam didn't return an error when Concourse failed")
+	}
+}
+
+func TestConcourseCreateTeamIsNotRetried(t *testing.T) {
+	server := fakeatc.New("admin", "password")
+	defer server.Close()
+	client := concourseNewClient(brokerConfig{
+		AdminUsername:      "admin",
+		AdminPassword:      "password",
+		ConcourseURL:       server.URL,
+		UpstreamMaxRetries: 3,
+	}, lager.NewLogger("test"))
+	server.Inject(fakeatc.Fault{Route: atc.SetTeam, Status: http.StatusBadGateway, Times: 1})
+
+	err := client.CreateTeam(context.Background(), platformDetails{OrgName: "my-org"}, nil)
+	if err == nil {
+		t.Error("CreateTeam didn't return an error when Concourse failed")
+	}
+	if puts := countRequests(server.Requests(), atc.SetTeam); puts != 1 {
+		t.Errorf("Expected the team to be set once but it was set %d times", puts)
+	}
+}
+
+func TestConcourseBadAdminCredentials(t *testing.T) {
+	server, client := newTestConcourse(t)
+	defer server.Close()
+	server.Inject(fakeatc.Fault{Route: atc.GetAuthToken, Status: http.StatusUnauthorized, Times: 1})
+
+	err := client.DeleteTeam(context.Background(), platformDetails{OrgName: "my-org"})
+	if err == nil {
+		t.Error("DeleteTeam didn't return an error without a token")
+	}
+}
+
+func TestConcourseSecondaryAdminPassword(t *testing.T) {
+	server := fakeatc.New("admin", "new-password")
+	defer server.Close()
+	config := brokerConfig{
+		AdminUsername:          "admin",
+		AdminPassword:          "old-password",
+		AdminPasswordSecondary: "new-password",
+		ConcourseURL:           server.URL,
+	}
+	client := concourseNewClient(config, lager.NewLogger("test"))
+
+	_, err := client.ListTeams(context.Background())
+	if err != nil {
+		t.Error("ListTeams returned error with the secondary password: " + err.Error())
+	}
+}
+
+func TestConcourseUpdateTeamAuth(t *testing.T) {
+	server, client := newTestConcourse(t)
+	defer server.Close()
+	details := platformDetails{Platform: platformCloudFoundry, OrgName: "my-org", SpaceGUID: "space-guid"}
+
+	err := client.UpdateTeamAuth(context.Background(), details, nil)
+	if kind, _ := errorKindOf(err); kind != kindNotFound {
+		t.Errorf("Expected a not found error for a missing team but got: %v", err)
+	}
+
+	err = client.CreateTeam(context.Background(), details, nil)
+	if err != nil {
+		t.Fatal("CreateTeam returned error: " + err.Error())
+	}
+	rotated := client.(*concourseClient)
+	rotated.env.ClientSecret = "rotated-secret"
+	err = rotated.UpdateTeamAuth(context.Background(), details, nil)
+	if err != nil {
+		t.Fatal("UpdateTeamAuth returned error: " + err.Error())
+	}
+	team, _ := server.Team("my-org")
+	var auth uaa.UAAAuthConfig
+	if team.Auth["uaa"] == nil || json.Unmarshal(*team.Auth["uaa"], &auth) != nil {
+		t.Fatal("Team my-org has no uaa auth")
+	}
+	if auth.ClientSecret != "rotated-secret" {
+		t.Error("Expected the rotated client secret but got: " + auth.ClientSecret)
+	}
+}
+
+func TestConcourseCreateTeamExtraAuth(t *testing.T) {
+	server, client := newTestConcourse(t)
+	defer server.Close()
+	auth := &teamAuthConfig{
+		GitHub:    &githubAuthConfig{ClientID: "id", ClientSecret: "secret", Users: []string{"octocat"}},
+		BasicAuth: &basicAuthConfig{Username: "ci", Password: "generated"},
+	}
+
+	err := client.CreateTeam(context.Background(), platformDetails{OrgName: "my-org", SpaceGUID: "space-guid"}, auth)
+	if err != nil {
+		t.Fatal("CreateTeam returned error: " + err.Error())
+	}
+	team, _ := server.Team("my-org")
+	if team.Auth["uaa"] == nil || team.Auth["github"] == nil {
+		t.Errorf("Expected uaa and github auth but got: %v", team.Auth)
+	}
+	if team.BasicAuth == nil || team.BasicAuth.BasicAuthUsername != "ci" {
+		t.Errorf("Expected basic auth for ci but got: %v", team.BasicAuth)
+	}
+}
+
+func TestConcourseArchiveAndRestoreTeam(t *testing.T) {
+	server, client := newTestConcourse(t)
+	defer server.Close()
+	err := client.CreateTeam(context.Background(), platformDetails{OrgName: "my-org", SpaceGUID: "space-guid"}, nil)
+	if err != nil {
+		t.Fatal("CreateTeam returned error: " + err.Error())
+	}
+	server.SetPipeline("my-org", "build", atc.Config{Jobs: atc.JobConfigs{{Name: "unit"}}}, false)
+
+	archive, err := client.ArchiveTeam(context.Background(), platformDetails{OrgName: "my-org", SpaceGUID: "space-guid"}, nil)
+	if err != nil {
+		t.Fatal("ArchiveTeam returned error: " + err.Error())
+	}
+	if len(archive.Pipelines) != 1 || archive.Pipelines[0].Config.Jobs[0].Name != "unit" {
+		t.Errorf("Pipelines were not archived: %+v", archive.Pipelines)
+	}
+	if _, found := server.Team("my-org"); found {
+		t.Error("Team my-org was not destroyed")
+	}
+
+	data, err := json.Marshal(archive)
+	if err != nil {
+		t.Fatal("Unable to marshal the archive: " + err.Error())
+	}
+	restored := teamArchive{}
+	err = json.Unmarshal(data, &restored)
+	if err != nil {
+		t.Fatal("Unable to unmarshal the archive: " + err.Error())
+	}
+	err = client.RestoreTeam(context.Background(), restored)
+	if err != nil {
+		t.Fatal("RestoreTeam returned error: " + err.Error())
+	}
+	if _, found := server.PipelineConfig("my-org", "build"); !found {
+		t.Error("Pipeline build was not restored")
+	}
+	team, _ := server.Team("my-org")
+	if team.Auth["uaa"] == nil {
+		t.Errorf("The auth of team my-org was not restored: %+v", team)
+	}
+}
+
+func TestConcourseHonoursContextDeadline(t *testing.T) {
+	server, client := newTestConcourse(t)
+	defer server.Close()
+	server.Inject(fakeatc.Fault{Route: atc.GetAuthToken, Latency: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.ListTeams(ctx)
+	if err == nil {
+		t.Fatal("ListTeams didn't return an error once the deadline passed")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("ListTeams wasn't cancelled at the deadline, took %s", elapsed)
+	}
+}
+
+func TestConcourseReusesAndRenewsToken(t *testing.T) {
+	server, client := newTestConcourse(t)
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.ListTeams(context.Background()); err != nil {
+			t.Fatal("ListTeams returned error: " + err.Error())
+		}
+	}
+	if logins := countRequests(server.Requests(), atc.GetAuthToken); logins != 1 {
+		t.Errorf("Expected the token to be reused but logged in %d times", logins)
+	}
+
+	server.RevokeTokens()
+	err := client.CreateTeam(context.Background(), platformDetails{OrgName: "my-org", SpaceGUID: "space-guid"}, nil)
+	if err != nil {
+		t.Fatal("CreateTeam returned error after the token was revoked: " + err.Error())
+	}
+	if logins := countRequests(server.Requests(), atc.GetAuthToken); logins != 2 {
+		t.Errorf("Expected a single new login after the token was revoked but logged in %d times", logins)
+	}
+}
+
+func TestConcourseTokenRenewalKeepsCallersRequest(t *testing.T) {
+	server, client := newTestConcourse(t)
+	defer server.Close()
+	transport := client.(*concourseClient).transport
+	if _, err := transport.authToken(context.Background(), nil); err != nil {
+		t.Fatal("Unable to log in: " + err.Error())
+	}
+	server.RevokeTokens()
+
+	req, _ := http.NewRequest("PUT", server.URL+"/api/v1/teams/my-org", strings.NewReader(`{"auth":{"uaa":{}}}`))
+	body := req.Body
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal("Request returned error: " + err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected the request to succeed after renewing the token but got: %d", resp.StatusCode)
+	}
+	if req.Body != body || req.Header.Get("Authorization") != "" {
+		t.Error("Renewing the token modified the caller's request")
+	}
+}
+
+func countRequests(requests []string, route string) int {
+	count := 0
+	for _, request := range requests {
+		if request == route {
+			count++
+		}
+	}
+	return count
+}
@@ -1,28 +1,248 @@
 package main
 
-import "github.com/kelseyhightower/envconfig"
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
 
 type brokerConfig struct {
-	BrokerUsername string `envconfig:"broker_username" required:"true"`
-	BrokerPassword string `envconfig:"broker_password" required:"true"`
-	AdminUsername  string `envconfig:"admin_username" required:"true"`
-	AdminPassword  string `envconfig:"admin_password" required:"true"`
-	ConcourseURL   string `envconfig:"concourse_url" required:"true"`
-	CFURL          string `envconfig:"cf_url" required:"true"`
-	TokenURL       string `envconfig:"token_url" required:"true"`
-	AuthURL        string `envconfig:"auth_url" required:"true"`
-	ClientID       string `envconfig:"client_id" required:"true"`
-	ClientSecret   string `envconfig:"client_secret" required:"true"`
-	LogLevel       string `envconfig:"log_level" default:"INFO"`
-	Port           string `envconfig:"port" default:"3000"`
+	BrokerUsername string `config:"broker_username" required:"true"`
+	BrokerPassword string `config:"broker_password" required:"true"`
+	AdminUsername  string `config:"admin_username" required:"true"`
+	AdminPassword  string `config:"admin_password" required:"true"`
+	ConcourseURL   string `config:"concourse_url" required:"true"`
+	CFURL          string `config:"cf_url" required:"true"`
+	TokenURL       string `config:"token_url" required:"true"`
+	AuthURL        string `config:"auth_url" required:"true"`
+	ClientID       string `config:"client_id" required:"true"`
+	ClientSecret   string `config:"client_secret" required:"true"`
+	LogLevel       string `config:"log_level" default:"INFO"`
+	Port           string `config:"port" default:"3000"`
+
+	ConcourseCACert string `config:"concourse_ca_cert"`
+
+	AdminPasswordSecondary string `config:"admin_password_secondary"`
+	ClientSecretSecondary  string `config:"client_secret_secondary"`
+
+	SecretsDir          string        `config:"secrets_dir"`
+	ConfigWatchInterval time.Duration `config:"config_watch_interval"`
+
+	InstanceStorePath string `config:"instance_store_path"`
+	InstanceStoreKey  string `config:"instance_store_key"`
+
+	RequestTimeout          time.Duration `config:"request_timeout" default:"60s"`
+	ConcourseTimeout        time.Duration `config:"concourse_timeout" default:"15s"`
+	CFTimeout               time.Duration `config:"cf_timeout" default:"15s"`
+	KubernetesTimeout       time.Duration `config:"kubernetes_timeout" default:"15s"`
+	CFCacheTTL              time.Duration `config:"cf_cache_ttl" default:"5m"`
+	CFCacheSize             int           `config:"cf_cache_size" default:"1000"`
+	UpstreamMaxRetries      int           `config:"upstream_max_retries" default:"3"`
+	UpstreamRetryDelay      time.Duration `config:"upstream_retry_delay" default:"200ms"`
+	UpstreamMaxRetryDelay   time.Duration `config:"upstream_max_retry_delay" default:"5s"`
+	CircuitBreakerThreshold int           `config:"circuit_breaker_threshold" default:"5"`
+	CircuitBreakerCooldown  time.Duration `config:"circuit_breaker_cooldown" default:"30s"`
+
+	DrainPollInterval time.Duration `config:"drain_poll_interval" default:"10s"`
+
+	NotifyWebhookURL     string        `config:"notify_webhook_url"`
+	NotifyWebhookSecret  string        `config:"notify_webhook_secret"`
+	NotifyFilePath       string        `config:"notify_file_path"`
+	NotifyDeadLetterPath string        `config:"notify_dead_letter_path"`
+	NotifyMaxRetries     int           `config:"notify_max_retries" default:"3"`
+	NotifyRetryDelay     time.Duration `config:"notify_retry_delay" default:"1s"`
+	NotifyTimeout        time.Duration `config:"notify_timeout" default:"10s"`
+
+	QuotaCheckInterval        time.Duration `config:"quota_check_interval"`
+	QuotaPauseExcessPipelines bool          `config:"quota_pause_excess_pipelines"`
+
+	TSAHost                  string `config:"tsa_host"`
+	TSAPublicKey             string `config:"tsa_public_key"`
+	TSATeamAuthorizedKeysDir string `config:"tsa_team_authorized_keys_dir"`
+
+	VaultAddr       string        `config:"vault_addr"`
+	VaultToken      string        `config:"vault_token"`
+	VaultPathPrefix string        `config:"vault_path_prefix" default:"concourse"`
+	VaultTimeout    time.Duration `config:"vault_timeout" default:"15s"`
+
+	CredHubURL            string        `config:"credhub_url"`
+	CredHubTokenURL       string        `config:"credhub_token_url"`
+	CredHubClientID       string        `config:"credhub_client_id"`
+	CredHubClientSecret   string        `config:"credhub_client_secret"`
+	CredHubPathPrefix     string        `config:"credhub_path_prefix" default:"/concourse"`
+	CredHubConcourseActor string        `config:"credhub_concourse_actor"`
+	CredHubTimeout        time.Duration `config:"credhub_timeout" default:"15s"`
+
+	KubernetesAPIURL string `config:"kubernetes_api_url"`
+	KubernetesToken  string `config:"kubernetes_token"`
+	OIDCIssuer       string `config:"oidc_issuer"`
+	OIDCClientID     string `config:"oidc_client_id"`
+	OIDCClientSecret string `config:"oidc_client_secret"`
+	OIDCGroupsClaim  string `config:"oidc_groups_claim" default:"groups"`
+}
+
+// configErrors lists every problem found while loading the configuration, so
+// they can be fixed in one go.
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return "Invalid configuration:\n  " + strings.Join(e, "\n  ")
 }
 
+type configField struct {
+	index    int
+	key      string
+	required bool
+	def      string
+}
+
+func configFields() []configField {
+	var fields []configField
+	t := reflect.TypeOf(brokerConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fields = append(fields, configField{
+			index:    i,
+			key:      field.Tag.Get("config"),
+			required: field.Tag.Get("required") == "true",
+			def:      field.Tag.Get("default"),
+		})
+	}
+	return fields
+}
+
+// brokerConfigLoad loads the configuration from the file named by CONFIG_FILE,
+// if any, and the environment.
 func brokerConfigLoad() (brokerConfig, error) {
-	var config brokerConfig
-	err := envconfig.Process("", &config)
+	return brokerConfigLoadFile(os.Getenv("CONFIG_FILE"))
+}
+
+// brokerConfigLoadFile layers the defaults, the YAML file at path and the
+// environment, in increasing precedence. ((name)) references in any value are
+// then resolved from the secret sources.
+func brokerConfigLoadFile(path string) (brokerConfig, error) {
+	var problems configErrors
+	fields := configFields()
+	values := make(map[string]string)
+
+	if path != "" {
+		fileValues, err := readConfigFile(path)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		known := make(map[string]bool)
+		for _, field := range fields {
+			known[field.key] = true
+		}
+		for key, value := range fileValues {
+			if !known[key] {
+				problems = append(problems, fmt.Sprintf("%s: unknown setting %s", path, key))
+				continue
+			}
+			values[key] = value
+		}
+	}
+	for _, field := range fields {
+		if value, ok := os.LookupEnv(strings.ToUpper(field.key)); ok {
+			values[field.key] = value
+		}
+	}
+
+	sources, err := newSecretSources(values)
 	if err != nil {
-		return brokerConfig{}, err
+		problems = append(problems, err.Error())
 	}
 
+	var config brokerConfig
+	configValue := reflect.ValueOf(&config).Elem()
+	for _, field := range fields {
+		value, ok := values[field.key]
+		if !ok {
+			value = field.def
+		}
+		value, err := resolveSecretReferences(value, sources)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", strings.ToUpper(field.key), err.Error()))
+			continue
+		}
+		if value == "" {
+			if field.required {
+				problems = append(problems, fmt.Sprintf("%s is required", strings.ToUpper(field.key)))
+			}
+			continue
+		}
+		err = setConfigField(configValue.Field(field.index), value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", strings.ToUpper(field.key), err.Error()))
+		}
+	}
+
+	if len(problems) > 0 {
+		return brokerConfig{}, problems
+	}
 	return config, nil
 }
+
+// readConfigFile reads a flat YAML map of settings, keyed by the lower case
+// names of the environment variables.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	values := make(map[string]string)
+	for key, value := range raw {
+		switch value.(type) {
+		case map[interface{}]interface{}, []interface{}:
+			return nil, fmt.Errorf("%s: setting %s must be a scalar", path, key)
+		case nil:
+			values[key] = ""
+		default:
+			values[key] = fmt.Sprint(value)
+		}
+	}
+	return values, nil
+}
+
+// setConfigField parses value into field. The value is left out of errors as
+// it may be a secret.
+func setConfigField(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("not a duration")
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("not an integer")
+		}
+		field.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("not a boolean")
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -60,3 +63,100 @@ func TestRequiredPassword(t *testing.T) {
 		t.Error("No error was thrown while required config BROKER_USERNAME was not set.")
 	}
 }
+
+func TestLayeredConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "admin_password"), []byte("from-file\n"), 0600)
+	configFile := filepath.Join(dir, "config.yml")
+	ioutil.WriteFile(configFile, []byte(`
+broker_username: broker
+broker_password: ((broker/password))
+admin_username: admin
+admin_password: ((admin_password))
+concourse_url: https://concourse.example.com
+cf_url: https://api.example.com
+token_url: https://uaa.example.com/oauth/token
+auth_url: https://login.example.com/oauth/authorize
+client_id: concourse
+client_secret: secret
+port: 8080
+secrets_dir: `+dir+`
+`), 0600)
+	os.Setenv("PORT", "9090")
+	os.Setenv("VCAP_SERVICES", `{"user-provided":[{"name":"broker","credentials":{"password":"from-vcap"}}]}`)
+	defer os.Unsetenv("PORT")
+	defer os.Unsetenv("VCAP_SERVICES")
+	for _, key := range []string{"BROKER_USERNAME", "BROKER_PASSWORD", "ADMIN_PASSWORD"} {
+		os.Unsetenv(key)
+	}
+
+	config, err := brokerConfigLoadFile(configFile)
+	if err != nil {
+		t.Fatal("Error loading config: " + err.Error())
+	}
+	if config.Port != "9090" {
+		t.Error("Expected PORT from the environment to override the file but got: " + config.Port)
+	}
+	if config.AdminPassword != "from-file" {
+		t.Error("Expected ((admin_password)) to resolve from the secrets dir but got: " + config.AdminPassword)
+	}
+	if config.BrokerPassword != "from-vcap" {
+		t.Error("Expected ((broker/password)) to resolve from VCAP_SERVICES but got: " + config.BrokerPassword)
+	}
+}
+
+func TestSecretsDirFromVCAP(t *testing.T) {
+	setTestConfigEnv()
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "admin_password"), []byte("from-file\n"), 0600)
+	os.Setenv("SECRETS_DIR", "((broker/secrets_dir))")
+	os.Setenv("ADMIN_PASSWORD", "((admin_password))")
+	os.Setenv("VCAP_SERVICES", `{"user-provided":[{"name":"broker","credentials":{"secrets_dir":"`+dir+`"}}]}`)
+	defer os.Unsetenv("SECRETS_DIR")
+	defer os.Unsetenv("ADMIN_PASSWORD")
+	defer os.Unsetenv("VCAP_SERVICES")
+
+	config, err := brokerConfigLoadFile("")
+	if err != nil {
+		t.Fatal("Error loading config: " + err.Error())
+	}
+	if config.SecretsDir != dir {
+		t.Error("Expected SECRETS_DIR to resolve from VCAP_SERVICES but got: " + config.SecretsDir)
+	}
+	if config.AdminPassword != "from-file" {
+		t.Error("Expected ((admin_password)) to resolve from the resolved secrets dir but got: " + config.AdminPassword)
+	}
+}
+
+func TestConfigReportsEveryProblem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.yml")
+	ioutil.WriteFile(configFile, []byte("brokr_username: typo\ncf_cache_ttl: forever\nadmin_password: ((missing))\n"), 0600)
+	for _, field := range configFields() {
+		os.Unsetenv(strings.ToUpper(field.key))
+	}
+
+	_, err = brokerConfigLoadFile(configFile)
+	problems, ok := err.(configErrors)
+	if !ok {
+		t.Fatalf("Expected configErrors but got: %v", err)
+	}
+	expected := []string{"unknown setting brokr_username", "CF_CACHE_TTL: not a duration", "ADMIN_PASSWORD: secret ((missing)) not found", "BROKER_USERNAME is required"}
+	for _, problem := range expected {
+		if !strings.Contains(problems.Error(), problem) {
+			t.Errorf("Expected problem %q to be reported in: %s", problem, problems.Error())
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// IcredentialManager prepares the credential manager Concourse looks up the
+// ((vars)) of a team's pipelines in.
+type IcredentialManager interface {
+	// CreateTeam sets up the secrets of a team and seeds them. Owned says
+	// the broker set them up before, so what exists of them is taken over
+	// rather than reported as a conflict.
+	CreateTeam(ctx context.Context, teamName string, secrets map[string]interface{}, owned bool) error
+	DeleteTeam(ctx context.Context, teamName string) error
+}
+
+// IcredentialBinder is implemented by credential managers that can give apps
+// access to the secrets of a team.
+type IcredentialBinder interface {
+	BindApp(ctx context.Context, teamName, appGUID string) (map[string]interface{}, error)
+	UnbindApp(ctx context.Context, teamName, appGUID string) error
+}
+
+// newCredentialManager returns the configured credential manager, or nil if
+// there is none. Vault takes precedence over CredHub.
+func newCredentialManager(config brokerConfig) IcredentialManager {
+	if config.VaultAddr != "" {
+		return newVaultClient(config)
+	}
+	if config.CredHubURL != "" {
+		return newCredHubClient(config)
+	}
+	return nil
+}
+
+var secretName = regexp.MustCompile(`^[A-Za-z0-9_-]+(/[A-Za-z0-9_-]+)*$`)
+
+// provisionParameters are the parameters the broker understands on provision.
+type provisionParameters struct {
+	// Secrets are seeded into the credential manager, by name.
+	Secrets map[string]interface{} `json:"secrets"`
+	// Auth adds auth providers to the team, merged over the ones of the plan.
+	Auth json.RawMessage `json:"auth"`
+}
+
+func parseProvisionParameters(raw json.RawMessage) (provisionParameters, error) {
+	var params provisionParameters
+	if len(raw) == 0 {
+		return params, nil
+	}
+	err := json.Unmarshal(raw, &params)
+	if err != nil {
+		err = errors.Wrap(err, "Invalid parameters")
+		return params, classify(err, kindInvalidInput, err.Error())
+	}
+	for name := range params.Secrets {
+		if !secretName.MatchString(name) {
+			err := errors.Errorf("Invalid secret name %q", name)
+			return params, classify(err, kindInvalidInput, err.Error())
+		}
+	}
+	return params, nil
+}
+
+// redactSecrets replaces the values of the secrets and the client secrets of
+// auth providers in raw by their digest, so the parameters kept in the
+// instance store hold no secrets but repeated requests can still be told
+// apart. The auth providers the client secrets end up in are encrypted by the
+// store instead.
+func redactSecrets(raw json.RawMessage) json.RawMessage {
+	var params map[string]json.RawMessage
+	if json.Unmarshal(raw, &params) != nil || (params["secrets"] == nil && params["auth"] == nil) {
+		return raw
+	}
+	if params["secrets"] != nil {
+		var secrets map[string]json.RawMessage
+		if json.Unmarshal(params["secrets"], &secrets) != nil {
+			return raw
+		}
+		digests := make(map[string]string, len(secrets))
+		for name, value := range secrets {
+			digests[name] = secretDigest(value)
+		}
+		params["secrets"], _ = json.Marshal(digests)
+	}
+	if params["auth"] != nil {
+		var providers map[string]map[string]json.RawMessage
+		if json.Unmarshal(params["auth"], &providers) != nil {
+			return raw
+		}
+		for _, fields := range providers {
+			if value, ok := fields["client_secret"]; ok {
+				fields["client_secret"], _ = json.Marshal(secretDigest(value))
+			}
+		}
+		params["auth"], _ = json.Marshal(providers)
+	}
+	redacted, err := json.Marshal(params)
+	if err != nil {
+		return raw
+	}
+	return redacted
+}
+
+func secretDigest(value json.RawMessage) string {
+	sum := sha256.Sum256([]byte(compactJSON(value)))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseProvisionParameters(t *testing.T) {
+	params, err := parseProvisionParameters(json.RawMessage(`{"secrets": {"docker-password": "hunter2"}}`))
+	if err != nil {
+		t.Fatal("parseProvisionParameters returned error: " + err.Error())
+	}
+	if params.Secrets["docker-password"] != "hunter2" {
+		t.Errorf("Unexpected secrets: %v", params.Secrets)
+	}
+
+	_, err = parseProvisionParameters(json.RawMessage(`{"secrets": {"../other-team/secret": "x"}}`))
+	if kind, _ := errorKindOf(err); kind != kindInvalidInput {
+		t.Errorf("Expected an invalid input error for a secret outside the team but got: %v", err)
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	redacted := redactSecrets(json.RawMessage(`{"secrets": {"docker-password": "hunter2"}, "other": 1}`))
+	if strings.Contains(string(redacted), "hunter2") {
+		t.Error("redactSecrets kept the secret: " + string(redacted))
+	}
+	if compactJSON(redacted) != compactJSON(redactSecrets(json.RawMessage(`{"other": 1, "secrets": {"docker-password": "hunter2"}}`))) {
+		t.Error("Expected the same parameters to be redacted the same")
+	}
+	if compactJSON(redacted) == compactJSON(redactSecrets(json.RawMessage(`{"secrets": {"docker-password": "other"}, "other": 1}`))) {
+		t.Error("Expected different secrets to be redacted differently")
+	}
+
+	redacted = redactSecrets(json.RawMessage(`{"auth": {"github": {"client_secret": "hunter2", "users": ["octocat"]}}}`))
+	if strings.Contains(string(redacted), "hunter2") || !strings.Contains(string(redacted), "octocat") {
+		t.Error("Expected only the client secret to be redacted: " + string(redacted))
+	}
+
+	unchanged := json.RawMessage(`{"b": 1, "a": 2}`)
+	if string(redactSecrets(unchanged)) != string(unchanged) {
+		t.Error("redactSecrets changed parameters without secrets")
+	}
+}
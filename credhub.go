@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// credhubClient scopes access to the secrets of every team under the path
+// prefix Concourse looks up ((vars)) in, through CredHub permissions.
+type credhubClient struct {
+	httpClient     *http.Client
+	url            string
+	prefix         string
+	concourseActor string
+}
+
+func newCredHubClient(config brokerConfig) *credhubClient {
+	base := &http.Client{
+		Transport: newRetryTransport(upstreamCredHub, config, defaultTransport()),
+		Timeout:   config.CredHubTimeout,
+	}
+	authConfig := &clientcredentials.Config{
+		ClientID:     config.CredHubClientID,
+		ClientSecret: config.CredHubClientSecret,
+		TokenURL:     config.CredHubTokenURL,
+	}
+	httpClient := authConfig.Client(context.WithValue(context.Background(), oauth2.HTTPClient, base))
+	httpClient.Timeout = config.CredHubTimeout
+	return &credhubClient{
+		httpClient:     httpClient,
+		url:            strings.TrimSuffix(config.CredHubURL, "/"),
+		prefix:         "/" + strings.Trim(config.CredHubPathPrefix, "/"),
+		concourseActor: config.CredHubConcourseActor,
+	}
+}
+
+func (c *credhubClient) teamPath(teamName string) string {
+	return c.prefix + "/" + teamName
+}
+
+// CreateTeam grants Concourse read access to the secrets of the team and
+// seeds the secrets. Scalar secrets are stored as value credentials, others as
+// json credentials. Paths in CredHub need no setting up, so there is nothing
+// owned could conflict with.
+func (c *credhubClient) CreateTeam(ctx context.Context, teamName string, secrets map[string]interface{}, owned bool) error {
+	if c.concourseActor != "" {
+		err := c.grant(ctx, c.teamPath(teamName)+"/*", c.concourseActor, []string{"read"})
+		if err != nil {
+			return err
+		}
+	}
+	for name, value := range secrets {
+		credentialType := "value"
+		if _, ok := value.(map[string]interface{}); ok {
+			credentialType = "json"
+		}
+		err := c.do(ctx, "PUT", "/api/v1/data", map[string]interface{}{
+			"name":  c.teamPath(teamName) + "/" + name,
+			"type":  credentialType,
+			"value": value,
+			"mode":  "overwrite",
+		}, nil)
+		if err != nil {
+			return errors.Wrapf(err, "Error writing secret %s", name)
+		}
+	}
+	return nil
+}
+
+// DeleteTeam deletes the secrets of the team and revokes the access of
+// Concourse to them.
+func (c *credhubClient) DeleteTeam(ctx context.Context, teamName string) error {
+	var found struct {
+		Credentials []struct {
+			Name string `json:"name"`
+		} `json:"credentials"`
+	}
+	err := c.do(ctx, "GET", "/api/v1/data?path="+url.QueryEscape(c.teamPath(teamName)), nil, &found)
+	if err != nil {
+		return err
+	}
+	for _, credential := range found.Credentials {
+		err = c.do(ctx, "DELETE", "/api/v1/data?name="+url.QueryEscape(credential.Name), nil, nil)
+		if err != nil && !isCredHubNotFound(err) {
+			return err
+		}
+	}
+	if c.concourseActor != "" {
+		return c.revoke(ctx, c.teamPath(teamName)+"/*", c.concourseActor)
+	}
+	return nil
+}
+
+// BindApp lets the app, authenticated by its instance identity, manage the
+// secrets of the team.
+func (c *credhubClient) BindApp(ctx context.Context, teamName, appGUID string) (map[string]interface{}, error) {
+	err := c.grant(ctx, c.teamPath(teamName)+"/*", "mtls-app:"+appGUID, []string{"read", "write", "delete"})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"credhub_url":  c.url,
+		"credhub_path": c.teamPath(teamName),
+	}, nil
+}
+
+func (c *credhubClient) UnbindApp(ctx context.Context, teamName, appGUID string) error {
+	return c.revoke(ctx, c.teamPath(teamName)+"/*", "mtls-app:"+appGUID)
+}
+
+// grant adds a permission, succeeding if the actor has one on the path already.
+func (c *credhubClient) grant(ctx context.Context, path, actor string, operations []string) error {
+	err := c.do(ctx, "POST", "/api/v2/permissions", map[string]interface{}{
+		"path":       path,
+		"actor":      actor,
+		"operations": operations,
+	}, nil)
+	if kind, _ := errorKindOf(err); kind == kindConflict {
+		return nil
+	}
+	return err
+}
+
+// revoke deletes the permission of the actor on the path, if there is one.
+func (c *credhubClient) revoke(ctx context.Context, path, actor string) error {
+	var permission struct {
+		UUID string `json:"uuid"`
+	}
+	query := url.Values{"path": {path}, "actor": {actor}}
+	err := c.do(ctx, "GET", "/api/v2/permissions?"+query.Encode(), nil, &permission)
+	if isCredHubNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = c.do(ctx, "DELETE", "/api/v2/permissions/"+url.PathEscape(permission.UUID), nil, nil)
+	if isCredHubNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func isCredHubNotFound(err error) bool {
+	kind, _ := errorKindOf(err)
+	return kind == kindNotFound
+}
+
+type credhubErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func (c *credhubClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.url+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return classify(errors.Wrap(err, "Error requesting CredHub"), kindUnavailable, "CredHub is unavailable")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		if out == nil {
+			return nil
+		}
+		return errors.Wrap(json.NewDecoder(resp.Body).Decode(out), "Error unmarshalling CredHub response")
+	}
+	var credhubErr credhubErrorResponse
+	json.NewDecoder(resp.Body).Decode(&credhubErr)
+	err = errors.Errorf("CredHub %s %s: %s %s", method, req.URL.Path, resp.Status, credhubErr.Error)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return classify(err, kindNotFound, "")
+	case resp.StatusCode == http.StatusConflict:
+		return classify(err, kindConflict, "")
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return classify(err, kindUnauthorized, "The broker is not authorized to manage CredHub")
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return classify(err, kindUnavailable, "CredHub is unavailable")
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vchrisr/cf-concourse-broker/fakes/fakecredhub"
+)
+
+func newTestCredHub() (*fakecredhub.Server, *credhubClient) {
+	server := fakecredhub.New("broker", "broker-secret")
+	config := brokerConfig{
+		CredHubURL:            server.URL,
+		CredHubTokenURL:       server.URL + "/oauth/token",
+		CredHubClientID:       "broker",
+		CredHubClientSecret:   "broker-secret",
+		CredHubPathPrefix:     "/concourse",
+		CredHubConcourseActor: "uaa-client:concourse_to_credhub",
+	}
+	return server, newCredHubClient(config)
+}
+
+func TestCredHubCreateAndDeleteTeam(t *testing.T) {
+	server, client := newTestCredHub()
+	defer server.Close()
+
+	err := client.CreateTeam(context.Background(), "my-org", map[string]interface{}{
+		"docker-password": "hunter2",
+		"deploy/aws":      map[string]interface{}{"access_key": "key"},
+	}, false)
+	if err != nil {
+		t.Fatal("CreateTeam returned error: " + err.Error())
+	}
+	permission, found := server.Permission("/concourse/my-org/*", "uaa-client:concourse_to_credhub")
+	if !found || len(permission.Operations) != 1 || permission.Operations[0] != "read" {
+		t.Errorf("Expected Concourse to be granted read on the team but got: %v", permission)
+	}
+	if value, _ := server.Credential("/concourse/my-org/docker-password"); value != "hunter2" {
+		t.Errorf("Expected the secret to be seeded but got: %v", value)
+	}
+
+	err = client.CreateTeam(context.Background(), "my-org", nil, false)
+	if err != nil {
+		t.Error("CreateTeam returned error for an existing permission: " + err.Error())
+	}
+
+	err = client.DeleteTeam(context.Background(), "my-org")
+	if err != nil {
+		t.Fatal("DeleteTeam returned error: " + err.Error())
+	}
+	if _, found := server.Permission("/concourse/my-org/*", "uaa-client:concourse_to_credhub"); found {
+		t.Error("DeleteTeam didn't revoke the permission of Concourse")
+	}
+	if _, found := server.Credential("/concourse/my-org/deploy/aws"); found {
+		t.Error("DeleteTeam left the secrets of the team behind")
+	}
+
+	err = client.DeleteTeam(context.Background(), "my-org")
+	if err != nil {
+		t.Error("DeleteTeam returned error for a deleted team: " + err.Error())
+	}
+}
+
+func TestCredHubBindApp(t *testing.T) {
+	server, client := newTestCredHub()
+	defer server.Close()
+
+	credentials, err := client.BindApp(context.Background(), "my-org", "app-guid")
+	if err != nil {
+		t.Fatal("BindApp returned error: " + err.Error())
+	}
+	if credentials["credhub_path"] != "/concourse/my-org" {
+		t.Errorf("Expected the path of the team but got: %v", credentials)
+	}
+	if _, found := server.Permission("/concourse/my-org/*", "mtls-app:app-guid"); !found {
+		t.Error("BindApp didn't grant the app access to the team")
+	}
+
+	err = client.UnbindApp(context.Background(), "my-org", "app-guid")
+	if err != nil {
+		t.Fatal("UnbindApp returned error: " + err.Error())
+	}
+	if _, found := server.Permission("/concourse/my-org/*", "mtls-app:app-guid"); found {
+		t.Error("UnbindApp didn't revoke the access of the app")
+	}
+}
+
+func TestCredHubBadClientSecret(t *testing.T) {
+	server, _ := newTestCredHub()
+	defer server.Close()
+	client := newCredHubClient(brokerConfig{
+		CredHubURL:          server.URL,
+		CredHubTokenURL:     server.URL + "/oauth/token",
+		CredHubClientID:     "broker",
+		CredHubClientSecret: "wrong",
+	})
+
+	_, err := client.BindApp(context.Background(), "my-org", "app-guid")
+	if err == nil {
+		t.Error("Expected an error for a bad client secret")
+	}
+}
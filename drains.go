@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/concourse/atc"
+	"github.com/concourse/atc/event"
+	"github.com/pkg/errors"
+)
+
+var (
+	drainMessages = newCounter("drain_messages_total", "Build events forwarded to drain bindings.")
+	drainFailures = newCounter("drain_failures_total", "Build events that couldn't be forwarded to drain bindings.")
+)
+
+// drainCredentials are returned to drain bindings. Credentials in the drain
+// URL are left out.
+type drainCredentials struct {
+	Team     string `json:"team"`
+	DrainURL string `json:"drain_url"`
+}
+
+func newDrainCredentials(teamName, drain string) drainCredentials {
+	u, _ := url.Parse(drain)
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	return drainCredentials{Team: teamName, DrainURL: u.String()}
+}
+
+// drainForwarder forwards the build events of the jobs of every team with a
+// drain binding to the drain, following the bindings in the instance store.
+// With a lease, it only forwards while it holds the lease.
+type drainForwarder struct {
+	broker *broker
+	logger lager.Logger
+	lease  *drainLease
+	drains map[string]*teamDrain
+}
+
+func newDrainForwarder(b *broker, lease *drainLease) *drainForwarder {
+	return &drainForwarder{
+		broker: b,
+		logger: b.logger.Session("drains"),
+		lease:  lease,
+		drains: make(map[string]*teamDrain),
+	}
+}
+
+// drainLease lets one of the broker instances sharing an instance store
+// forward the build events. The holder renews it on every poll and others
+// take it over once it expired, e.g. when the holder stopped.
+type drainLease struct {
+	path   string
+	holder string
+	ttl    time.Duration
+}
+
+type drainLeaseRecord struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// newDrainLease returns the lease kept next to the instance store at
+// storePath, or nil for a store in memory, which no other instance shares.
+func newDrainLease(storePath string, pollInterval time.Duration) *drainLease {
+	if storePath == "" {
+		return nil
+	}
+	holder := os.Getenv("CF_INSTANCE_GUID")
+	if holder == "" {
+		hostname, _ := os.Hostname()
+		holder = hostname + "/" + strconv.Itoa(os.Getpid())
+	}
+	return &drainLease{path: storePath + ".drains", holder: holder, ttl: 3 * pollInterval}
+}
+
+// acquire takes or renews the lease, and reports whether it is held. A nil
+// lease is always held.
+func (l *drainLease) acquire(now time.Time) (bool, error) {
+	if l == nil {
+		return true, nil
+	}
+	current, err := l.read()
+	if err != nil {
+		return false, err
+	}
+	if current.Holder != l.holder && now.Before(current.Expires) {
+		return false, nil
+	}
+	data, err := json.Marshal(drainLeaseRecord{Holder: l.holder, Expires: now.Add(l.ttl)})
+	if err != nil {
+		return false, err
+	}
+	tmp := l.path + "." + strconv.Itoa(os.Getpid())
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return false, errors.Wrap(err, "Error writing the drain lease")
+	}
+	err = os.Rename(tmp, l.path)
+	if err != nil {
+		return false, errors.Wrap(err, "Error writing the drain lease")
+	}
+	// Instances taking over an expired lease at once both write it, the
+	// last write wins.
+	current, err = l.read()
+	return current.Holder == l.holder, err
+}
+
+// read returns the lease as written, or an expired one if there is none or it
+// can't be parsed.
+func (l *drainLease) read() (drainLeaseRecord, error) {
+	var lease drainLeaseRecord
+	data, err := ioutil.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return lease, nil
+	}
+	if err != nil {
+		return lease, errors.Wrap(err, "Error reading the drain lease")
+	}
+	if json.Unmarshal(data, &lease) != nil {
+		return drainLeaseRecord{}, nil
+	}
+	return lease, nil
+}
+
+// watch polls for new builds every interval until stop is closed.
+func (f *drainForwarder) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			f.poll(ctx)
+			cancel()
+		case <-stop:
+			f.stopAll()
+			return
+		}
+	}
+}
+
+func (f *drainForwarder) stopAll() {
+	for id, drain := range f.drains {
+		drain.stop()
+		delete(f.drains, id)
+	}
+}
+
+// poll starts and stops forwarding to match the drain bindings, and starts
+// streaming the builds started since the last poll. The builds that finished
+// before a drain is first polled are not forwarded. Without the lease it
+// stops forwarding.
+func (f *drainForwarder) poll(ctx context.Context) {
+	held, err := f.lease.acquire(time.Now())
+	if err != nil {
+		f.logger.Error("lease-error", err)
+		held = false
+	}
+	if !held {
+		f.stopAll()
+		return
+	}
+	b := f.broker.current()
+	records, err := b.store.List()
+	if err != nil {
+		f.logger.Error("list-instances-error", err)
+		return
+	}
+	bound := make(map[string]teamDrainBinding)
+	for _, record := range records {
+		for id, binding := range record.Bindings {
+			if binding.Drain != "" {
+				bound[id] = teamDrainBinding{team: record.TeamName, url: binding.Drain}
+			}
+		}
+	}
+
+	for id, drain := range f.drains {
+		if bound[id] != drain.binding {
+			drain.stop()
+			delete(f.drains, id)
+		}
+	}
+	for id, binding := range bound {
+		drain, ok := f.drains[id]
+		if !ok {
+			logDrain, err := newLogDrain(binding.url, b.env.ConcourseTimeout)
+			if err != nil {
+				f.logger.Error("drain-error", err, lager.Data{"binding-id": id})
+				continue
+			}
+			drain = newTeamDrain(binding, logDrain, f.logger.WithData(lager.Data{"binding-id": id, "team-name": binding.team}))
+			f.drains[id] = drain
+		}
+		drain.poll(ctx, b.concourse)
+	}
+}
+
+type teamDrainBinding struct {
+	team string
+	url  string
+}
+
+// teamDrain forwards the builds of one team to one drain. Builds are streamed
+// concurrently, their messages are sent one at a time.
+type teamDrain struct {
+	binding teamDrainBinding
+	logger  lager.Logger
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	// lastBuilds holds the ID of the newest build seen, by pipeline and job.
+	// It is nil until the first poll.
+	lastBuilds map[string]int
+
+	mu    sync.Mutex
+	drain IlogDrain
+}
+
+func newTeamDrain(binding teamDrainBinding, drain IlogDrain, logger lager.Logger) *teamDrain {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &teamDrain{
+		binding: binding,
+		logger:  logger,
+		ctx:     ctx,
+		cancel:  cancel,
+		drain:   drain,
+	}
+}
+
+func (d *teamDrain) poll(ctx context.Context, concourseClient IccClient) {
+	pipelines, err := concourseClient.ListPipelines(ctx, d.binding.team)
+	if err != nil {
+		d.logger.Error("list-pipelines-error", err)
+		return
+	}
+	first := d.lastBuilds == nil
+	if first {
+		d.lastBuilds = make(map[string]int)
+	}
+	for _, pipeline := range pipelines {
+		jobs, err := concourseClient.ListJobs(ctx, d.binding.team, pipeline.Name)
+		if err != nil {
+			d.logger.Error("list-jobs-error", err, lager.Data{"pipeline": pipeline.Name})
+			continue
+		}
+		for _, job := range jobs {
+			key := pipeline.Name + "/" + job.Name
+			if first {
+				for _, build := range []*atc.Build{job.FinishedBuild, job.NextBuild} {
+					if build == nil || build.ID <= d.lastBuilds[key] {
+						continue
+					}
+					d.lastBuilds[key] = build.ID
+					if build.IsRunning() {
+						d.stream(concourseClient, pipeline.Name, job.Name, *build)
+					}
+				}
+				continue
+			}
+			builds, err := concourseClient.ListJobBuilds(ctx, d.binding.team, pipeline.Name, job.Name, d.lastBuilds[key])
+			if err != nil {
+				d.logger.Error("list-builds-error", err, lager.Data{"pipeline": pipeline.Name, "job": job.Name})
+				continue
+			}
+			for _, build := range builds {
+				d.lastBuilds[key] = build.ID
+				d.stream(concourseClient, pipeline.Name, job.Name, build)
+			}
+		}
+	}
+}
+
+// stream forwards the events of a build until it ends or the drain is stopped.
+func (d *teamDrain) stream(concourseClient IccClient, pipelineName, jobName string, build atc.Build) {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		logData := lager.Data{"pipeline": pipelineName, "job": jobName, "build-id": build.ID}
+		events, err := concourseClient.BuildEvents(d.ctx, build.ID)
+		if err != nil {
+			d.logger.Error("build-events-error", err, logData)
+			return
+		}
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-d.ctx.Done():
+				events.Close()
+			case <-done:
+			}
+		}()
+		defer events.Close()
+		for {
+			e, err := events.NextEvent()
+			if err != nil {
+				if err != io.EOF && d.ctx.Err() == nil {
+					d.logger.Error("next-event-error", err, logData)
+				}
+				return
+			}
+			message, ok := buildEventMessage(d.binding.team, pipelineName, jobName, build.Name, e)
+			if ok {
+				d.send(message)
+			}
+		}
+	}()
+}
+
+func (d *teamDrain) send(message syslogMessage) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := d.drain.Send(message)
+	if err != nil {
+		drainFailures.Inc()
+		d.logger.Error("send-error", err)
+		return
+	}
+	drainMessages.Inc()
+}
+
+// stop stops streaming and closes the drain.
+func (d *teamDrain) stop() {
+	d.cancel()
+	d.wg.Wait()
+	d.drain.Close()
+}
+
+// buildEventMessage turns the logs, status changes and errors of a build into
+// syslog messages: the team is the hostname, the pipeline the app name, the
+// job and build the process ID and the event type the message ID. Other
+// events are not forwarded.
+func buildEventMessage(teamName, pipelineName, jobName, buildName string, e atc.Event) (syslogMessage, bool) {
+	message := syslogMessage{
+		Severity: syslogSeverityInfo,
+		Time:     time.Now(),
+		Hostname: teamName,
+		AppName:  pipelineName,
+		ProcID:   jobName + "/" + buildName,
+		MsgID:    string(e.EventType()),
+	}
+	switch e := e.(type) {
+	case event.Log:
+		message.Message = strings.TrimRight(e.Payload, "\r\n")
+		if e.Origin.Source == event.OriginSourceStderr {
+			message.Severity = syslogSeverityErr
+		}
+	case event.Status:
+		message.Time = time.Unix(e.Time, 0)
+		message.Message = "build " + buildName + " " + string(e.Status)
+		if e.Status == atc.StatusFailed || e.Status == atc.StatusErrored {
+			message.Severity = syslogSeverityErr
+		}
+	case event.Error:
+		message.Severity = syslogSeverityErr
+		message.Message = e.Message
+	default:
+		return syslogMessage{}, false
+	}
+	return message, message.Message != ""
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/concourse/atc"
+	"github.com/concourse/atc/event"
+	"github.com/vchrisr/cf-concourse-broker/fakes/fakeatc"
+)
+
+// readSyslogFrames reads octet counted frames from the first connection to
+// listener.
+func readSyslogFrames(listener net.Listener) <-chan string {
+	frames := make(chan string, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			length, err := reader.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(length))
+			frame := make([]byte, n)
+			_, err = io.ReadFull(reader, frame)
+			if err != nil {
+				return
+			}
+			frames <- string(frame)
+		}
+	}()
+	return frames
+}
+
+func TestDrainForwarder(t *testing.T) {
+	server := fakeatc.New("admin", "password")
+	defer server.Close()
+	server.SetPipeline("my-org", "my-pipeline", atc.Config{Jobs: atc.JobConfigs{{Name: "unit"}}}, false)
+	server.AddBuild(atc.Build{TeamName: "my-org", PipelineName: "my-pipeline", JobName: "unit", Status: string(atc.StatusSucceeded)},
+		event.Log{Payload: "old build\n"})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	frames := readSyslogFrames(listener)
+
+	config := brokerConfig{AdminUsername: "admin", AdminPassword: "password", ConcourseURL: server.URL, ConcourseTimeout: time.Second}
+	store, _ := newInstanceStore("", "")
+	store.Put(instanceRecord{InstanceID: "instance-id", TeamName: "my-org", Bindings: map[string]bindingRecord{
+		"binding-id": {Drain: "syslog://" + listener.Addr().String()},
+	}})
+	forwarder := newDrainForwarder(&broker{
+		logger:    lager.NewLogger("test"),
+		env:       config,
+		concourse: concourseNewClient(config, lager.NewLogger("test")),
+		store:     store,
+	}, nil)
+
+	forwarder.poll(context.Background())
+	buildID := server.AddBuild(atc.Build{TeamName: "my-org", PipelineName: "my-pipeline", JobName: "unit", Status: string(atc.StatusStarted)},
+		event.Log{Payload: "ok  \tgithub.com/vchrisr/cf-concourse-broker\n"},
+		event.Status{Status: atc.StatusFailed, Time: 1507000000})
+	forwarder.poll(context.Background())
+
+	var received []string
+	for len(received) < 2 {
+		select {
+		case frame := <-frames:
+			received = append(received, frame)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 2 messages but got: %v", received)
+		}
+	}
+	build := strconv.Itoa(buildID)
+	if !strings.HasPrefix(received[0], "<14>1 ") || !strings.HasSuffix(received[0], " my-org my-pipeline unit/"+build+" log - ok  \tgithub.com/vchrisr/cf-concourse-broker") {
+		t.Error("Unexpected log message: " + received[0])
+	}
+	if !strings.HasPrefix(received[1], "<11>1 ") || !strings.HasSuffix(received[1], " - build "+build+" failed") {
+		t.Error("Unexpected status message: " + received[1])
+	}
+
+	// Builds that both finished between two polls are forwarded.
+	first := server.AddBuild(atc.Build{TeamName: "my-org", PipelineName: "my-pipeline", JobName: "unit", Status: string(atc.StatusSucceeded)},
+		event.Log{Payload: "first\n"})
+	second := server.AddBuild(atc.Build{TeamName: "my-org", PipelineName: "my-pipeline", JobName: "unit", Status: string(atc.StatusSucceeded)},
+		event.Log{Payload: "second\n"})
+	forwarder.poll(context.Background())
+	// The builds are streamed concurrently, so their messages are told apart
+	// by their text.
+	forwarded := make(map[string]string)
+	for len(forwarded) < 2 {
+		select {
+		case frame := <-frames:
+			forwarded[frame[strings.LastIndex(frame, " ")+1:]] = frame
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the messages of both builds but got: %v", forwarded)
+		}
+	}
+	if !strings.Contains(forwarded["first"], " unit/"+strconv.Itoa(first)+" ") || !strings.Contains(forwarded["second"], " unit/"+strconv.Itoa(second)+" ") {
+		t.Errorf("Unexpected messages of the finished builds: %v", forwarded)
+	}
+
+	store.Delete("instance-id")
+	forwarder.poll(context.Background())
+	if len(forwarder.drains) != 0 {
+		t.Error("Expected the drain to be stopped once its binding is gone")
+	}
+}
+
+func TestDrainLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drain-lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "instances.json.drains")
+	one := &drainLease{path: path, holder: "one", ttl: time.Minute}
+	other := &drainLease{path: path, holder: "other", ttl: time.Minute}
+	now := time.Now()
+
+	if held, err := one.acquire(now); !held || err != nil {
+		t.Fatalf("Expected the free lease to be taken but got: %v, %v", held, err)
+	}
+	if held, _ := other.acquire(now.Add(time.Second)); held {
+		t.Error("A lease held by another instance was taken")
+	}
+	if held, _ := one.acquire(now.Add(30 * time.Second)); !held {
+		t.Error("The holder couldn't renew the lease")
+	}
+	if held, _ := other.acquire(now.Add(2 * time.Minute)); !held {
+		t.Error("An expired lease wasn't taken over")
+	}
+	if held, _ := one.acquire(now.Add(2 * time.Minute)); held {
+		t.Error("The former holder kept the lease taken over")
+	}
+	var lease *drainLease
+	if held, _ := lease.acquire(now); !held {
+		t.Error("A nil lease isn't held")
+	}
+}
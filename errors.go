@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"net/url"
+
+	"github.com/concourse/go-concourse/concourse"
+	"github.com/pkg/errors"
+)
+
+// errorKind classifies failures of Cloud Foundry, Kubernetes and Concourse so
+// the broker can answer with a matching response.
+type errorKind string
+
+const (
+	kindNotFound      errorKind = "not-found"
+	kindUnauthorized  errorKind = "unauthorized"
+	kindConflict      errorKind = "conflict"
+	kindUnavailable   errorKind = "upstream-unavailable"
+	kindInvalidInput  errorKind = "invalid-input"
+	kindQuotaExceeded errorKind = "quota-exceeded"
+)
+
+// classifiedError attaches a kind and a description that is safe to show to
+// users to an error. The cause stays reachable through errors.Cause.
+type classifiedError struct {
+	cause       error
+	kind        errorKind
+	description string
+}
+
+func (e *classifiedError) Error() string { return e.cause.Error() }
+func (e *classifiedError) Cause() error  { return e.cause }
+
+func classify(err error, kind errorKind, description string) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{cause: err, kind: kind, description: description}
+}
+
+// errorKindOf returns the kind and description of the outermost classification
+// of err, or an empty kind if err was never classified.
+func errorKindOf(err error) (errorKind, string) {
+	type causer interface {
+		Cause() error
+	}
+	for err != nil {
+		if classified, ok := err.(*classifiedError); ok {
+			return classified.kind, classified.description
+		}
+		// http.Client wraps the errors of its transport, which may have been
+		// classified already.
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+			continue
+		}
+		cause, ok := err.(causer)
+		if !ok {
+			break
+		}
+		err = cause.Cause()
+	}
+	return "", ""
+}
+
+// isUnreachable reports whether err is a failure to reach a server at all.
+func isUnreachable(err error) bool {
+	if _, ok := err.(*url.Error); ok {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// classifyConcourseError classifies the errors returned by go-concourse.
+func classifyConcourseError(err error, description string) error {
+	if kind, _ := errorKindOf(err); kind != "" {
+		return err
+	}
+	cause := errors.Cause(err)
+	switch {
+	case cause == concourse.ErrUnauthorized || cause == concourse.ErrForbidden:
+		return classify(err, kindUnauthorized, "The broker is not authorized to manage Concourse teams")
+	case isUnreachable(cause):
+		return classify(err, kindUnavailable, "Concourse is unavailable")
+	}
+	return classify(err, "", description)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+	"github.com/pkg/errors"
+)
+
+func TestErrorKindOfWrappedError(t *testing.T) {
+	err := errors.Wrap(classify(errors.New("boom"), kindConflict, "Conflict"), "context")
+	kind, description := errorKindOf(err)
+	if kind != kindConflict || description != "Conflict" {
+		t.Errorf("Unexpected classification: %s %s", kind, description)
+	}
+	if errors.Cause(err).Error() != "boom" {
+		t.Error("The cause of a classified error should stay reachable")
+	}
+	if kind, _ := errorKindOf(errors.New("boom")); kind != "" {
+		t.Error("Unclassified errors should have no kind, got: " + string(kind))
+	}
+}
+
+func TestClassifyCFError(t *testing.T) {
+	cases := map[int]errorKind{
+		http.StatusNotFound:           kindNotFound,
+		http.StatusUnauthorized:       kindUnauthorized,
+		http.StatusServiceUnavailable: kindUnavailable,
+	}
+	for status, expected := range cases {
+		err := classifyCFError(status, cfclient.CloudFoundryError{Code: status})
+		if kind, _ := errorKindOf(err); kind != expected {
+			t.Errorf("Expected status %d to be classified as %s but got: %s", status, expected, kind)
+		}
+	}
+}
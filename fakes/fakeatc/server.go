@@ -0,0 +1,727 @@
+// Package fakeatc provides an in-memory Concourse ATC, served over httptest,
+// implementing the endpoints the broker uses through go-concourse.
+package fakeatc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/concourse/atc"
+	"github.com/concourse/atc/event"
+	"github.com/tedsuo/rata"
+	"github.com/vito/go-sse/sse"
+	"gopkg.in/yaml.v2"
+)
+
+// Version is reported by the info endpoint.
+const Version = "3.5.0"
+
+// Fault makes the server misbehave for requests to a route.
+type Fault struct {
+	// Route is the atc route name, e.g. atc.SetTeam. Empty matches every route.
+	Route string
+	// Status is returned instead of handling the request. Zero handles it.
+	Status int
+	// Latency is waited before the request is handled.
+	Latency time.Duration
+	// Times is the number of requests affected. Zero affects all of them.
+	Times int
+}
+
+type pipeline struct {
+	atc.Pipeline
+	Config  atc.Config
+	Version int
+}
+
+type build struct {
+	atc.Build
+	Events []atc.Event
+}
+
+type team struct {
+	atc.Team
+	Pipelines map[string]*pipeline
+}
+
+// Server is a fake ATC. Its state is kept in memory and is safe for concurrent
+// use.
+type Server struct {
+	*httptest.Server
+
+	username string
+	password string
+
+	mu       sync.Mutex
+	teams    map[string]*team
+	workers  map[string]atc.Worker
+	builds   map[int]*build
+	tokens   map[string]string
+	faults   []*Fault
+	requests []string
+	nextID   int
+}
+
+var handledRoutes = map[string]func(s *Server, w http.ResponseWriter, r *http.Request){
+	atc.GetInfo:          (*Server).getInfo,
+	atc.GetAuthToken:     (*Server).getAuthToken,
+	atc.ListAuthMethods:  (*Server).listAuthMethods,
+	atc.ListTeams:        (*Server).listTeams,
+	atc.SetTeam:          (*Server).setTeam,
+	atc.DestroyTeam:      (*Server).destroyTeam,
+	atc.ListPipelines:    (*Server).listPipelines,
+	atc.GetPipeline:      (*Server).getPipeline,
+	atc.DeletePipeline:   (*Server).deletePipeline,
+	atc.PausePipeline:    (*Server).pausePipeline,
+	atc.UnpausePipeline:  (*Server).unpausePipeline,
+	atc.GetConfig:        (*Server).getConfig,
+	atc.SaveConfig:       (*Server).saveConfig,
+	atc.ListAllPipelines: (*Server).listAllPipelines,
+	atc.ListWorkers:      (*Server).listWorkers,
+	atc.PruneWorker:      (*Server).pruneWorker,
+	atc.ListJobs:         (*Server).listJobs,
+	atc.ListJobBuilds:    (*Server).listJobBuilds,
+	atc.BuildEvents:      (*Server).buildEvents,
+}
+
+// New starts a fake ATC whose main team authenticates with the given basic
+// auth credentials.
+func New(username, password string) *Server {
+	s := &Server{
+		username: username,
+		password: password,
+		teams:    make(map[string]*team),
+		workers:  make(map[string]atc.Worker),
+		builds:   make(map[int]*build),
+		tokens:   make(map[string]string),
+	}
+	s.addTeam(atc.Team{Name: atc.DefaultTeamName})
+
+	var routes rata.Routes
+	handlers := rata.Handlers{}
+	for _, route := range atc.Routes {
+		handle, ok := handledRoutes[route.Name]
+		if !ok {
+			continue
+		}
+		routes = append(routes, route)
+		handlers[route.Name] = s.wrap(route.Name, handle)
+	}
+	router, err := rata.NewRouter(routes, handlers)
+	if err != nil {
+		panic(err)
+	}
+	s.Server = httptest.NewServer(router)
+	return s
+}
+
+// Inject adds a fault. Faults are applied in the order they were added.
+func (s *Server) Inject(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault)
+}
+
+// ClearFaults removes all faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Requests returns the names of the routes requested so far.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// Team returns the team with the given name, including its auth.
+func (s *Server) Team(name string) (atc.Team, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.teams[name]
+	if !ok {
+		return atc.Team{}, false
+	}
+	return t.Team, true
+}
+
+// TeamNames returns the names of all teams, sorted.
+func (s *Server) TeamNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.teams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RevokeTokens invalidates all tokens handed out so far.
+func (s *Server) RevokeTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = make(map[string]string)
+}
+
+// AddTeam creates a team as if it was set by another client.
+func (s *Server) AddTeam(t atc.Team) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addTeam(t)
+}
+
+// AddWorker registers a worker as if it registered through the TSA.
+func (s *Server) AddWorker(worker atc.Worker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.workers[worker.Name] = worker
+}
+
+// WorkerNames returns the names of all registered workers, sorted.
+func (s *Server) WorkerNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.workers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PipelineConfig returns the config of a pipeline and whether it exists.
+func (s *Server) PipelineConfig(teamName, pipelineName string) (atc.Config, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.teams[teamName]
+	if !ok {
+		return atc.Config{}, false
+	}
+	p, ok := t.Pipelines[pipelineName]
+	if !ok {
+		return atc.Config{}, false
+	}
+	return p.Config, true
+}
+
+// SetPipeline creates or replaces a pipeline as if it was set by another
+// client.
+func (s *Server) SetPipeline(teamName, pipelineName string, config atc.Config, paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.teams[teamName]
+	if !ok {
+		t = s.addTeam(atc.Team{Name: teamName})
+	}
+	s.nextID++
+	t.Pipelines[pipelineName] = &pipeline{
+		Pipeline: atc.Pipeline{ID: s.nextID, Name: pipelineName, Paused: paused, TeamName: teamName},
+		Config:   config,
+		Version:  1,
+	}
+}
+
+// AddBuild adds a build of a job, with the events its event stream serves, and
+// returns its ID. Running builds are the next build of their job, the others
+// the finished build.
+func (s *Server) AddBuild(b atc.Build, events ...atc.Event) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	b.ID = s.nextID
+	if b.Name == "" {
+		b.Name = strconv.Itoa(b.ID)
+	}
+	s.builds[b.ID] = &build{Build: b, Events: events}
+	return b.ID
+}
+
+func (s *Server) addTeam(t atc.Team) *team {
+	s.nextID++
+	t.ID = s.nextID
+	added := &team{Team: t, Pipelines: make(map[string]*pipeline)}
+	s.teams[t.Name] = added
+	return added
+}
+
+func (s *Server) wrap(route string, handle func(s *Server, w http.ResponseWriter, r *http.Request)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, route)
+		var latency time.Duration
+		status := 0
+		var remaining []*Fault
+		for _, fault := range s.faults {
+			if fault.Route != "" && fault.Route != route {
+				remaining = append(remaining, fault)
+				continue
+			}
+			latency += fault.Latency
+			if status == 0 {
+				status = fault.Status
+			}
+			if fault.Times > 0 {
+				fault.Times--
+				if fault.Times == 0 {
+					continue
+				}
+			}
+			remaining = append(remaining, fault)
+		}
+		s.faults = remaining
+		s.mu.Unlock()
+
+		if latency > 0 {
+			select {
+			case <-time.After(latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		handle(s, w, r)
+	})
+}
+
+func (s *Server) authorized(r *http.Request, teamName string) bool {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(strings.ToLower(authorization), "bearer ") {
+		return false
+	}
+	token := authorization[len("bearer "):]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	owner, ok := s.tokens[token]
+	return ok && (owner == atc.DefaultTeamName || owner == teamName)
+}
+
+func respond(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (s *Server) getInfo(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, atc.Info{Version: Version, WorkerVersion: "1.2"})
+}
+
+func (s *Server) getAuthToken(w http.ResponseWriter, r *http.Request) {
+	teamName := rata.Param(r, "team_name")
+	username, password, ok := r.BasicAuth()
+	if !ok || teamName != atc.DefaultTeamName || username != s.username || password != s.password {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	s.nextID++
+	token := fmt.Sprintf("fake-token-%s-%d", teamName, s.nextID)
+	s.tokens[token] = teamName
+	s.mu.Unlock()
+	respond(w, http.StatusOK, atc.AuthToken{Type: "Bearer", Value: token})
+}
+
+func (s *Server) listAuthMethods(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.teams[rata.Param(r, "team_name")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	methods := []atc.AuthMethod{}
+	if t.BasicAuth != nil {
+		methods = append(methods, atc.AuthMethod{Type: atc.AuthTypeBasic, DisplayName: "Basic Auth"})
+	}
+	var providers []string
+	for provider := range t.Auth {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	for _, provider := range providers {
+		methods = append(methods, atc.AuthMethod{Type: atc.AuthTypeOAuth, DisplayName: provider})
+	}
+	respond(w, http.StatusOK, methods)
+}
+
+func (s *Server) listTeams(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r, atc.DefaultTeamName) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	teams := []atc.Team{}
+	for _, t := range s.teams {
+		teams = append(teams, atc.Team{ID: t.ID, Name: t.Name})
+	}
+	sort.Slice(teams, func(i, j int) bool { return teams[i].ID < teams[j].ID })
+	respond(w, http.StatusOK, teams)
+}
+
+func (s *Server) setTeam(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r, atc.DefaultTeamName) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var requested atc.Team
+	err := json.NewDecoder(r.Body).Decode(&requested)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if requested.BasicAuth == nil && len(requested.Auth) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := rata.Param(r, "team_name")
+	requested.Name = name
+	if t, ok := s.teams[name]; ok {
+		requested.ID = t.ID
+		t.Team = requested
+		respond(w, http.StatusOK, atc.Team{ID: t.ID, Name: name})
+		return
+	}
+	t := s.addTeam(requested)
+	respond(w, http.StatusCreated, atc.Team{ID: t.ID, Name: name})
+}
+
+func (s *Server) destroyTeam(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r, atc.DefaultTeamName) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := rata.Param(r, "team_name")
+	if name == atc.DefaultTeamName {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if _, ok := s.teams[name]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	delete(s.teams, name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listWorkers(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r, atc.DefaultTeamName) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	workers := []atc.Worker{}
+	for _, worker := range s.workers {
+		workers = append(workers, worker)
+	}
+	sort.Slice(workers, func(i, j int) bool { return workers[i].Name < workers[j].Name })
+	respond(w, http.StatusOK, workers)
+}
+
+// pruneWorker only prunes stalled workers, like Concourse does.
+func (s *Server) pruneWorker(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r, atc.DefaultTeamName) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := rata.Param(r, "worker_name")
+	worker, ok := s.workers[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if worker.State != "stalled" {
+		respond(w, http.StatusBadRequest, atc.PruneWorkerResponseBody{Stderr: "cannot prune running worker"})
+		return
+	}
+	delete(s.workers, name)
+	w.WriteHeader(http.StatusOK)
+}
+
+// lookupPipeline returns the team and pipeline of the request, writing the
+// error response if either of them can't be found. The caller must hold s.mu.
+func (s *Server) lookupPipeline(w http.ResponseWriter, r *http.Request) (*team, *pipeline, bool) {
+	t, ok := s.teams[rata.Param(r, "team_name")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return nil, nil, false
+	}
+	p, ok := t.Pipelines[rata.Param(r, "pipeline_name")]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return t, nil, false
+	}
+	return t, p, true
+}
+
+func (s *Server) listPipelines(w http.ResponseWriter, r *http.Request) {
+	teamName := rata.Param(r, "team_name")
+	if !s.authorized(r, teamName) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.teams[teamName]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	pipelines := []atc.Pipeline{}
+	for _, p := range t.Pipelines {
+		pipelines = append(pipelines, p.Pipeline)
+	}
+	sort.Slice(pipelines, func(i, j int) bool { return pipelines[i].ID < pipelines[j].ID })
+	respond(w, http.StatusOK, pipelines)
+}
+
+func (s *Server) listAllPipelines(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r, atc.DefaultTeamName) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pipelines := []atc.Pipeline{}
+	for _, t := range s.teams {
+		for _, p := range t.Pipelines {
+			pipelines = append(pipelines, p.Pipeline)
+		}
+	}
+	sort.Slice(pipelines, func(i, j int) bool { return pipelines[i].ID < pipelines[j].ID })
+	respond(w, http.StatusOK, pipelines)
+}
+
+func (s *Server) getPipeline(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r, rata.Param(r, "team_name")) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, p, ok := s.lookupPipeline(w, r)
+	if !ok {
+		return
+	}
+	respond(w, http.StatusOK, p.Pipeline)
+}
+
+func (s *Server) deletePipeline(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r, rata.Param(r, "team_name")) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, p, ok := s.lookupPipeline(w, r)
+	if !ok {
+		return
+	}
+	delete(t.Pipelines, p.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) pausePipeline(w http.ResponseWriter, r *http.Request) {
+	s.setPaused(w, r, true)
+}
+
+func (s *Server) unpausePipeline(w http.ResponseWriter, r *http.Request) {
+	s.setPaused(w, r, false)
+}
+
+func (s *Server) setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	if !s.authorized(r, rata.Param(r, "team_name")) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, p, ok := s.lookupPipeline(w, r)
+	if !ok {
+		return
+	}
+	p.Paused = paused
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) getConfig(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r, rata.Param(r, "team_name")) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, p, ok := s.lookupPipeline(w, r)
+	if !ok {
+		return
+	}
+	raw, _ := yaml.Marshal(p.Config)
+	config := p.Config
+	w.Header().Set(atc.ConfigVersionHeader, versionString(p.Version))
+	respond(w, http.StatusOK, atc.ConfigResponse{Config: &config, RawConfig: atc.RawConfig(raw)})
+}
+
+func (s *Server) saveConfig(w http.ResponseWriter, r *http.Request) {
+	teamName := rata.Param(r, "team_name")
+	if !s.authorized(r, teamName) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var config atc.Config
+	err = yaml.Unmarshal(body, &config)
+	if err != nil {
+		respond(w, http.StatusBadRequest, map[string][]string{"errors": {err.Error()}})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.teams[teamName]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	name := rata.Param(r, "pipeline_name")
+	version := r.Header.Get(atc.ConfigVersionHeader)
+	if p, ok := t.Pipelines[name]; ok {
+		if version != versionString(p.Version) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		p.Config = config
+		p.Version++
+		respond(w, http.StatusOK, map[string]interface{}{"warnings": []interface{}{}})
+		return
+	}
+	s.nextID++
+	t.Pipelines[name] = &pipeline{
+		Pipeline: atc.Pipeline{ID: s.nextID, Name: name, Paused: true, TeamName: teamName},
+		Config:   config,
+		Version:  1,
+	}
+	respond(w, http.StatusCreated, map[string]interface{}{"warnings": []interface{}{}})
+}
+
+func versionString(version int) string {
+	return strconv.Itoa(version)
+}
+
+func (s *Server) listJobs(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r, rata.Param(r, "team_name")) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, p, ok := s.lookupPipeline(w, r)
+	if !ok {
+		return
+	}
+	jobs := []atc.Job{}
+	for _, config := range p.Config.Jobs {
+		job := atc.Job{ID: len(jobs) + 1, Name: config.Name}
+		for _, b := range s.builds {
+			if b.TeamName != t.Name || b.PipelineName != p.Name || b.JobName != config.Name {
+				continue
+			}
+			latest := &job.FinishedBuild
+			if b.IsRunning() {
+				latest = &job.NextBuild
+			}
+			if *latest == nil || (*latest).ID < b.ID {
+				copied := b.Build
+				*latest = &copied
+			}
+		}
+		jobs = append(jobs, job)
+	}
+	respond(w, http.StatusOK, jobs)
+}
+
+// listJobBuilds serves the builds of a job newest first, paged like the ATC:
+// until asks for the builds right after a build, since for those before it.
+func (s *Server) listJobBuilds(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r, rata.Param(r, "team_name")) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, p, ok := s.lookupPipeline(w, r)
+	if !ok {
+		return
+	}
+	until, _ := strconv.Atoi(r.URL.Query().Get("until"))
+	since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	builds := []atc.Build{}
+	for _, b := range s.builds {
+		if b.TeamName != t.Name || b.PipelineName != p.Name || b.JobName != rata.Param(r, "job_name") {
+			continue
+		}
+		if (until > 0 && b.ID <= until) || (until == 0 && since > 0 && b.ID >= since) {
+			continue
+		}
+		builds = append(builds, b.Build)
+	}
+	sort.Slice(builds, func(i, j int) bool { return builds[i].ID > builds[j].ID })
+	if limit > 0 && len(builds) > limit {
+		if until > 0 {
+			builds = builds[len(builds)-limit:]
+		} else {
+			builds = builds[:limit]
+		}
+	}
+	respond(w, http.StatusOK, builds)
+}
+
+func (s *Server) buildEvents(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(rata.Param(r, "build_id"))
+	s.mu.Lock()
+	b, ok := s.builds[id]
+	s.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !s.authorized(r, b.TeamName) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	for i, e := range b.Events {
+		data, err := json.Marshal(event.Message{Event: e})
+		if err != nil {
+			panic(err)
+		}
+		sse.Event{ID: strconv.Itoa(i), Name: "event", Data: data}.Write(w)
+	}
+	sse.Event{Name: "end"}.Write(w)
+}
@@ -0,0 +1,64 @@
+package fakeatc
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/concourse/atc"
+	"github.com/concourse/go-concourse/concourse"
+)
+
+func TestGetInfo(t *testing.T) {
+	server := New("admin", "password")
+	defer server.Close()
+
+	info, err := concourse.NewClient(server.URL, http.DefaultClient).GetInfo()
+	if err != nil {
+		t.Fatal("GetInfo returned error: " + err.Error())
+	}
+	if info.Version != Version {
+		t.Error("Expected version " + Version + " but got: " + info.Version)
+	}
+}
+
+func TestFaultTimes(t *testing.T) {
+	server := New("admin", "password")
+	defer server.Close()
+	server.Inject(Fault{Route: atc.GetInfo, Status: http.StatusInternalServerError, Times: 1})
+	client := concourse.NewClient(server.URL, http.DefaultClient)
+
+	_, err := client.GetInfo()
+	if err == nil {
+		t.Error("No error was returned for an injected fault")
+	}
+	_, err = client.GetInfo()
+	if err != nil {
+		t.Error("Fault was applied more often than requested: " + err.Error())
+	}
+}
+
+func TestFaultLatency(t *testing.T) {
+	server := New("admin", "password")
+	defer server.Close()
+	server.Inject(Fault{Latency: 50 * time.Millisecond})
+
+	start := time.Now()
+	_, err := concourse.NewClient(server.URL, http.DefaultClient).GetInfo()
+	if err != nil {
+		t.Fatal("GetInfo returned error: " + err.Error())
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("Latency was not injected")
+	}
+}
+
+func TestUnauthorizedWithoutToken(t *testing.T) {
+	server := New("admin", "password")
+	defer server.Close()
+
+	_, err := concourse.NewClient(server.URL, http.DefaultClient).ListTeams()
+	if err != concourse.ErrUnauthorized {
+		t.Errorf("Expected ErrUnauthorized but got: %v", err)
+	}
+}
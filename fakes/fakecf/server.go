@@ -0,0 +1,598 @@
+// Package fakecf provides an in-memory Cloud Controller and UAA, served over
+// httptest, implementing the v2 and v3 endpoints the broker resolves orgs,
+// spaces and service instances with.
+package fakecf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Org struct {
+	GUID string
+	Name string
+}
+
+type Space struct {
+	GUID    string
+	Name    string
+	OrgGUID string
+}
+
+type ServicePlan struct {
+	GUID      string
+	CatalogID string
+}
+
+type ServiceInstance struct {
+	GUID            string
+	Name            string
+	SpaceGUID       string
+	ServicePlanGUID string
+}
+
+// Server is a fake Cloud Controller that also acts as its own UAA. Its state
+// is kept in memory and is safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	clientID     string
+	clientSecret string
+
+	mu            sync.Mutex
+	v2Only        bool
+	pageSize      int
+	tokenLifetime int
+	orgs          map[string]Org
+	spaces        map[string]Space
+	plans         map[string]ServicePlan
+	instances     map[string]ServiceInstance
+	tokens        map[string]bool
+	failures      map[string]int
+	requests      []string
+}
+
+// New starts a fake Cloud Controller that issues tokens to the given UAA
+// client.
+func New(clientID, clientSecret string) *Server {
+	s := &Server{
+		clientID:      clientID,
+		clientSecret:  clientSecret,
+		pageSize:      50,
+		tokenLifetime: 3600,
+		orgs:          make(map[string]Org),
+		spaces:        make(map[string]Space),
+		plans:         make(map[string]ServicePlan),
+		instances:     make(map[string]ServiceInstance),
+		tokens:        make(map[string]bool),
+		failures:      make(map[string]int),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/info", s.info)
+	mux.HandleFunc("/oauth/token", s.token)
+	mux.HandleFunc("/v2/", s.authenticated(s.v2))
+	mux.HandleFunc("/v3", s.v3Root)
+	mux.HandleFunc("/v3/", s.authenticated(s.v3))
+	s.Server = httptest.NewServer(s.recordRequests(mux))
+	return s
+}
+
+// AddOrg, AddSpace, AddServicePlan and AddServiceInstance configure fixtures.
+func (s *Server) AddOrg(org Org) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orgs[org.GUID] = org
+}
+
+func (s *Server) AddSpace(space Space) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spaces[space.GUID] = space
+}
+
+func (s *Server) AddServicePlan(plan ServicePlan) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.plans[plan.GUID] = plan
+}
+
+func (s *Server) AddServiceInstance(instance ServiceInstance) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.instances[instance.GUID] = instance
+}
+
+func (s *Server) RemoveServiceInstance(guid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.instances, guid)
+}
+
+// DisableV3 makes the server behave like a foundation that predates the v3
+// API.
+func (s *Server) DisableV3() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.v2Only = true
+}
+
+// SetPageSize sets the number of resources per page of list endpoints.
+func (s *Server) SetPageSize(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pageSize = size
+}
+
+// RotateClientSecret makes UAA only accept secret for the client from now on.
+// Tokens issued before stay valid until they expire.
+func (s *Server) RotateClientSecret(secret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientSecret = secret
+}
+
+// SetTokenLifetime sets the expires_in of the tokens issued from now on.
+// Clients refresh tokens some seconds early, so a lifetime of 1 makes them
+// fetch a token for every request.
+func (s *Server) SetTokenLifetime(seconds int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenLifetime = seconds
+}
+
+// Fail makes requests whose path starts with prefix fail with status.
+func (s *Server) Fail(prefix string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[prefix] = status
+}
+
+// ClearFailures removes all failures configured with Fail.
+func (s *Server) ClearFailures() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = make(map[string]int)
+}
+
+// Requests returns the paths requested so far.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+func (s *Server) recordRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.URL.Path)
+		status := 0
+		for prefix, failure := range s.failures {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				status = failure
+			}
+		}
+		s.mu.Unlock()
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fields := strings.Fields(r.Header.Get("Authorization"))
+		s.mu.Lock()
+		ok := len(fields) == 2 && strings.EqualFold(fields[0], "bearer") && s.tokens[fields[1]]
+		s.mu.Unlock()
+		if !ok {
+			respond(w, http.StatusUnauthorized, v2Error{Code: 1000, Description: "Invalid Auth Token", ErrorCode: "CF-InvalidAuthToken"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func respond(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (s *Server) info(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, map[string]string{
+		"api_version":            "2.100.0",
+		"authorization_endpoint": s.URL,
+		"token_endpoint":         s.URL,
+	})
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	s.mu.Lock()
+	valid := r.FormValue("grant_type") == "client_credentials" && clientID == s.clientID && clientSecret == s.clientSecret
+	lifetime := s.tokenLifetime
+	s.mu.Unlock()
+	if !valid {
+		respond(w, http.StatusUnauthorized, map[string]string{
+			"error":             "unauthorized",
+			"error_description": "Bad credentials",
+		})
+		return
+	}
+	s.mu.Lock()
+	token := fmt.Sprintf("fake-token-%d", len(s.tokens)+1)
+	s.tokens[token] = true
+	s.mu.Unlock()
+	respond(w, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "bearer",
+		"expires_in":   lifetime,
+	})
+}
+
+type v2Error struct {
+	Code        int    `json:"code"`
+	Description string `json:"description"`
+	ErrorCode   string `json:"error_code"`
+}
+
+type v2Metadata struct {
+	GUID string `json:"guid"`
+	URL  string `json:"url"`
+}
+
+type v2Resource struct {
+	Metadata v2Metadata             `json:"metadata"`
+	Entity   map[string]interface{} `json:"entity"`
+}
+
+func (s *Server) v2(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/"), "/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case len(parts) == 2 && parts[0] == "spaces":
+		space, ok := s.spaces[parts[1]]
+		if !ok {
+			respond(w, http.StatusNotFound, v2Error{Code: 40004, Description: "The app space could not be found: " + parts[1], ErrorCode: "CF-SpaceNotFound"})
+			return
+		}
+		resource := s.v2Space(space)
+		if r.URL.Query().Get("inline-relations-depth") != "" {
+			if org, ok := s.orgs[space.OrgGUID]; ok {
+				resource.Entity["organization"] = s.v2Org(org)
+			}
+		}
+		respond(w, http.StatusOK, resource)
+	case len(parts) == 2 && parts[0] == "organizations":
+		org, ok := s.orgs[parts[1]]
+		if !ok {
+			respond(w, http.StatusNotFound, v2Error{Code: 30003, Description: "The organization could not be found: " + parts[1], ErrorCode: "CF-OrganizationNotFound"})
+			return
+		}
+		respond(w, http.StatusOK, s.v2Org(org))
+	case len(parts) == 2 && parts[0] == "service_instances":
+		instance, ok := s.instances[parts[1]]
+		if !ok {
+			respond(w, http.StatusNotFound, v2Error{Code: 60004, Description: "The service instance could not be found: " + parts[1], ErrorCode: "CF-ServiceInstanceNotFound"})
+			return
+		}
+		respond(w, http.StatusOK, s.v2ServiceInstance(instance))
+	case len(parts) == 1 && parts[0] == "service_plans":
+		uniqueIDs := v2Filter(r.URL.Query().Get("q"), "unique_id")
+		var resources []v2Resource
+		for _, plan := range s.sortedPlans() {
+			if uniqueIDs == nil || uniqueIDs[plan.CatalogID] {
+				resources = append(resources, v2Resource{
+					Metadata: v2Metadata{GUID: plan.GUID, URL: "/v2/service_plans/" + plan.GUID},
+					Entity:   map[string]interface{}{"unique_id": plan.CatalogID},
+				})
+			}
+		}
+		s.respondV2Page(w, r, resources)
+	case len(parts) == 1 && parts[0] == "service_instances":
+		planGUIDs := v2Filter(r.URL.Query().Get("q"), "service_plan_guid")
+		var resources []v2Resource
+		for _, instance := range s.sortedInstances() {
+			if planGUIDs == nil || planGUIDs[instance.ServicePlanGUID] {
+				resources = append(resources, s.v2ServiceInstance(instance))
+			}
+		}
+		s.respondV2Page(w, r, resources)
+	default:
+		respond(w, http.StatusNotFound, v2Error{Code: 10000, Description: "Unknown request", ErrorCode: "CF-NotFound"})
+	}
+}
+
+func (s *Server) v2Space(space Space) v2Resource {
+	return v2Resource{
+		Metadata: v2Metadata{GUID: space.GUID, URL: "/v2/spaces/" + space.GUID},
+		Entity: map[string]interface{}{
+			"name":              space.Name,
+			"organization_guid": space.OrgGUID,
+			"organization_url":  "/v2/organizations/" + space.OrgGUID,
+		},
+	}
+}
+
+func (s *Server) v2Org(org Org) v2Resource {
+	return v2Resource{
+		Metadata: v2Metadata{GUID: org.GUID, URL: "/v2/organizations/" + org.GUID},
+		Entity:   map[string]interface{}{"name": org.Name},
+	}
+}
+
+func (s *Server) v2ServiceInstance(instance ServiceInstance) v2Resource {
+	return v2Resource{
+		Metadata: v2Metadata{GUID: instance.GUID, URL: "/v2/service_instances/" + instance.GUID},
+		Entity: map[string]interface{}{
+			"name":              instance.Name,
+			"space_guid":        instance.SpaceGUID,
+			"space_url":         "/v2/spaces/" + instance.SpaceGUID,
+			"service_plan_guid": instance.ServicePlanGUID,
+		},
+	}
+}
+
+// v2Filter parses a "field IN a,b" or "field:a" query filter.
+func v2Filter(q, field string) map[string]bool {
+	var values string
+	switch {
+	case strings.HasPrefix(q, field+" IN "):
+		values = strings.TrimPrefix(q, field+" IN ")
+	case strings.HasPrefix(q, field+":"):
+		values = strings.TrimPrefix(q, field+":")
+	default:
+		return nil
+	}
+	filter := make(map[string]bool)
+	for _, value := range strings.Split(values, ",") {
+		filter[value] = true
+	}
+	return filter
+}
+
+func (s *Server) respondV2Page(w http.ResponseWriter, r *http.Request, resources []v2Resource) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	start, end, pages := s.pageBounds(page, len(resources))
+	nextURL := ""
+	if page < pages {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(page+1))
+		nextURL = r.URL.Path + "?" + query.Encode()
+	}
+	respond(w, http.StatusOK, map[string]interface{}{
+		"total_results": len(resources),
+		"total_pages":   pages,
+		"next_url":      nextURL,
+		"resources":     append([]v2Resource{}, resources[start:end]...),
+	})
+}
+
+func (s *Server) v3Root(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	v2Only := s.v2Only
+	s.mu.Unlock()
+	if v2Only {
+		respond(w, http.StatusNotFound, v2Error{Code: 10000, Description: "Unknown request", ErrorCode: "CF-NotFound"})
+		return
+	}
+	respond(w, http.StatusOK, map[string]interface{}{"links": map[string]interface{}{}})
+}
+
+type v3Error struct {
+	Code   int    `json:"code"`
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+}
+
+func respondV3Error(w http.ResponseWriter, status int, err v3Error) {
+	respond(w, status, map[string][]v3Error{"errors": {err}})
+}
+
+func v3NotFound(resource string) v3Error {
+	return v3Error{Code: 10010, Title: "CF-ResourceNotFound", Detail: resource + " not found"}
+}
+
+func (s *Server) v3(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v3/"), "/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.v2Only {
+		respond(w, http.StatusNotFound, v2Error{Code: 10000, Description: "Unknown request", ErrorCode: "CF-NotFound"})
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && parts[0] == "spaces":
+		space, ok := s.spaces[parts[1]]
+		if !ok {
+			respondV3Error(w, http.StatusNotFound, v3NotFound("Space"))
+			return
+		}
+		resource := s.v3Space(space)
+		if r.URL.Query().Get("include") == "organization" {
+			var orgs []interface{}
+			if org, ok := s.orgs[space.OrgGUID]; ok {
+				orgs = append(orgs, v3Org(org))
+			}
+			resource["included"] = map[string]interface{}{"organizations": orgs}
+		}
+		respond(w, http.StatusOK, resource)
+	case len(parts) == 2 && parts[0] == "organizations":
+		org, ok := s.orgs[parts[1]]
+		if !ok {
+			respondV3Error(w, http.StatusNotFound, v3NotFound("Organization"))
+			return
+		}
+		respond(w, http.StatusOK, v3Org(org))
+	case len(parts) == 2 && parts[0] == "service_instances":
+		instance, ok := s.instances[parts[1]]
+		if !ok {
+			respondV3Error(w, http.StatusNotFound, v3NotFound("Service instance"))
+			return
+		}
+		respond(w, http.StatusOK, v3ServiceInstance(instance))
+	case len(parts) == 1 && parts[0] == "service_plans":
+		catalogIDs := v3Filter(r.URL.Query(), "broker_catalog_ids")
+		var resources []interface{}
+		for _, plan := range s.sortedPlans() {
+			if catalogIDs == nil || catalogIDs[plan.CatalogID] {
+				resources = append(resources, map[string]interface{}{
+					"guid":           plan.GUID,
+					"broker_catalog": map[string]string{"id": plan.CatalogID},
+				})
+			}
+		}
+		s.respondV3Page(w, r, resources, nil)
+	case len(parts) == 1 && parts[0] == "service_instances":
+		planGUIDs := v3Filter(r.URL.Query(), "service_plan_guids")
+		var resources []interface{}
+		var instances []ServiceInstance
+		for _, instance := range s.sortedInstances() {
+			if planGUIDs == nil || planGUIDs[instance.ServicePlanGUID] {
+				resources = append(resources, v3ServiceInstance(instance))
+				instances = append(instances, instance)
+			}
+		}
+		include := r.URL.Query().Get("fields[space]") != ""
+		s.respondV3Page(w, r, resources, func(start, end int) map[string]interface{} {
+			if !include {
+				return nil
+			}
+			spaces := []interface{}{}
+			orgs := []interface{}{}
+			seen := make(map[string]bool)
+			for _, instance := range instances[start:end] {
+				space, ok := s.spaces[instance.SpaceGUID]
+				if !ok || seen[space.GUID] {
+					continue
+				}
+				seen[space.GUID] = true
+				spaces = append(spaces, s.v3Space(space))
+				if org, ok := s.orgs[space.OrgGUID]; ok && !seen[org.GUID] {
+					seen[org.GUID] = true
+					orgs = append(orgs, v3Org(org))
+				}
+			}
+			return map[string]interface{}{"spaces": spaces, "organizations": orgs}
+		})
+	default:
+		respondV3Error(w, http.StatusNotFound, v3Error{Code: 10000, Title: "CF-NotFound", Detail: "Unknown request"})
+	}
+}
+
+func (s *Server) v3Space(space Space) map[string]interface{} {
+	return map[string]interface{}{
+		"guid": space.GUID,
+		"name": space.Name,
+		"relationships": map[string]interface{}{
+			"organization": map[string]interface{}{"data": map[string]string{"guid": space.OrgGUID}},
+		},
+	}
+}
+
+func v3Org(org Org) map[string]interface{} {
+	return map[string]interface{}{"guid": org.GUID, "name": org.Name}
+}
+
+func v3ServiceInstance(instance ServiceInstance) map[string]interface{} {
+	return map[string]interface{}{
+		"guid": instance.GUID,
+		"name": instance.Name,
+		"type": "managed",
+		"relationships": map[string]interface{}{
+			"space":        map[string]interface{}{"data": map[string]string{"guid": instance.SpaceGUID}},
+			"service_plan": map[string]interface{}{"data": map[string]string{"guid": instance.ServicePlanGUID}},
+		},
+	}
+}
+
+func v3Filter(query url.Values, name string) map[string]bool {
+	if _, ok := query[name]; !ok {
+		return nil
+	}
+	filter := make(map[string]bool)
+	for _, value := range strings.Split(query.Get(name), ",") {
+		filter[value] = true
+	}
+	return filter
+}
+
+func (s *Server) respondV3Page(w http.ResponseWriter, r *http.Request, resources []interface{}, included func(start, end int) map[string]interface{}) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	start, end, pages := s.pageBounds(page, len(resources))
+	var next interface{}
+	if page < pages {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(page+1))
+		next = map[string]string{"href": s.URL + r.URL.Path + "?" + query.Encode()}
+	}
+	body := map[string]interface{}{
+		"pagination": map[string]interface{}{
+			"total_results": len(resources),
+			"total_pages":   pages,
+			"next":          next,
+		},
+		"resources": append([]interface{}{}, resources[start:end]...),
+	}
+	if included != nil {
+		if inc := included(start, end); inc != nil {
+			body["included"] = inc
+		}
+	}
+	respond(w, http.StatusOK, body)
+}
+
+func (s *Server) pageBounds(page, total int) (int, int, int) {
+	pages := (total + s.pageSize - 1) / s.pageSize
+	if pages == 0 {
+		pages = 1
+	}
+	start := (page - 1) * s.pageSize
+	if start > total {
+		start = total
+	}
+	end := start + s.pageSize
+	if end > total {
+		end = total
+	}
+	return start, end, pages
+}
+
+func (s *Server) sortedPlans() []ServicePlan {
+	var plans []ServicePlan
+	for _, plan := range s.plans {
+		plans = append(plans, plan)
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].GUID < plans[j].GUID })
+	return plans
+}
+
+func (s *Server) sortedInstances() []ServiceInstance {
+	var instances []ServiceInstance
+	for _, instance := range s.instances {
+		instances = append(instances, instance)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].GUID < instances[j].GUID })
+	return instances
+}
@@ -0,0 +1,218 @@
+// Package fakecredhub provides an in-memory CredHub, served over httptest,
+// implementing the token, credential and permission endpoints the broker uses.
+package fakecredhub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Server is a fake CredHub that issues its own UAA tokens. Its state is kept
+// in memory and is safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	clientID     string
+	clientSecret string
+
+	mu          sync.Mutex
+	credentials map[string]credential
+	permissions map[string]Permission
+	nextUUID    int
+}
+
+type credential struct {
+	Type  string
+	Value interface{}
+}
+
+// Permission grants an actor operations on a path.
+type Permission struct {
+	UUID       string   `json:"uuid"`
+	Path       string   `json:"path"`
+	Actor      string   `json:"actor"`
+	Operations []string `json:"operations"`
+}
+
+const token = "fake-credhub-token"
+
+// New starts a fake CredHub that accepts tokens issued to the given client,
+// from the /oauth/token endpoint of the same server.
+func New(clientID, clientSecret string) *Server {
+	s := &Server{
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		credentials:  make(map[string]credential),
+		permissions:  make(map[string]Permission),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Credential returns the value of the credential of that name and whether it
+// exists.
+func (s *Server) Credential(name string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.credentials[name]
+	return c.Value, ok
+}
+
+// Permission returns the permission of the actor on path and whether it
+// exists.
+func (s *Server) Permission(path, actor string) (Permission, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, permission := range s.permissions {
+		if permission.Path == path && permission.Actor == actor {
+			return permission, true
+		}
+	}
+	return Permission{}, false
+}
+
+func respondError(w http.ResponseWriter, status int, message string) {
+	respond(w, status, map[string]string{"error": message})
+}
+
+func respond(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/oauth/token" {
+		s.handleToken(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+token {
+		respondError(w, http.StatusUnauthorized, "Full authentication is required to access this resource")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case r.URL.Path == "/api/v1/data":
+		s.handleData(w, r)
+	case strings.HasPrefix(r.URL.Path, "/api/v2/permissions"):
+		s.handlePermissions(w, r, strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v2/permissions"), "/"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		r.ParseForm()
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != s.clientID || clientSecret != s.clientSecret {
+		respond(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized", "error_description": "Bad credentials"})
+		return
+	}
+	respond(w, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "bearer",
+		"expires_in":   3600,
+	})
+}
+
+func (s *Server) handleData(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch r.Method {
+	case "GET":
+		if name := query.Get("name"); name != "" {
+			c, ok := s.credentials[name]
+			if !ok {
+				respondError(w, http.StatusNotFound, "The request could not be completed because the credential does not exist or you do not have sufficient authorization.")
+				return
+			}
+			respond(w, http.StatusOK, map[string]interface{}{
+				"data": []map[string]interface{}{{"name": name, "type": c.Type, "value": c.Value}},
+			})
+			return
+		}
+		path := strings.TrimSuffix(query.Get("path"), "/") + "/"
+		found := []map[string]string{}
+		for name := range s.credentials {
+			if strings.HasPrefix(name, path) {
+				found = append(found, map[string]string{"name": name})
+			}
+		}
+		respond(w, http.StatusOK, map[string]interface{}{"credentials": found})
+	case "PUT":
+		var body struct {
+			Name  string      `json:"name"`
+			Type  string      `json:"type"`
+			Value interface{} `json:"value"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Name == "" || body.Type == "" || body.Value == nil {
+			respondError(w, http.StatusBadRequest, "A name, type and value are required.")
+			return
+		}
+		if _, isJSON := body.Value.(map[string]interface{}); (body.Type == "json") != isJSON {
+			respondError(w, http.StatusBadRequest, "The value does not match the credential type.")
+			return
+		}
+		s.credentials[body.Name] = credential{Type: body.Type, Value: body.Value}
+		respond(w, http.StatusOK, map[string]interface{}{"name": body.Name, "type": body.Type, "value": body.Value})
+	case "DELETE":
+		name := query.Get("name")
+		if _, ok := s.credentials[name]; !ok {
+			respondError(w, http.StatusNotFound, "The request could not be completed because the credential does not exist or you do not have sufficient authorization.")
+			return
+		}
+		delete(s.credentials, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handlePermissions(w http.ResponseWriter, r *http.Request, uuid string) {
+	switch {
+	case r.Method == "GET" && uuid == "":
+		query := r.URL.Query()
+		for _, permission := range s.permissions {
+			if permission.Path == query.Get("path") && permission.Actor == query.Get("actor") {
+				respond(w, http.StatusOK, permission)
+				return
+			}
+		}
+		respondError(w, http.StatusNotFound, "The request includes a permission that does not exist.")
+	case r.Method == "POST" && uuid == "":
+		var permission Permission
+		json.NewDecoder(r.Body).Decode(&permission)
+		if permission.Path == "" || permission.Actor == "" || len(permission.Operations) == 0 {
+			respondError(w, http.StatusBadRequest, "A path, actor and operations are required.")
+			return
+		}
+		for _, existing := range s.permissions {
+			if existing.Path == permission.Path && existing.Actor == permission.Actor {
+				respondError(w, http.StatusConflict, "A permission entry for this actor and path already exists.")
+				return
+			}
+		}
+		s.nextUUID++
+		permission.UUID = fmt.Sprintf("permission-%d", s.nextUUID)
+		s.permissions[permission.UUID] = permission
+		respond(w, http.StatusCreated, permission)
+	case r.Method == "DELETE" && uuid != "":
+		permission, ok := s.permissions[uuid]
+		if !ok {
+			respondError(w, http.StatusNotFound, "The request includes a permission that does not exist.")
+			return
+		}
+		delete(s.permissions, uuid)
+		respond(w, http.StatusOK, permission)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,240 @@
+// Package fakevault provides an in-memory Vault, served over httptest,
+// implementing the mount, policy, token role and KV endpoints the broker uses.
+package fakevault
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Server is a fake Vault. Its state is kept in memory and is safe for
+// concurrent use.
+type Server struct {
+	*httptest.Server
+
+	token string
+
+	mu       sync.Mutex
+	mounts   map[string]string
+	policies map[string]string
+	roles    map[string][]string
+	secrets  map[string]map[string]interface{}
+}
+
+// New starts a fake Vault that accepts the given token.
+func New(token string) *Server {
+	s := &Server{
+		token:    token,
+		mounts:   make(map[string]string),
+		policies: make(map[string]string),
+		roles:    make(map[string][]string),
+		secrets:  make(map[string]map[string]interface{}),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Mounts returns the paths of all mounts, sorted.
+func (s *Server) Mounts() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var paths []string
+	for path := range s.mounts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Policy returns the rules of a policy and whether it exists.
+func (s *Server) Policy(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	policy, ok := s.policies[name]
+	return policy, ok
+}
+
+// TokenRole returns the policies a token role issues and whether it exists.
+func (s *Server) TokenRole(name string) ([]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	policies, ok := s.roles[name]
+	return policies, ok
+}
+
+// Mount mounts a KV backend at path, as someone other than the broker would.
+func (s *Server) Mount(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mounts[strings.Trim(path, "/")] = "kv"
+}
+
+// Secret returns the data of the secret at path and whether it exists.
+func (s *Server) Secret(path string) (map[string]interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.secrets[strings.Trim(path, "/")]
+	return data, ok
+}
+
+func respondErrors(w http.ResponseWriter, status int, errors ...string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]string{"errors": errors})
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != s.token {
+		respondErrors(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/"), "/")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case path == "sys/mounts" && r.Method == "GET":
+		s.listMounts(w)
+	case strings.HasPrefix(path, "sys/mounts/"):
+		s.handleMount(w, r, strings.TrimPrefix(path, "sys/mounts/"))
+	case strings.HasPrefix(path, "sys/policies/acl/"):
+		s.handlePolicy(w, r, strings.TrimPrefix(path, "sys/policies/acl/"))
+	case strings.HasPrefix(path, "auth/token/roles/"):
+		s.handleTokenRole(w, r, strings.TrimPrefix(path, "auth/token/roles/"))
+	default:
+		s.handleSecret(w, r, path)
+	}
+}
+
+// listMounts responds like Vault, with the mounts keyed by their path and a
+// trailing slash, both at the top level and under data.
+func (s *Server) listMounts(w http.ResponseWriter) {
+	mounts := make(map[string]interface{})
+	for path, mountType := range s.mounts {
+		mounts[path+"/"] = map[string]string{"type": mountType}
+	}
+	response := map[string]interface{}{"data": mounts}
+	for path, mount := range mounts {
+		response[path] = mount
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleTokenRole(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case "PUT", "POST":
+		var role struct {
+			AllowedPolicies []string `json:"allowed_policies"`
+		}
+		json.NewDecoder(r.Body).Decode(&role)
+		s.roles[name] = role.AllowedPolicies
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		delete(s.roles, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleMount(w http.ResponseWriter, r *http.Request, path string) {
+	switch r.Method {
+	case "POST":
+		var mount struct {
+			Type string `json:"type"`
+		}
+		json.NewDecoder(r.Body).Decode(&mount)
+		if mount.Type == "" {
+			respondErrors(w, http.StatusBadRequest, "backend type must be specified as a string")
+			return
+		}
+		for existing := range s.mounts {
+			if strings.HasPrefix(path+"/", existing+"/") || strings.HasPrefix(existing+"/", path+"/") {
+				respondErrors(w, http.StatusBadRequest, "existing mount at "+existing+"/", "path is already in use at "+path+"/")
+				return
+			}
+		}
+		s.mounts[path] = mount.Type
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		delete(s.mounts, path)
+		for secret := range s.secrets {
+			if strings.HasPrefix(secret, path+"/") {
+				delete(s.secrets, secret)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handlePolicy(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case "GET":
+		policy, ok := s.policies[name]
+		if !ok {
+			respondErrors(w, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"name": name, "policy": policy})
+	case "PUT", "POST":
+		var policy struct {
+			Policy string `json:"policy"`
+		}
+		json.NewDecoder(r.Body).Decode(&policy)
+		if policy.Policy == "" {
+			respondErrors(w, http.StatusBadRequest, "'policy' parameter not supplied or empty")
+			return
+		}
+		s.policies[name] = policy.Policy
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		delete(s.policies, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleSecret(w http.ResponseWriter, r *http.Request, path string) {
+	mounted := false
+	for mount := range s.mounts {
+		if strings.HasPrefix(path, mount+"/") {
+			mounted = true
+		}
+	}
+	if !mounted {
+		respondErrors(w, http.StatusNotFound, "no handler for route '"+path+"'")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		data, ok := s.secrets[path]
+		if !ok {
+			respondErrors(w, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	case "PUT", "POST":
+		var data map[string]interface{}
+		err := json.NewDecoder(r.Body).Decode(&data)
+		if err != nil {
+			respondErrors(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		s.secrets[path] = data
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		delete(s.secrets, path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pkg/errors"
+)
+
+const serviceInstancesPath = "/apis/servicecatalog.k8s.io/v1beta1/serviceinstances"
+
+type kubernetesResolver struct {
+	httpClient *http.Client
+	apiURL     string
+}
+
+func newKubernetesResolver(config brokerConfig) IplatformResolver {
+	httpClient := newOAuthClient("Bearer", config.KubernetesToken, newRetryTransport(upstreamKubernetes, config, defaultTransport()))
+	httpClient.Timeout = config.KubernetesTimeout
+	return &kubernetesResolver{
+		httpClient: httpClient,
+		apiURL:     strings.TrimSuffix(config.KubernetesAPIURL, "/"),
+	}
+}
+
+// GetProvisionDetails maps the namespace of the instance to a team and the
+// groups of the requesting user to the team's auth.
+func (k *kubernetesResolver) GetProvisionDetails(ctx context.Context, details brokerapi.ProvisionDetails) (platformDetails, error) {
+	pc := platformContextFrom(ctx)
+	if pc.Namespace == "" {
+		err := errors.New("No namespace found in the request context")
+		return platformDetails{}, classify(err, kindInvalidInput, err.Error())
+	}
+	var groups []string
+	for _, group := range pc.Groups {
+		if !strings.HasPrefix(group, "system:") {
+			groups = append(groups, group)
+		}
+	}
+	return platformDetails{
+		Platform:  platformKubernetes,
+		Namespace: pc.Namespace,
+		Groups:    groups,
+	}, nil
+}
+
+type serviceInstanceList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+		Spec struct {
+			ExternalID string `json:"externalID"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+// GetDeprovisionDetails looks up the namespace of the instance in the Service
+// Catalog API, as deprovision requests carry no context object.
+func (k *kubernetesResolver) GetDeprovisionDetails(ctx context.Context, instanceID string) (platformDetails, error) {
+	req, err := http.NewRequest("GET", k.apiURL+serviceInstancesPath, nil)
+	if err != nil {
+		return platformDetails{}, err
+	}
+	resp, err := k.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return platformDetails{}, classify(errors.Wrap(err, "Error requesting service instances"), kindUnavailable, "Kubernetes is unavailable")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := errors.Errorf("Error requesting service instances: %s", resp.Status)
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+			return platformDetails{}, classify(err, kindUnauthorized, "The broker is not authorized to list Kubernetes service instances")
+		case resp.StatusCode >= http.StatusInternalServerError:
+			return platformDetails{}, classify(err, kindUnavailable, "Kubernetes is unavailable")
+		}
+		return platformDetails{}, err
+	}
+	var instances serviceInstanceList
+	err = json.NewDecoder(resp.Body).Decode(&instances)
+	if err != nil {
+		return platformDetails{}, errors.Wrap(err, "Error unmarshalling service instances")
+	}
+	for _, instance := range instances.Items {
+		if instance.Spec.ExternalID == instanceID {
+			return platformDetails{
+				Platform:  platformKubernetes,
+				Namespace: instance.Metadata.Namespace,
+			}, nil
+		}
+	}
+	return platformDetails{}, errInstanceNotFound
+}
@@ -1,24 +1,58 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/pivotal-cf/brokerapi"
+	"github.com/pivotal-cf/brokerapi/auth"
+	"github.com/pkg/errors"
 )
 
+var logLevels = map[string]lager.LogLevel{
+	"DEBUG": lager.DEBUG,
+	"INFO":  lager.INFO,
+	"ERROR": lager.ERROR,
+	"FATAL": lager.FATAL,
+}
+
 func main() {
-	var logLevels = map[string]lager.LogLevel{
-		"DEBUG": lager.DEBUG,
-		"INFO":  lager.INFO,
-		"ERROR": lager.ERROR,
-		"FATAL": lager.FATAL,
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	run, ok := commands[command]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %s\n\n", command)
+		usage()
+		os.Exit(2)
 	}
+	err := run(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
 
+func newLogger(config brokerConfig, w io.Writer) lager.Logger {
+	logger := lager.NewLogger("concourse-broker")
+	logger.RegisterSink(lager.NewWriterSink(w, logLevels[config.LogLevel]))
+	return logger
+}
+
+const catalogPath = "./catalog.json"
+
+func serve(args []string) error {
 	config, err := brokerConfigLoad()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	brokerCredentials := brokerapi.BrokerCredentials{
@@ -26,16 +60,56 @@ func main() {
 		Password: config.BrokerPassword,
 	}
 
-	services, err := CatalogLoad("./catalog.json")
+	services, err := CatalogLoad(catalogPath)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	plans, err := PlanConfigsLoad(catalogPath)
+	if err != nil {
+		return err
 	}
 
-	logger := lager.NewLogger("concourse-broker")
-	logger.RegisterSink(lager.NewWriterSink(os.Stdout, logLevels[config.LogLevel]))
+	err = checkInstanceStore(config, plans)
+	if err != nil {
+		return err
+	}
+	store, err := newInstanceStore(config.InstanceStorePath, config.InstanceStoreKey)
+	if err != nil {
+		return err
+	}
+
+	logger := newLogger(config, os.Stdout)
+	if config.InstanceStorePath == "" {
+		logger.Error("instance-store-in-memory", errors.New("INSTANCE_STORE_PATH is not set, instance and binding records are lost on restart"))
+	}
+
+	serviceBroker := &broker{
+		logger:   logger,
+		store:    store,
+		notifier: newNotifier(logger),
+	}
+	serviceBroker.configure(config, services, plans)
+	handler := &swappableHandler{handler: newBrokerHandler(serviceBroker, logger, brokerCredentials)}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go newReloader(serviceBroker, handler, catalogPath).watch(hup, config.ConfigWatchInterval, nil)
+	if config.QuotaCheckInterval > 0 {
+		go serviceBroker.watchQuotas(config.QuotaCheckInterval, nil)
+	}
+	go serviceBroker.notifier.run(nil)
+	if config.DrainPollInterval > 0 {
+		go newDrainForwarder(serviceBroker, newDrainLease(config.InstanceStorePath, config.DrainPollInterval)).watch(config.DrainPollInterval, nil)
+	}
+
+	http.Handle("/", handler)
+	return http.ListenAndServe(":"+config.Port, nil)
+}
 
-	serviceBroker := &broker{services: services, logger: logger, env: config}
+func newBrokerHandler(serviceBroker brokerapi.ServiceBroker, logger lager.Logger, brokerCredentials brokerapi.BrokerCredentials) http.Handler {
 	brokerHandler := brokerapi.New(serviceBroker, logger, brokerCredentials)
-	http.Handle("/", brokerHandler)
-	http.ListenAndServe(":"+config.Port, nil)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", auth.NewWrapper(brokerCredentials.Username, brokerCredentials.Password).Wrap(metricsHandler()))
+	mux.Handle("/", responseOverrideHandler(platformContextHandler(brokerHandler)))
+	return mux
 }
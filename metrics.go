@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	metricsMu sync.Mutex
+	metrics   = make(map[string]*counter)
+)
+
+// counter is a monotonically increasing metric, served by metricsHandler in
+// the Prometheus text format.
+type counter struct {
+	name  string
+	help  string
+	value uint64
+}
+
+// newCounter registers a counter, or returns the registered one of that name.
+func newCounter(name, help string) *counter {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if c, ok := metrics[name]; ok {
+		return c
+	}
+	c := &counter{name: name, help: help}
+	metrics[name] = c
+	return c
+}
+
+func (c *counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func metricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metricsMu.Lock()
+		var names []string
+		for name := range metrics {
+			names = append(names, name)
+		}
+		metricsMu.Unlock()
+		sort.Strings(names)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, name := range names {
+			c := newCounter(name, "")
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.Value())
+		}
+	})
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	eventTeamCreated = "team.created"
+	eventTeamUpdated = "team.updated"
+	eventTeamDeleted = "team.deleted"
+
+	eventSucceeded = "succeeded"
+	eventFailed    = "failed"
+
+	// notifyQueueSize bounds the events waiting for delivery. Events that
+	// don't fit go straight to the dead-letter log rather than holding up
+	// the request that emitted them.
+	notifyQueueSize = 100
+)
+
+var (
+	notificationsSent       = newCounter("notifications_sent_total", "Team lifecycle events delivered to notification sinks.")
+	notificationsDeadLetter = newCounter("notifications_dead_letter_total", "Team lifecycle events given up on and written to the dead-letter log.")
+)
+
+// teamEvent tells the notification sinks that a team was created, updated or
+// deleted, or failed to be. Text is a readable summary, so chat webhooks
+// like Slack's and Teams' can show the event as is.
+type teamEvent struct {
+	Event      string    `json:"event"`
+	Status     string    `json:"status"`
+	Time       time.Time `json:"time"`
+	InstanceID string    `json:"instance_id"`
+	Team       string    `json:"team,omitempty"`
+	PlanID     string    `json:"plan_id,omitempty"`
+	OrgGUID    string    `json:"organization_guid,omitempty"`
+	SpaceGUID  string    `json:"space_guid,omitempty"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Text       string    `json:"text"`
+}
+
+func newTeamEvent(eventType string, record instanceRecord, err error) teamEvent {
+	event := teamEvent{
+		Event:      eventType,
+		Status:     eventSucceeded,
+		Time:       time.Now().UTC(),
+		InstanceID: record.InstanceID,
+		Team:       record.TeamName,
+		PlanID:     record.PlanID,
+		OrgGUID:    record.OrgGUID,
+		SpaceGUID:  record.SpaceGUID,
+		Namespace:  record.Namespace,
+	}
+	action := map[string]string{
+		eventTeamCreated: "created",
+		eventTeamUpdated: "updated",
+		eventTeamDeleted: "deleted",
+	}[eventType]
+	subject := fmt.Sprintf("Concourse team %s", record.TeamName)
+	if record.TeamName == "" {
+		subject = fmt.Sprintf("Concourse team of service instance %s", record.InstanceID)
+	}
+	if err != nil {
+		event.Status = eventFailed
+		event.Error = eventError(err)
+		event.Text = fmt.Sprintf("%s couldn't be %s: %s", subject, action, event.Error)
+		return event
+	}
+	event.Text = fmt.Sprintf("%s was %s", subject, action)
+	return event
+}
+
+// eventError returns what events tell about err: the description for users
+// it was classified with, never the error itself, which may name internal
+// hosts or quote upstream responses.
+func eventError(err error) string {
+	if _, description := errorKindOf(err); description != "" {
+		return description
+	}
+	switch err {
+	case brokerapi.ErrInstanceAlreadyExists, brokerapi.ErrInstanceDoesNotExist, brokerapi.ErrPlanChangeNotSupported:
+		return err.Error()
+	}
+	return "Internal error, see the logs of the broker"
+}
+
+// InotificationSink delivers team events to where they are wanted.
+type InotificationSink interface {
+	Notify(ctx context.Context, event teamEvent) error
+	// String names the sink in logs and the dead-letter log, without
+	// credentials.
+	String() string
+}
+
+// webhookSink posts events as JSON. With a secret, the body is signed with
+// HMAC-SHA256 in the X-Broker-Signature header, as sha256=<hex digest>.
+type webhookSink struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (s *webhookSink) Notify(ctx context.Context, event teamEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Broker-Event", event.Event)
+	if s.secret != "" {
+		req.Header.Set("X-Broker-Signature", "sha256="+webhookSignature(s.secret, body))
+	}
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "Error posting to webhook")
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("Webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *webhookSink) String() string {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return "webhook"
+	}
+	return "webhook " + u.Scheme + "://" + u.Host
+}
+
+// webhookSignature is the hex HMAC-SHA256 digest of body keyed by secret.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// fileSink appends events to a file, one JSON document per line.
+type fileSink struct {
+	path string
+}
+
+func (s *fileSink) Notify(ctx context.Context, event teamEvent) error {
+	return appendJSONLine(s.path, event)
+}
+
+func (s *fileSink) String() string {
+	return "file " + s.path
+}
+
+var appendMu sync.Mutex
+
+// appendJSONLine appends value to the file at path as a line of JSON.
+func appendJSONLine(path string, value interface{}) error {
+	line, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	appendMu.Lock()
+	defer appendMu.Unlock()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// deadLetter records an event that couldn't be delivered to a sink.
+type deadLetter struct {
+	Sink     string    `json:"sink"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	Event    teamEvent `json:"event"`
+}
+
+// notifier delivers team events to the configured sinks in the background,
+// so a slow or failing sink never holds up a request. Each delivery is
+// retried with a doubling delay, and given up on to the dead-letter log.
+// It outlives reloads, which only replace its sinks and settings.
+type notifier struct {
+	logger lager.Logger
+	queue  chan teamEvent
+
+	mu             sync.RWMutex
+	sinks          []InotificationSink
+	maxRetries     int
+	retryDelay     time.Duration
+	timeout        time.Duration
+	deadLetterPath string
+}
+
+func newNotifier(logger lager.Logger) *notifier {
+	return &notifier{
+		logger: logger.Session("notify"),
+		queue:  make(chan teamEvent, notifyQueueSize),
+	}
+}
+
+// configure replaces the sinks and the delivery settings.
+func (n *notifier) configure(config brokerConfig) {
+	var sinks []InotificationSink
+	if config.NotifyWebhookURL != "" {
+		sinks = append(sinks, &webhookSink{
+			url:    config.NotifyWebhookURL,
+			secret: config.NotifyWebhookSecret,
+			client: &http.Client{Timeout: config.NotifyTimeout},
+		})
+	}
+	if config.NotifyFilePath != "" {
+		sinks = append(sinks, &fileSink{path: config.NotifyFilePath})
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sinks = sinks
+	n.maxRetries = config.NotifyMaxRetries
+	n.retryDelay = config.NotifyRetryDelay
+	n.timeout = config.NotifyTimeout
+	n.deadLetterPath = config.NotifyDeadLetterPath
+}
+
+// emit queues an event for delivery. It never blocks and is a no-op on a nil
+// notifier or without sinks.
+func (n *notifier) emit(event teamEvent) {
+	if n == nil {
+		return
+	}
+	n.mu.RLock()
+	sinks := n.sinks
+	n.mu.RUnlock()
+	if len(sinks) == 0 {
+		return
+	}
+	select {
+	case n.queue <- event:
+	default:
+		for _, sink := range sinks {
+			n.deadLetter(sink, event, 0, errors.New("Notification queue is full"))
+		}
+	}
+}
+
+// run delivers queued events until stop is closed.
+func (n *notifier) run(stop <-chan struct{}) {
+	for {
+		select {
+		case event := <-n.queue:
+			n.deliver(event)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// deliver sends event to every sink, retrying each on its own.
+func (n *notifier) deliver(event teamEvent) {
+	n.mu.RLock()
+	sinks, maxRetries, delay, timeout := n.sinks, n.maxRetries, n.retryDelay, n.timeout
+	n.mu.RUnlock()
+
+	for _, sink := range sinks {
+		var err error
+		attempts := 1
+		for wait := delay; ; wait *= 2 {
+			err = n.notify(sink, event, timeout)
+			if err == nil || attempts > maxRetries {
+				break
+			}
+			n.logger.Info("retry", lager.Data{"sink": sink.String(), "event": event.Event, "instance-id": event.InstanceID, "attempt": attempts, "error": err.Error()})
+			time.Sleep(wait)
+			attempts++
+		}
+		if err != nil {
+			n.deadLetter(sink, event, attempts, err)
+			continue
+		}
+		notificationsSent.Inc()
+	}
+}
+
+func (n *notifier) notify(sink InotificationSink, event teamEvent, timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return sink.Notify(ctx, event)
+}
+
+// deadLetter logs an event given up on, and appends it to the dead-letter
+// log if there is one.
+func (n *notifier) deadLetter(sink InotificationSink, event teamEvent, attempts int, err error) {
+	notificationsDeadLetter.Inc()
+	n.logger.Error("dead-letter", err, lager.Data{"sink": sink.String(), "event": event, "attempts": attempts})
+
+	n.mu.RLock()
+	path := n.deadLetterPath
+	n.mu.RUnlock()
+	if path == "" {
+		return
+	}
+	writeErr := appendJSONLine(path, deadLetter{
+		Sink:     sink.String(),
+		Error:    err.Error(),
+		Attempts: attempts,
+		Event:    event,
+	})
+	if writeErr != nil {
+		n.logger.Error("dead-letter-write-error", writeErr, lager.Data{"path": path})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pkg/errors"
+	"github.com/vchrisr/cf-concourse-broker/fakes/fakeatc"
+)
+
+// readJSONLines decodes every line of the file at path into a new value
+// made by newValue.
+func readJSONLines(t *testing.T, path string, newValue func() interface{}) []interface{} {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var values []interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		value := newValue()
+		err = json.Unmarshal(scanner.Bytes(), value)
+		if err != nil {
+			t.Fatal("Invalid JSON line: " + err.Error())
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+func TestWebhookSinkSignsEvents(t *testing.T) {
+	received := make(chan teamEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Broker-Signature") != "sha256="+webhookSignature("webhook-secret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("X-Broker-Event") != eventTeamCreated {
+			t.Error("Unexpected event header " + r.Header.Get("X-Broker-Event"))
+		}
+		var event teamEvent
+		json.Unmarshal(body, &event)
+		received <- event
+	}))
+	defer server.Close()
+
+	sink := &webhookSink{url: server.URL, secret: "webhook-secret", client: http.DefaultClient}
+	err := sink.Notify(context.Background(), newTeamEvent(eventTeamCreated, instanceRecord{InstanceID: "instance-id", TeamName: "my-org"}, nil))
+	if err != nil {
+		t.Fatal("Notify returned error: " + err.Error())
+	}
+	event := <-received
+	if event.Team != "my-org" || event.Status != eventSucceeded || event.Text != "Concourse team my-org was created" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	sink.secret = "other-secret"
+	err = sink.Notify(context.Background(), newTeamEvent(eventTeamCreated, instanceRecord{InstanceID: "instance-id"}, nil))
+	if err == nil {
+		t.Error("Notify didn't fail on a rejected signature")
+	}
+}
+
+func TestTeamEventHidesErrors(t *testing.T) {
+	record := instanceRecord{InstanceID: "instance-id", TeamName: "my-org"}
+	err := classify(errors.New("Post https://10.0.0.5/api/v1/teams/my-org: dial tcp 10.0.0.5:443: connection refused"), kindUnavailable, "Concourse is unavailable")
+	event := newTeamEvent(eventTeamCreated, record, err)
+	if event.Error != "Concourse is unavailable" || strings.Contains(event.Text, "10.0.0.5") {
+		t.Errorf("Expected only the description of the error but got: %+v", event)
+	}
+	event = newTeamEvent(eventTeamCreated, record, errors.New("token=secret"))
+	if strings.Contains(event.Error, "secret") || strings.Contains(event.Text, "secret") {
+		t.Errorf("Expected an unclassified error to be left out but got: %+v", event)
+	}
+	event = newTeamEvent(eventTeamUpdated, record, brokerapi.ErrPlanChangeNotSupported)
+	if event.Error != brokerapi.ErrPlanChangeNotSupported.Error() {
+		t.Errorf("Expected the error of the Service Broker API but got: %+v", event)
+	}
+}
+
+func TestNotifierRetriesThenDeadLetters(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "notifier")
+	defer os.RemoveAll(dir)
+	deadLetterPath := filepath.Join(dir, "dead-letter.jsonl")
+
+	n := newNotifier(lager.NewLogger("test"))
+	n.configure(brokerConfig{
+		NotifyWebhookURL:     server.URL,
+		NotifyDeadLetterPath: deadLetterPath,
+		NotifyMaxRetries:     2,
+		NotifyRetryDelay:     time.Millisecond,
+		NotifyTimeout:        time.Second,
+	})
+	n.deliver(newTeamEvent(eventTeamDeleted, instanceRecord{InstanceID: "instance-id", TeamName: "my-org"}, nil))
+
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+	letters := readJSONLines(t, deadLetterPath, func() interface{} { return &deadLetter{} })
+	if len(letters) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(letters))
+	}
+	letter := letters[0].(*deadLetter)
+	if letter.Attempts != 3 || letter.Event.Event != eventTeamDeleted || letter.Event.Team != "my-org" {
+		t.Errorf("Unexpected dead letter %+v", letter)
+	}
+}
+
+func TestBrokerNotifiesTeamEvents(t *testing.T) {
+	server := fakeatc.New("admin", "password")
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "notifier")
+	defer os.RemoveAll(dir)
+	eventsPath := filepath.Join(dir, "events.jsonl")
+
+	n := newNotifier(lager.NewLogger("test"))
+	n.configure(brokerConfig{NotifyFilePath: eventsPath})
+	serviceBroker := newTestBroker(t, nil, testBrokerOptions{server: server, notifier: n})
+	services := serviceBroker.services
+	provisionDetails := brokerapi.ProvisionDetails{
+		ServiceID: services[0].ID,
+		PlanID:    services[0].Plans[0].ID,
+		SpaceGUID: "space-guid",
+	}
+
+	serviceBroker.Provision(context.Background(), "instance-id", provisionDetails, false)
+	serviceBroker.Provision(context.Background(), "other-instance-id", provisionDetails, false)
+	serviceBroker.Deprovision(context.Background(), "instance-id", brokerapi.DeprovisionDetails{}, false)
+	for len(n.queue) > 0 {
+		n.deliver(<-n.queue)
+	}
+
+	events := readJSONLines(t, eventsPath, func() interface{} { return &teamEvent{} })
+	expected := []struct{ event, status, instanceID string }{
+		{eventTeamCreated, eventSucceeded, "instance-id"},
+		{eventTeamCreated, eventFailed, "other-instance-id"},
+		{eventTeamDeleted, eventSucceeded, "instance-id"},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(events))
+	}
+	for i, e := range expected {
+		event := events[i].(*teamEvent)
+		if event.Event != e.event || event.Status != e.status || event.InstanceID != e.instanceID {
+			t.Errorf("Unexpected event %d: %+v", i, event)
+		}
+	}
+	if failed := events[1].(*teamEvent); failed.Error == "" || failed.SpaceGUID != "space-guid" {
+		t.Errorf("Failed event lacks details: %+v", failed)
+	}
+	if deleted := events[2].(*teamEvent); deleted.Team != "my-org" {
+		t.Error("Deleted event has team " + deleted.Team)
+	}
+}
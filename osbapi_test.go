@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/concourse/atc"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/vchrisr/cf-concourse-broker/fakes/fakeatc"
+	"github.com/vchrisr/cf-concourse-broker/fakes/fakecf"
+)
+
+const (
+	osbapiServiceID = "64aca71f-f2e9-4f3d-8e0e-9a3e1e5e3bb6"
+	osbapiPlanID    = "334744a3-f12f-4004-a94e-d7132a0d0706"
+)
+
+type osbapiCase struct {
+	name     string
+	setup    func(cf *fakecf.Server, concourse *fakeatc.Server, store IinstanceStore)
+	method   string
+	path     string
+	body     string
+	password string
+	status   int
+	// response is compared to the JSON response body when set.
+	response string
+}
+
+var provisionBody = `{
+	"service_id": "` + osbapiServiceID + `",
+	"plan_id": "` + osbapiPlanID + `",
+	"organization_guid": "org-guid",
+	"space_guid": "space-guid",
+	"context": {"platform": "cloudfoundry", "organization_guid": "org-guid", "space_guid": "space-guid"}
+}`
+
+// provisionInstance sets up the state left behind by provisioning
+// instance-guid with provisionBody.
+func provisionInstance(cf *fakecf.Server, concourse *fakeatc.Server, store IinstanceStore) {
+	concourse.AddTeam(atc.Team{Name: "my-org", BasicAuth: &atc.BasicAuth{BasicAuthUsername: "u", BasicAuthPassword: "p"}})
+	putInstanceRecord(store)
+}
+
+func putInstanceRecord(store IinstanceStore) {
+	store.Put(instanceRecord{
+		InstanceID: "instance-guid",
+		ServiceID:  osbapiServiceID,
+		PlanID:     osbapiPlanID,
+		OrgGUID:    "org-guid",
+		SpaceGUID:  "space-guid",
+		TeamName:   "my-org",
+		Details:    platformDetails{Platform: platformCloudFoundry, OrgGUID: "org-guid", OrgName: "my-org", SpaceGUID: "space-guid"},
+	})
+}
+
+var osbapiCases = []osbapiCase{
+	{
+		name:   "catalog",
+		method: "GET", path: "/v2/catalog",
+		status: http.StatusOK,
+	},
+	{
+		name:   "catalog with bad credentials",
+		method: "GET", path: "/v2/catalog",
+		password: "wrong",
+		status:   http.StatusUnauthorized,
+	},
+	{
+		name:   "provision",
+		method: "PUT", path: "/v2/service_instances/instance-guid",
+		body:     provisionBody,
+		status:   http.StatusCreated,
+		response: `{}`,
+	},
+	{
+		name:   "provision accepting incomplete responds synchronously",
+		method: "PUT", path: "/v2/service_instances/instance-guid?accepts_incomplete=true",
+		body:     provisionBody,
+		status:   http.StatusCreated,
+		response: `{}`,
+	},
+	{
+		name: "provision into an org that already has a team",
+		setup: func(cf *fakecf.Server, concourse *fakeatc.Server, store IinstanceStore) {
+			concourse.AddTeam(atc.Team{Name: "my-org", BasicAuth: &atc.BasicAuth{BasicAuthUsername: "u", BasicAuthPassword: "p"}})
+		},
+		method: "PUT", path: "/v2/service_instances/other-instance-guid",
+		body:     provisionBody,
+		status:   http.StatusConflict,
+		response: `{}`,
+	},
+	{
+		name:   "provision an existing instance with identical details",
+		setup:  provisionInstance,
+		method: "PUT", path: "/v2/service_instances/instance-guid",
+		body:     provisionBody,
+		status:   http.StatusOK,
+		response: `{}`,
+	},
+	{
+		name:   "provision an existing instance with different details",
+		setup:  provisionInstance,
+		method: "PUT", path: "/v2/service_instances/instance-guid",
+		body:     strings.Replace(provisionBody, `"space_guid": "space-guid",`, `"space_guid": "space-guid", "parameters": {"a": 1},`, 1),
+		status:   http.StatusConflict,
+		response: `{}`,
+	},
+	{
+		name:   "provision with an unknown plan",
+		method: "PUT", path: "/v2/service_instances/instance-guid",
+		body:     strings.Replace(provisionBody, osbapiPlanID, "unknown-plan", 1),
+		status:   http.StatusBadRequest,
+		response: `{"description": "Plan unknown-plan of service ` + osbapiServiceID + ` not found in catalog"}`,
+	},
+	{
+		name:   "provision into an unknown space",
+		method: "PUT", path: "/v2/service_instances/instance-guid",
+		body:     strings.Replace(provisionBody, `"space_guid": "space-guid",`, `"space_guid": "unknown-space",`, 1),
+		status:   http.StatusBadRequest,
+		response: `{"description": "Space unknown-space does not exist"}`,
+	},
+	{
+		name: "provision while Cloud Foundry is unavailable",
+		setup: func(cf *fakecf.Server, concourse *fakeatc.Server, store IinstanceStore) {
+			cf.Fail("/v3/spaces", http.StatusServiceUnavailable)
+		},
+		method: "PUT", path: "/v2/service_instances/instance-guid",
+		body:     provisionBody,
+		status:   http.StatusServiceUnavailable,
+		response: `{"description": "Cloud Foundry is unavailable"}`,
+	},
+	{
+		name: "provision with rejected Concourse credentials",
+		setup: func(cf *fakecf.Server, concourse *fakeatc.Server, store IinstanceStore) {
+			concourse.Inject(fakeatc.Fault{Route: atc.GetAuthToken, Status: http.StatusUnauthorized})
+		},
+		method: "PUT", path: "/v2/service_instances/instance-guid",
+		body:     provisionBody,
+		status:   http.StatusInternalServerError,
+		response: `{"description": "The broker is not authorized to manage Concourse teams"}`,
+	},
+	{
+		name:   "provision with a malformed body",
+		method: "PUT", path: "/v2/service_instances/instance-guid",
+		body:   `{"service_id":`,
+		status: http.StatusUnprocessableEntity,
+	},
+	{
+		name:   "provision with bad credentials",
+		method: "PUT", path: "/v2/service_instances/instance-guid",
+		body:     provisionBody,
+		password: "wrong",
+		status:   http.StatusUnauthorized,
+	},
+	{
+		name: "deprovision",
+		setup: func(cf *fakecf.Server, concourse *fakeatc.Server, store IinstanceStore) {
+			concourse.AddTeam(atc.Team{Name: "my-org", BasicAuth: &atc.BasicAuth{BasicAuthUsername: "u", BasicAuthPassword: "p"}})
+		},
+		method: "DELETE", path: "/v2/service_instances/instance-guid?service_id=" + osbapiServiceID + "&plan_id=" + osbapiPlanID,
+		status:   http.StatusOK,
+		response: `{}`,
+	},
+	{
+		name: "deprovision accepting incomplete responds synchronously",
+		setup: func(cf *fakecf.Server, concourse *fakeatc.Server, store IinstanceStore) {
+			concourse.AddTeam(atc.Team{Name: "my-org", BasicAuth: &atc.BasicAuth{BasicAuthUsername: "u", BasicAuthPassword: "p"}})
+		},
+		method: "DELETE", path: "/v2/service_instances/instance-guid?accepts_incomplete=true&service_id=" + osbapiServiceID + "&plan_id=" + osbapiPlanID,
+		status:   http.StatusOK,
+		response: `{}`,
+	},
+	{
+		name:   "deprovision a provisioned instance",
+		setup:  provisionInstance,
+		method: "DELETE", path: "/v2/service_instances/instance-guid?service_id=" + osbapiServiceID + "&plan_id=" + osbapiPlanID,
+		status:   http.StatusOK,
+		response: `{}`,
+	},
+	{
+		name: "deprovision an instance whose team is already gone",
+		setup: func(cf *fakecf.Server, concourse *fakeatc.Server, store IinstanceStore) {
+			putInstanceRecord(store)
+		},
+		method: "DELETE", path: "/v2/service_instances/instance-guid?service_id=" + osbapiServiceID + "&plan_id=" + osbapiPlanID,
+		status:   http.StatusOK,
+		response: `{}`,
+	},
+	{
+		name:   "deprovision an already deprovisioned instance",
+		method: "DELETE", path: "/v2/service_instances/instance-guid?service_id=" + osbapiServiceID + "&plan_id=" + osbapiPlanID,
+		status:   http.StatusGone,
+		response: `{}`,
+	},
+	{
+		name:   "deprovision an unknown instance",
+		method: "DELETE", path: "/v2/service_instances/unknown-guid?service_id=" + osbapiServiceID + "&plan_id=" + osbapiPlanID,
+		status:   http.StatusGone,
+		response: `{}`,
+	},
+	{
+		name: "update",
+		setup: func(cf *fakecf.Server, concourse *fakeatc.Server, store IinstanceStore) {
+			putInstanceRecord(store)
+		},
+		method: "PATCH", path: "/v2/service_instances/instance-guid",
+		body:     `{"service_id": "` + osbapiServiceID + `", "plan_id": "` + osbapiPlanID + `"}`,
+		status:   http.StatusOK,
+		response: `{}`,
+	},
+	{
+		name:   "update the plan of an unrecorded instance",
+		method: "PATCH", path: "/v2/service_instances/instance-guid",
+		body:     `{"service_id": "` + osbapiServiceID + `", "plan_id": "` + osbapiPlanID + `"}`,
+		status:   http.StatusInternalServerError,
+		response: `{"description": "The broker has no record of this instance, its plan can't be changed"}`,
+	},
+	{
+		name:   "metrics",
+		method: "GET", path: "/metrics",
+		status: http.StatusOK,
+	},
+	{
+		name:   "metrics with bad credentials",
+		method: "GET", path: "/metrics",
+		password: "wrong",
+		status:   http.StatusUnauthorized,
+	},
+	{
+		name:   "last operation",
+		method: "GET", path: "/v2/service_instances/instance-guid/last_operation",
+		status: http.StatusOK,
+	},
+}
+
+func TestOSBAPIConformance(t *testing.T) {
+	for _, c := range osbapiCases {
+		t.Run(c.name, func(t *testing.T) {
+			cf := newTestCF(t)
+			defer cf.Close()
+			concourse := fakeatc.New("admin", "password")
+			defer concourse.Close()
+			store, _ := newInstanceStore("", "")
+			if c.setup != nil {
+				c.setup(cf, concourse, store)
+			}
+
+			config := testCFConfig(cf)
+			config.BrokerUsername = "broker"
+			config.BrokerPassword = "password"
+			config.AdminUsername = "admin"
+			config.AdminPassword = "password"
+			config.ConcourseURL = concourse.URL
+			services, err := CatalogLoad("./catalog.json")
+			if err != nil {
+				t.Fatal("Unable to load catalog: " + err.Error())
+			}
+			serviceBroker := &broker{
+				services:  services,
+				logger:    lager.NewLogger("test"),
+				env:       config,
+				resolver:  newPlatformResolver(config, newCFLazyClient(config)),
+				concourse: concourseNewClient(config, lager.NewLogger("test")),
+				store:     store,
+			}
+			server := httptest.NewServer(newBrokerHandler(serviceBroker, lager.NewLogger("test"), brokerapi.BrokerCredentials{
+				Username: config.BrokerUsername,
+				Password: config.BrokerPassword,
+			}))
+			defer server.Close()
+
+			req, err := http.NewRequest(c.method, server.URL+c.path, strings.NewReader(c.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			password := config.BrokerPassword
+			if c.password != "" {
+				password = c.password
+			}
+			req.SetBasicAuth(config.BrokerUsername, password)
+			req.Header.Set("X-Broker-API-Version", "2.12")
+			req.Header.Set("Content-Type", "application/json")
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := ioutil.ReadAll(resp.Body)
+
+			if resp.StatusCode != c.status {
+				t.Fatalf("Expected status %d but got %d: %s", c.status, resp.StatusCode, body)
+			}
+			if c.response != "" {
+				var expected, actual interface{}
+				json.Unmarshal([]byte(c.response), &expected)
+				if err := json.Unmarshal(body, &actual); err != nil {
+					t.Fatalf("Response is not valid JSON: %s", body)
+				}
+				if !reflect.DeepEqual(expected, actual) {
+					t.Errorf("Expected response %s but got: %s", c.response, body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/concourse/atc"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// pipelineTemplate is a pipeline the broker sets in every team of a plan. File
+// is relative to the catalog.
+type pipelineTemplate struct {
+	Name   string     `json:"name"`
+	File   string     `json:"file"`
+	Paused bool       `json:"paused"`
+	Config atc.Config `json:"-"`
+}
+
+// loadPipelineTemplate reads the config of template and checks it complies
+// with the worker tags of the plan.
+func loadPipelineTemplate(catalogDir string, template pipelineTemplate, tags []string) (pipelineTemplate, error) {
+	if template.Name == "" || template.File == "" {
+		return template, errors.New("Pipeline templates need a name and a file")
+	}
+	path := template.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(catalogDir, path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return template, err
+	}
+	err = yaml.Unmarshal(data, &template.Config)
+	if err != nil {
+		return template, errors.Wrapf(err, "Invalid pipeline %s", template.File)
+	}
+	_, err = applyWorkerTags(template.Config, tags)
+	if err != nil {
+		return template, errors.Wrapf(err, "Invalid pipeline %s", template.File)
+	}
+	return template, nil
+}
+
+// applyWorkerTags returns a copy of config with tags set on every resource,
+// resource type and job step that runs on a worker, so the pipeline only runs
+// on the workers of the plan. Steps that set other tags are rejected. Without
+// tags config is returned as is.
+func applyWorkerTags(config atc.Config, tags []string) (atc.Config, error) {
+	if len(tags) == 0 {
+		return config, nil
+	}
+	tagged := config
+
+	tagged.Resources = make(atc.ResourceConfigs, len(config.Resources))
+	for i, resource := range config.Resources {
+		if !allowedTags(resource.Tags, tags) {
+			return atc.Config{}, errors.Errorf("Resource %s overrides the worker tags %v", resource.Name, tags)
+		}
+		resource.Tags = tags
+		tagged.Resources[i] = resource
+	}
+	tagged.ResourceTypes = make(atc.ResourceTypes, len(config.ResourceTypes))
+	for i, resourceType := range config.ResourceTypes {
+		if !allowedTags(resourceType.Tags, tags) {
+			return atc.Config{}, errors.Errorf("Resource type %s overrides the worker tags %v", resourceType.Name, tags)
+		}
+		resourceType.Tags = tags
+		tagged.ResourceTypes[i] = resourceType
+	}
+
+	tagged.Jobs = make(atc.JobConfigs, len(config.Jobs))
+	for i, job := range config.Jobs {
+		var err error
+		job.Plan, err = tagPlanSequence(job.Plan, tags, job.Name)
+		if err != nil {
+			return atc.Config{}, err
+		}
+		for _, hook := range []**atc.PlanConfig{&job.Failure, &job.Ensure, &job.Success} {
+			*hook, err = tagPlanPointer(*hook, tags, job.Name)
+			if err != nil {
+				return atc.Config{}, err
+			}
+		}
+		tagged.Jobs[i] = job
+	}
+	return tagged, nil
+}
+
+func tagPlanSequence(plans atc.PlanSequence, tags []string, jobName string) (atc.PlanSequence, error) {
+	tagged := make(atc.PlanSequence, len(plans))
+	for i, plan := range plans {
+		var err error
+		tagged[i], err = tagPlan(plan, tags, jobName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tagged, nil
+}
+
+func tagPlanPointer(plan *atc.PlanConfig, tags []string, jobName string) (*atc.PlanConfig, error) {
+	if plan == nil {
+		return nil, nil
+	}
+	tagged, err := tagPlan(*plan, tags, jobName)
+	if err != nil {
+		return nil, err
+	}
+	return &tagged, nil
+}
+
+// tagPlan tags the step and all steps nested in it. Nested steps are copied,
+// so the template they came from is left untouched.
+func tagPlan(plan atc.PlanConfig, tags []string, jobName string) (atc.PlanConfig, error) {
+	if plan.Get != "" || plan.Put != "" || plan.Task != "" {
+		if !allowedTags(plan.Tags, tags) {
+			return atc.PlanConfig{}, errors.Errorf("Step %s of job %s overrides the worker tags %v", plan.Name(), jobName, tags)
+		}
+		plan.Tags = tags
+	}
+	for _, sequence := range []**atc.PlanSequence{&plan.Do, &plan.Aggregate} {
+		if *sequence == nil {
+			continue
+		}
+		tagged, err := tagPlanSequence(**sequence, tags, jobName)
+		if err != nil {
+			return atc.PlanConfig{}, err
+		}
+		*sequence = &tagged
+	}
+	for _, nested := range []**atc.PlanConfig{&plan.Failure, &plan.Ensure, &plan.Success, &plan.Try} {
+		var err error
+		*nested, err = tagPlanPointer(*nested, tags, jobName)
+		if err != nil {
+			return atc.PlanConfig{}, err
+		}
+	}
+	return plan, nil
+}
+
+// allowedTags reports whether tags set in a pipeline are unset or the same as
+// the required ones.
+func allowedTags(tags, required []string) bool {
+	if len(tags) == 0 {
+		return true
+	}
+	if len(tags) != len(required) {
+		return false
+	}
+	sorted := append([]string(nil), tags...)
+	sortedRequired := append([]string(nil), required...)
+	sort.Strings(sorted)
+	sort.Strings(sortedRequired)
+	for i := range sorted {
+		if sorted[i] != sortedRequired[i] {
+			return false
+		}
+	}
+	return true
+}
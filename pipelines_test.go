@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/concourse/atc"
+)
+
+func testPipelineConfig() atc.Config {
+	return atc.Config{
+		Resources: atc.ResourceConfigs{{Name: "repo", Type: "git"}},
+		Jobs: atc.JobConfigs{{
+			Name: "build",
+			Plan: atc.PlanSequence{
+				{Get: "repo", Trigger: true},
+				{Aggregate: &atc.PlanSequence{{Task: "unit"}, {Task: "lint", Tags: atc.Tags{"large"}}}},
+				{Put: "repo", Failure: &atc.PlanConfig{Task: "notify"}},
+			},
+			Ensure: &atc.PlanConfig{Task: "cleanup"},
+		}},
+	}
+}
+
+func TestApplyWorkerTags(t *testing.T) {
+	config := testPipelineConfig()
+	tagged, err := applyWorkerTags(config, []string{"large"})
+	if err != nil {
+		t.Fatal("applyWorkerTags returned error: " + err.Error())
+	}
+	job := tagged.Jobs[0]
+	steps := []atc.PlanConfig{
+		job.Plan[0],
+		(*job.Plan[1].Aggregate)[0],
+		(*job.Plan[1].Aggregate)[1],
+		job.Plan[2],
+		*job.Plan[2].Failure,
+		*job.Ensure,
+	}
+	for _, step := range steps {
+		if len(step.Tags) != 1 || step.Tags[0] != "large" {
+			t.Errorf("Expected step %s to be tagged large but got: %v", step.Name(), step.Tags)
+		}
+	}
+	if len(tagged.Resources[0].Tags) != 1 {
+		t.Error("Expected resource repo to be tagged large")
+	}
+	if len(config.Jobs[0].Plan[0].Tags) != 0 || len((*config.Jobs[0].Plan[1].Aggregate)[0].Tags) != 0 {
+		t.Error("applyWorkerTags changed the original config")
+	}
+}
+
+func TestApplyWorkerTagsRejectsOverrides(t *testing.T) {
+	config := testPipelineConfig()
+	_, err := applyWorkerTags(config, []string{"internal-network"})
+	if err == nil {
+		t.Error("applyWorkerTags didn't reject a step with other tags")
+	}
+
+	_, err = applyWorkerTags(config, nil)
+	if err != nil {
+		t.Error("applyWorkerTags rejected tags without a policy: " + err.Error())
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	platformCloudFoundry = "cloudfoundry"
+	platformKubernetes   = "kubernetes"
+)
+
+const originatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
+var errInstanceNotFound = classify(errors.New("Service instance not found"), kindNotFound, "Service instance not found")
+
+type platformDetails struct {
+	Platform  string
+	OrgGUID   string
+	OrgName   string
+	SpaceGUID string
+	SpaceName string
+	Namespace string
+	Groups    []string
+}
+
+// IplatformResolver resolves the platform specific details (CF org and space,
+// Kubernetes namespace) that a service instance belongs to.
+type IplatformResolver interface {
+	GetProvisionDetails(ctx context.Context, details brokerapi.ProvisionDetails) (platformDetails, error)
+	GetDeprovisionDetails(ctx context.Context, instanceID string) (platformDetails, error)
+}
+
+// platformContext is the OSBAPI context object together with the originating
+// identity of the request. The vendored brokerapi predates both, so they are
+// extracted by platformContextHandler and passed along in the request context.
+type platformContext struct {
+	Platform         string   `json:"platform"`
+	OrganizationGUID string   `json:"organization_guid"`
+	SpaceGUID        string   `json:"space_guid"`
+	Namespace        string   `json:"namespace"`
+	IdentityPlatform string   `json:"-"`
+	Groups           []string `json:"-"`
+}
+
+type platformContextKey struct{}
+
+func platformContextFrom(ctx context.Context) platformContext {
+	if ctx == nil {
+		return platformContext{}
+	}
+	pc, _ := ctx.Value(platformContextKey{}).(platformContext)
+	return pc
+}
+
+func withPlatformContext(ctx context.Context, pc platformContext) context.Context {
+	return context.WithValue(ctx, platformContextKey{}, pc)
+}
+
+// platformContextHandler wraps the brokerapi handler to make the OSBAPI context
+// object and the originating identity available to the broker.
+func platformContextHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var pc platformContext
+		if r.Body != nil && (r.Method == "PUT" || r.Method == "PATCH") {
+			body, err := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			var request struct {
+				Context *platformContext `json:"context"`
+			}
+			if json.Unmarshal(body, &request) == nil && request.Context != nil {
+				pc = *request.Context
+			}
+		}
+		pc.IdentityPlatform, pc.Groups = parseOriginatingIdentity(r.Header.Get(originatingIdentityHeader))
+		next.ServeHTTP(w, r.WithContext(withPlatformContext(r.Context(), pc)))
+	})
+}
+
+// parseOriginatingIdentity returns the platform and, for Kubernetes, the groups
+// of the user that issued the request.
+func parseOriginatingIdentity(header string) (string, []string) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) != 2 {
+		return "", nil
+	}
+	value, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return parts[0], nil
+	}
+	var identity struct {
+		Groups []string `json:"groups"`
+	}
+	if json.Unmarshal(value, &identity) != nil {
+		return parts[0], nil
+	}
+	return parts[0], identity.Groups
+}
+
+func newPlatformResolver(config brokerConfig, cfClient IcfClient) IplatformResolver {
+	resolvers := map[string]IplatformResolver{
+		platformCloudFoundry: &cfPlatformResolver{client: cfClient},
+	}
+	if config.KubernetesAPIURL != "" {
+		resolvers[platformKubernetes] = newKubernetesResolver(config)
+	}
+	return &platformRouter{resolvers: resolvers}
+}
+
+// platformRouter dispatches to the resolver of the platform that issued the
+// request, defaulting to Cloud Foundry for brokers that send no context.
+type platformRouter struct {
+	resolvers map[string]IplatformResolver
+}
+
+func (p *platformRouter) resolver(platform string) (IplatformResolver, error) {
+	if platform == "" {
+		platform = platformCloudFoundry
+	}
+	resolver, ok := p.resolvers[platform]
+	if !ok {
+		err := errors.Errorf("Platform %s is not supported by this broker", platform)
+		return nil, classify(err, kindInvalidInput, err.Error())
+	}
+	return resolver, nil
+}
+
+func (p *platformRouter) GetProvisionDetails(ctx context.Context, details brokerapi.ProvisionDetails) (platformDetails, error) {
+	pc := platformContextFrom(ctx)
+	platform := pc.Platform
+	if platform == "" {
+		platform = pc.IdentityPlatform
+	}
+	resolver, err := p.resolver(platform)
+	if err != nil {
+		return platformDetails{}, err
+	}
+	return resolver.GetProvisionDetails(ctx, details)
+}
+
+// GetDeprovisionDetails relies on the originating identity to determine the
+// platform, since OSBAPI does not send a context object on deprovision.
+func (p *platformRouter) GetDeprovisionDetails(ctx context.Context, instanceID string) (platformDetails, error) {
+	resolver, err := p.resolver(platformContextFrom(ctx).IdentityPlatform)
+	if err != nil {
+		return platformDetails{}, err
+	}
+	return resolver.GetDeprovisionDetails(ctx, instanceID)
+}
+
+type cfPlatformResolver struct {
+	client IcfClient
+}
+
+func (r *cfPlatformResolver) GetProvisionDetails(ctx context.Context, details brokerapi.ProvisionDetails) (platformDetails, error) {
+	pDetails, err := r.client.GetProvisionDetails(ctx, details.SpaceGUID)
+	if err != nil {
+		return platformDetails{}, err
+	}
+	pDetails.SpaceGUID = details.SpaceGUID
+	return pDetails, nil
+}
+
+func (r *cfPlatformResolver) GetDeprovisionDetails(ctx context.Context, instanceID string) (platformDetails, error) {
+	pDetails, err := r.client.GetDeprovisionDetails(ctx, instanceID)
+	if isCFNotFound(err) {
+		return platformDetails{}, errInstanceNotFound
+	}
+	return pDetails, err
+}
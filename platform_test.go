@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+func TestPlatformContextHandler(t *testing.T) {
+	body := `{"service_id":"s","plan_id":"p","context":{"platform":"kubernetes","namespace":"ci"}}`
+	identity := base64.StdEncoding.EncodeToString([]byte(`{"username":"jane","groups":["devs","system:authenticated"]}`))
+
+	var got platformContext
+	var gotBody string
+	handler := platformContextHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = platformContextFrom(r.Context())
+		data, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(data)
+	}))
+
+	req := httptest.NewRequest("PUT", "/v2/service_instances/1", strings.NewReader(body))
+	req.Header.Set(originatingIdentityHeader, "kubernetes "+identity)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got.Platform != platformKubernetes || got.Namespace != "ci" {
+		t.Errorf("Expected kubernetes context for namespace ci but got: %+v", got)
+	}
+	if got.IdentityPlatform != platformKubernetes || len(got.Groups) != 2 {
+		t.Errorf("Expected groups from the originating identity but got: %+v", got)
+	}
+	if gotBody != body {
+		t.Error("Request body was not passed on to the broker handler")
+	}
+}
+
+func TestKubernetesProvisionDetails(t *testing.T) {
+	ctx := withPlatformContext(context.Background(), platformContext{
+		Platform:  platformKubernetes,
+		Namespace: "ci",
+		Groups:    []string{"devs", "system:authenticated"},
+	})
+
+	details, err := (&kubernetesResolver{}).GetProvisionDetails(ctx, brokerapi.ProvisionDetails{})
+	if err != nil {
+		t.Fatal("Unexpected error: " + err.Error())
+	}
+	if details.Namespace != "ci" {
+		t.Error("Expected namespace ci but got: " + details.Namespace)
+	}
+	if len(details.Groups) != 1 || details.Groups[0] != "devs" {
+		t.Errorf("Expected system groups to be dropped but got: %v", details.Groups)
+	}
+}
+
+func TestPlatformRouterUnsupportedPlatform(t *testing.T) {
+	router := &platformRouter{resolvers: map[string]IplatformResolver{}}
+	ctx := withPlatformContext(context.Background(), platformContext{Platform: platformKubernetes})
+
+	_, err := router.GetProvisionDetails(ctx, brokerapi.ProvisionDetails{})
+	if err == nil {
+		t.Error("No error was returned for a platform without a resolver")
+	}
+}
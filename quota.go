@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pkg/errors"
+)
+
+var quotaViolations = newCounter("quota_pipeline_violations_total", "Checks that found a team with more pipelines than its plan allows.")
+
+// quotaConfig limits the instances of a plan. Zero means unlimited.
+type quotaConfig struct {
+	MaxInstancesPerOrg  int `json:"max_instances_per_org"`
+	MaxTeamsPerSpace    int `json:"max_teams_per_space"`
+	MaxPipelinesPerTeam int `json:"max_pipelines_per_team"`
+}
+
+func quotaExceeded(format string, args ...interface{}) error {
+	err := errors.Errorf(format, args...)
+	return classify(err, kindQuotaExceeded, err.Error())
+}
+
+// quotaScopes returns the org and the space record counts against in the
+// instance and team quotas. Kubernetes has neither, so an instance counts
+// against its namespace for both.
+func quotaScopes(record instanceRecord) (org, space string) {
+	if record.Details.Platform == platformKubernetes {
+		return "namespace/" + record.Details.Namespace, "namespace/" + record.Details.Namespace
+	}
+	return record.OrgGUID, record.SpaceGUID
+}
+
+// checkInstanceQuota checks that record fits in the instance and team quotas,
+// counting the other instances the broker keeps records of. Each instance is
+// a team, so the teams in a space are the instances in it.
+func (b *broker) checkInstanceQuota(record instanceRecord, quota quotaConfig) error {
+	if quota.MaxInstancesPerOrg <= 0 && quota.MaxTeamsPerSpace <= 0 {
+		return nil
+	}
+	records, err := b.store.List()
+	if err != nil {
+		return err
+	}
+	org, space := quotaScopes(record)
+	instancesInOrg, teamsInSpace := 0, 0
+	for _, other := range records {
+		if other.InstanceID == record.InstanceID {
+			continue
+		}
+		otherOrg, otherSpace := quotaScopes(other)
+		if org != "" && otherOrg == org {
+			instancesInOrg++
+		}
+		if space != "" && otherSpace == space {
+			teamsInSpace++
+		}
+	}
+	if quota.MaxInstancesPerOrg > 0 && instancesInOrg >= quota.MaxInstancesPerOrg {
+		return quotaExceeded("Quota exceeded: the org already has %d instances, the plan allows %d", instancesInOrg, quota.MaxInstancesPerOrg)
+	}
+	if quota.MaxTeamsPerSpace > 0 && teamsInSpace >= quota.MaxTeamsPerSpace {
+		return quotaExceeded("Quota exceeded: the space already has %d teams, the plan allows %d", teamsInSpace, quota.MaxTeamsPerSpace)
+	}
+	return nil
+}
+
+// checkPipelineQuota checks that an existing team has no more pipelines than
+// quota allows.
+func (b *broker) checkPipelineQuota(ctx context.Context, teamName string, quota quotaConfig) error {
+	if quota.MaxPipelinesPerTeam <= 0 {
+		return nil
+	}
+	pipelines, err := b.concourse.ListPipelines(ctx, teamName)
+	if err != nil {
+		return err
+	}
+	if len(pipelines) > quota.MaxPipelinesPerTeam {
+		return quotaExceeded("Quota exceeded: the team has %d pipelines, the plan allows %d", len(pipelines), quota.MaxPipelinesPerTeam)
+	}
+	return nil
+}
+
+// checkPipelineQuotas flags the teams with more pipelines than their plan
+// allows and, if configured, pauses their newest pipelines until they fit.
+func (b *broker) checkPipelineQuotas(ctx context.Context) error {
+	b = b.current()
+	records, err := b.store.List()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		quota := b.plans[record.PlanID].Quota
+		if quota.MaxPipelinesPerTeam <= 0 {
+			continue
+		}
+		logData := lager.Data{"team-name": record.TeamName, "max-pipelines": quota.MaxPipelinesPerTeam}
+		pipelines, err := b.concourse.ListPipelines(ctx, record.TeamName)
+		if err != nil {
+			b.logger.Error("quota.list-pipelines-error", err, logData)
+			continue
+		}
+		if len(pipelines) <= quota.MaxPipelinesPerTeam {
+			continue
+		}
+		quotaViolations.Inc()
+		logData["pipelines"] = len(pipelines)
+		b.logger.Info("quota.pipelines-exceeded", logData)
+		if !b.env.QuotaPauseExcessPipelines {
+			continue
+		}
+		sort.Slice(pipelines, func(i, j int) bool { return pipelines[i].ID > pipelines[j].ID })
+		for _, pipeline := range pipelines[:len(pipelines)-quota.MaxPipelinesPerTeam] {
+			if pipeline.Paused {
+				continue
+			}
+			err := b.concourse.PausePipeline(ctx, record.TeamName, pipeline.Name)
+			if err != nil {
+				b.logger.Error("quota.pause-pipeline-error", err, lager.Data{"team-name": record.TeamName, "pipeline": pipeline.Name})
+				continue
+			}
+			b.logger.Info("quota.paused-pipeline", lager.Data{"team-name": record.TeamName, "pipeline": pipeline.Name})
+		}
+	}
+	return nil
+}
+
+// watchQuotas checks the pipeline quotas every interval until stop is closed.
+func (b *broker) watchQuotas(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := b.checkPipelineQuotas(ctx)
+			cancel()
+			if err != nil {
+				b.logger.Error("quota.check-error", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
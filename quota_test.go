@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/concourse/atc"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/vchrisr/cf-concourse-broker/fakes/fakeatc"
+)
+
+func TestProvisionInstanceQuota(t *testing.T) {
+	services, _ := CatalogLoad("./catalog.json")
+	planID := services[0].Plans[0].ID
+	cfDetails := platformDetails{Platform: platformCloudFoundry, OrgGUID: "org-guid", OrgName: "my-org", SpaceGUID: "space-guid"}
+	k8sDetails := platformDetails{Platform: platformKubernetes, Namespace: "ci"}
+	tests := []struct {
+		name      string
+		quota     quotaConfig
+		existing  instanceRecord
+		details   platformDetails
+		spaceGUID string
+	}{
+		{
+			name:      "instances per org",
+			quota:     quotaConfig{MaxInstancesPerOrg: 1},
+			existing:  instanceRecord{OrgGUID: "org-guid", SpaceGUID: "other-space-guid", TeamName: "my-org", Details: cfDetails},
+			details:   cfDetails,
+			spaceGUID: "space-guid",
+		},
+		{
+			name:      "teams per space",
+			quota:     quotaConfig{MaxTeamsPerSpace: 1},
+			existing:  instanceRecord{OrgGUID: "org-guid", SpaceGUID: "space-guid", TeamName: "my-org", Details: cfDetails},
+			details:   cfDetails,
+			spaceGUID: "space-guid",
+		},
+		{
+			name:     "instances per namespace",
+			quota:    quotaConfig{MaxInstancesPerOrg: 1},
+			existing: instanceRecord{Namespace: "ci", TeamName: "ci", Details: k8sDetails},
+			details:  k8sDetails,
+		},
+	}
+	for _, test := range tests {
+		server := fakeatc.New("admin", "password")
+		b := newTestBroker(t, map[string]planConfig{planID: {Quota: test.quota}}, testBrokerOptions{server: server})
+		b.resolver = &fakeResolver{details: test.details}
+		test.existing.InstanceID, test.existing.PlanID = "existing", planID
+		b.store.Put(test.existing)
+
+		err := b.provision(context.Background(), "instance-id", brokerapi.ProvisionDetails{
+			ServiceID:        services[0].ID,
+			PlanID:           planID,
+			OrganizationGUID: test.details.OrgGUID,
+			SpaceGUID:        test.spaceGUID,
+		})
+		if kind, _ := errorKindOf(err); kind != kindQuotaExceeded {
+			t.Errorf("%s: expected a quota error but got: %v", test.name, err)
+		}
+		if _, found := server.Team(getTeamName(test.details)); found {
+			t.Errorf("%s: provision created a team beyond the quota", test.name)
+		}
+		server.Close()
+	}
+}
+
+func TestUpdatePipelineQuota(t *testing.T) {
+	server := fakeatc.New("admin", "password")
+	defer server.Close()
+	services, _ := CatalogLoad("./catalog.json")
+	b := newTestBroker(t, map[string]planConfig{"small": {Quota: quotaConfig{MaxPipelinesPerTeam: 1}}}, testBrokerOptions{server: server})
+	b.services[0].Plans = append(b.services[0].Plans, brokerapi.ServicePlan{ID: "small"})
+	b.store.Put(instanceRecord{InstanceID: "instance-id", ServiceID: services[0].ID, PlanID: services[0].Plans[0].ID, TeamName: "my-org"})
+	server.SetPipeline("my-org", "one", atc.Config{}, false)
+	server.SetPipeline("my-org", "two", atc.Config{}, false)
+
+	err := b.update(context.Background(), "instance-id", brokerapi.UpdateDetails{ServiceID: services[0].ID, PlanID: "small"})
+	if kind, _ := errorKindOf(err); kind != kindQuotaExceeded {
+		t.Errorf("Expected a quota error but got: %v", err)
+	}
+	record, _, _ := b.store.Get("instance-id")
+	if record.PlanID == "small" {
+		t.Error("Update changed the plan beyond the quota")
+	}
+}
+
+func TestCheckPipelineQuotasPausesNewestPipelines(t *testing.T) {
+	server := fakeatc.New("admin", "password")
+	defer server.Close()
+	b := newTestBroker(t, map[string]planConfig{"plan": {Quota: quotaConfig{MaxPipelinesPerTeam: 1}}}, testBrokerOptions{server: server})
+	b.env.QuotaPauseExcessPipelines = true
+	b.store.Put(instanceRecord{InstanceID: "instance-id", PlanID: "plan", TeamName: "my-org"})
+	server.SetPipeline("my-org", "oldest", atc.Config{}, false)
+	server.SetPipeline("my-org", "middle", atc.Config{}, false)
+	server.SetPipeline("my-org", "newest", atc.Config{}, false)
+	violations := quotaViolations.Value()
+
+	err := b.checkPipelineQuotas(context.Background())
+	if err != nil {
+		t.Fatal("checkPipelineQuotas returned error: " + err.Error())
+	}
+	if quotaViolations.Value() != violations+1 {
+		t.Error("Expected the team to be flagged")
+	}
+	pipelines, _ := b.concourse.ListPipelines(context.Background(), "my-org")
+	for _, pipeline := range pipelines {
+		if pipeline.Paused != (pipeline.Name != "oldest") {
+			t.Errorf("Unexpected paused state of pipeline %s: %v", pipeline.Name, pipeline.Paused)
+		}
+	}
+}
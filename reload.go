@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// reloader reloads the config and catalog of a running broker. A reload only
+// takes effect if both load, otherwise the broker keeps the ones it has.
+type reloader struct {
+	broker      *broker
+	handler     *swappableHandler
+	catalogPath string
+	logger      lager.Logger
+
+	mu       sync.Mutex
+	modTimes map[string]time.Time
+}
+
+func newReloader(b *broker, handler *swappableHandler, catalogPath string) *reloader {
+	r := &reloader{
+		broker:      b,
+		handler:     handler,
+		catalogPath: catalogPath,
+		logger:      b.logger.Session("reload"),
+	}
+	r.modTimes = r.currentModTimes()
+	return r
+}
+
+// reload loads the config and catalog and swaps them in.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.modTimes = r.currentModTimes()
+
+	config, err := brokerConfigLoad()
+	if err != nil {
+		r.logger.Error("invalid-config", err)
+		return err
+	}
+	services, err := CatalogLoad(r.catalogPath)
+	if err != nil {
+		r.logger.Error("invalid-catalog", err)
+		return err
+	}
+	plans, err := PlanConfigsLoad(r.catalogPath)
+	if err != nil {
+		r.logger.Error("invalid-catalog", err)
+		return err
+	}
+	err = checkInstanceStore(config, plans)
+	if err != nil {
+		r.logger.Error("invalid-catalog", err)
+		return err
+	}
+
+	previous := r.broker.current().env
+	r.broker.configure(config, services, plans)
+	if r.handler != nil {
+		r.handler.set(newBrokerHandler(r.broker, r.broker.logger, brokerapi.BrokerCredentials{
+			Username: config.BrokerUsername,
+			Password: config.BrokerPassword,
+		}))
+	}
+
+	var restartRequired []string
+	if config.Port != previous.Port {
+		restartRequired = append(restartRequired, "PORT")
+	}
+	if config.InstanceStorePath != previous.InstanceStorePath {
+		restartRequired = append(restartRequired, "INSTANCE_STORE_PATH")
+	}
+	if config.InstanceStoreKey != previous.InstanceStoreKey {
+		restartRequired = append(restartRequired, "INSTANCE_STORE_KEY")
+	}
+	if config.LogLevel != previous.LogLevel {
+		restartRequired = append(restartRequired, "LOG_LEVEL")
+	}
+	if config.QuotaCheckInterval != previous.QuotaCheckInterval {
+		restartRequired = append(restartRequired, "QUOTA_CHECK_INTERVAL")
+	}
+	if config.DrainPollInterval != previous.DrainPollInterval {
+		restartRequired = append(restartRequired, "DRAIN_POLL_INTERVAL")
+	}
+	if config.ConfigWatchInterval != previous.ConfigWatchInterval {
+		restartRequired = append(restartRequired, "CONFIG_WATCH_INTERVAL")
+	}
+	r.logger.Info("reloaded", lager.Data{
+		"services":         len(services),
+		"restart-required": restartRequired,
+	})
+	return nil
+}
+
+// watch reloads on every signal received from signals and, if interval is
+// set, whenever the config file or catalog changed on disk.
+func (r *reloader) watch(signals <-chan os.Signal, interval time.Duration, stop <-chan struct{}) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-signals:
+			r.reload()
+		case <-tick:
+			if r.changed() {
+				r.reload()
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (r *reloader) changed() bool {
+	modTimes := r.currentModTimes()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for path, modTime := range modTimes {
+		if !modTime.Equal(r.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *reloader) currentModTimes() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, path := range []string{r.catalogPath, os.Getenv("CONFIG_FILE")} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// swappableHandler serves with the handler set last, so the broker credentials
+// baked into the brokerapi handler can be replaced on reload.
+type swappableHandler struct {
+	mu      sync.RWMutex
+	handler http.Handler
+}
+
+func (h *swappableHandler) set(handler http.Handler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handler = handler
+}
+
+func (h *swappableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	handler := h.handler
+	h.mu.RUnlock()
+	handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+func setTestConfigEnv() {
+	for key, value := range map[string]string{
+		"BROKER_USERNAME": "broker",
+		"BROKER_PASSWORD": "password",
+		"ADMIN_USERNAME":  "admin",
+		"ADMIN_PASSWORD":  "password",
+		"CONCOURSE_URL":   "https://concourse.example.com",
+		"CF_URL":          "https://api.example.com",
+		"TOKEN_URL":       "https://uaa.example.com/oauth/token",
+		"AUTH_URL":        "https://login.example.com/oauth/authorize",
+		"CLIENT_ID":       "concourse",
+		"CLIENT_SECRET":   "secret",
+	} {
+		os.Setenv(key, value)
+	}
+}
+
+func newTestReloader(t *testing.T) (*reloader, string) {
+	setTestConfigEnv()
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := filepath.Join(dir, "catalog.json")
+	data, _ := ioutil.ReadFile("./catalog.json")
+	ioutil.WriteFile(catalog, data, 0600)
+
+	config, err := brokerConfigLoad()
+	if err != nil {
+		t.Fatal("Error loading config: " + err.Error())
+	}
+	services, _ := CatalogLoad(catalog)
+	b := &broker{logger: lager.NewLogger("test")}
+	b.configure(config, services, nil)
+	return newReloader(b, nil, catalog), dir
+}
+
+func TestReloadKeepsConfigOnInvalidCatalog(t *testing.T) {
+	r, dir := newTestReloader(t)
+	defer os.RemoveAll(dir)
+	before := r.broker.current().services
+
+	ioutil.WriteFile(r.catalogPath, []byte("{"), 0600)
+	if err := r.reload(); err == nil {
+		t.Error("Reloading an invalid catalog didn't return an error")
+	}
+	if len(r.broker.current().services) != len(before) || len(before) == 0 {
+		t.Error("The previous catalog wasn't kept after a failed reload")
+	}
+}
+
+func TestReloadAppliesNewConfig(t *testing.T) {
+	r, dir := newTestReloader(t)
+	defer os.RemoveAll(dir)
+	defer os.Unsetenv("CONCOURSE_TIMEOUT")
+
+	os.Setenv("CONCOURSE_TIMEOUT", "42s")
+	if err := r.reload(); err != nil {
+		t.Fatal("Reload returned error: " + err.Error())
+	}
+	if timeout := r.broker.current().env.ConcourseTimeout; timeout != 42*time.Second {
+		t.Errorf("Expected the reloaded timeout to be 42s but got: %s", timeout)
+	}
+}
+
+func TestWatchReloadsChangedCatalog(t *testing.T) {
+	r, dir := newTestReloader(t)
+	defer os.RemoveAll(dir)
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.watch(nil, 10*time.Millisecond, stop)
+
+	ioutil.WriteFile(r.catalogPath, []byte(`[]`), 0600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(r.catalogPath, future, future)
+
+	deadline := time.Now().Add(time.Second)
+	for len(r.broker.current().services) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("The changed catalog wasn't reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// responseOverride lets the broker answer with status codes the vendored
+// brokerapi can't produce, such as 400 for unknown plans.
+type responseOverride struct {
+	status   int
+	response *brokerapi.ErrorResponse
+}
+
+type responseOverrideKey struct{}
+
+// overrideResponse replaces the status code, and the body if response is not
+// nil, of the response to the request ctx belongs to.
+func overrideResponse(ctx context.Context, status int, response *brokerapi.ErrorResponse) {
+	if ctx == nil {
+		return
+	}
+	if override, ok := ctx.Value(responseOverrideKey{}).(*responseOverride); ok {
+		override.status = status
+		override.response = response
+	}
+}
+
+// responseOverrideHandler applies the overrides set by the broker while
+// handling the request.
+func responseOverrideHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		override := &responseOverride{}
+		ctx := context.WithValue(r.Context(), responseOverrideKey{}, override)
+		next.ServeHTTP(&overridingResponseWriter{ResponseWriter: w, override: override}, r.WithContext(ctx))
+	})
+}
+
+type overridingResponseWriter struct {
+	http.ResponseWriter
+	override *responseOverride
+	replaced bool
+}
+
+func (w *overridingResponseWriter) WriteHeader(status int) {
+	if w.override.status == 0 {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.ResponseWriter.WriteHeader(w.override.status)
+	if w.override.response != nil {
+		json.NewEncoder(w.ResponseWriter).Encode(w.override.response)
+		w.replaced = true
+	}
+}
+
+func (w *overridingResponseWriter) Write(data []byte) (int, error) {
+	if w.replaced {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
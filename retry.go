@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	upstreamConcourse    = "Concourse"
+	upstreamCloudFoundry = "Cloud Foundry"
+	upstreamKubernetes   = "Kubernetes"
+	upstreamVault        = "Vault"
+	upstreamCredHub      = "CredHub"
+)
+
+// retryTransport retries idempotent requests that failed with a transport
+// error or a gateway status, backing off exponentially with full jitter.
+// Consecutive failures open the circuit breaker of the upstream, after which
+// requests fail fast until the breaker's cooldown has passed.
+type retryTransport struct {
+	base       http.RoundTripper
+	breaker    *circuitBreaker
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+func newRetryTransport(upstream string, config brokerConfig, base http.RoundTripper) http.RoundTripper {
+	return &retryTransport{
+		base:       base,
+		breaker:    upstreamBreaker(upstream, config.CircuitBreakerThreshold, config.CircuitBreakerCooldown),
+		maxRetries: config.UpstreamMaxRetries,
+		baseDelay:  config.UpstreamRetryDelay,
+		maxDelay:   config.UpstreamMaxRetryDelay,
+	}
+}
+
+// noRetriesKey marks the contexts of withoutRetries.
+type noRetriesKey struct{}
+
+// withoutRetries returns a context whose requests are sent only once, for
+// requests whose response tells whether the request changed something, which
+// a retry after a lost response would get wrong.
+func withoutRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetriesKey{}, true)
+}
+
+func (t *retryTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	retries := t.maxRetries
+	if !isIdempotent(r) || r.Context().Value(noRetriesKey{}) != nil {
+		retries = 0
+	}
+	for attempt := 0; ; attempt++ {
+		allowed, trial := t.breaker.allow()
+		if !allowed {
+			return nil, classify(errors.Errorf("Circuit breaker for %s is open", t.breaker.upstream),
+				kindUnavailable, t.breaker.upstream+" is unavailable")
+		}
+		req := r
+		if attempt > 0 && r.GetBody != nil {
+			// A RoundTripper must not modify the caller's request, retries
+			// are sent as clones with a fresh body.
+			body, err := r.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = r.Clone(r.Context())
+			req.Body = body
+		}
+		resp, err := t.base.RoundTrip(req)
+		if err != nil && r.Context().Err() != nil {
+			// The caller gave up, which says nothing about the upstream.
+			t.breaker.release(trial)
+			return nil, err
+		}
+		failed := err != nil || isGatewayStatus(resp.StatusCode)
+		t.breaker.record(!failed, trial)
+		if !failed || attempt >= retries {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(t.backoff(attempt)):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+}
+
+// backoff returns a random delay of up to baseDelay * 2^attempt, capped at
+// maxDelay.
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	delay := t.baseDelay << uint(attempt)
+	if delay <= 0 || (t.maxDelay > 0 && delay > t.maxDelay) {
+		delay = t.maxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay)))
+}
+
+// isIdempotent reports whether r may be sent again, which also requires its
+// body to be replayable.
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+	}
+	return false
+}
+
+func isGatewayStatus(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = make(map[string]*circuitBreaker)
+)
+
+// upstreamBreaker returns the circuit breaker shared by all clients of the
+// upstream, so its state survives reloads of the configuration, which create
+// new clients.
+func upstreamBreaker(upstream string, threshold int, cooldown time.Duration) *circuitBreaker {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	breaker, ok := breakers[upstream]
+	if !ok {
+		breaker = &circuitBreaker{upstream: upstream}
+		breakers[upstream] = breaker
+	}
+	breaker.configure(threshold, cooldown)
+	return breaker
+}
+
+// circuitBreaker opens after threshold consecutive failures. Once cooldown has
+// passed a single trial request is let through, which closes the breaker
+// again if it succeeds. A threshold of 0 disables the breaker.
+type circuitBreaker struct {
+	upstream string
+
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func (b *circuitBreaker) configure(threshold int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.threshold = threshold
+	b.cooldown = cooldown
+}
+
+// allow reports whether a request may be sent, and whether it is the trial
+// request, which must be passed on to release or record.
+func (b *circuitBreaker) allow() (allowed, trial bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return true, false
+	}
+	if b.trial || time.Now().Before(b.openUntil) {
+		return false, false
+	}
+	b.trial = true
+	return true, true
+}
+
+// release ends a request without a verdict on the upstream, e.g. one the
+// caller cancelled, so that another trial request can be let through if it
+// was the trial request.
+func (b *circuitBreaker) release(trial bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if trial {
+		b.trial = false
+	}
+}
+
+func (b *circuitBreaker) record(success, trial bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if trial {
+		b.trial = false
+	}
+	if success {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.threshold > 0 && b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
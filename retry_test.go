@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newFlakyServer(failures *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *failures > 0 {
+			*failures--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+func testRetryConfig() brokerConfig {
+	return brokerConfig{
+		UpstreamMaxRetries:    3,
+		UpstreamRetryDelay:    time.Millisecond,
+		UpstreamMaxRetryDelay: 10 * time.Millisecond,
+	}
+}
+
+func TestRetryTransportRetriesIdempotentRequests(t *testing.T) {
+	failures := 2
+	server := newFlakyServer(&failures)
+	defer server.Close()
+	client := &http.Client{Transport: newRetryTransport("test-retry", testRetryConfig(), defaultTransport())}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal("Request returned error: " + err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the request to succeed after retrying but got: %d", resp.StatusCode)
+	}
+}
+
+func TestRetryTransportDoesNotRetryPost(t *testing.T) {
+	failures := 1
+	server := newFlakyServer(&failures)
+	defer server.Close()
+	client := &http.Client{Transport: newRetryTransport("test-post", testRetryConfig(), defaultTransport())}
+
+	resp, err := client.Post(server.URL, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal("Request returned error: " + err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected a POST not to be retried but got: %d", resp.StatusCode)
+	}
+}
+
+func TestCircuitBreakerFailsFast(t *testing.T) {
+	failures := 2
+	server := newFlakyServer(&failures)
+	defer server.Close()
+	config := brokerConfig{CircuitBreakerThreshold: 2, CircuitBreakerCooldown: 20 * time.Millisecond}
+	client := &http.Client{Transport: newRetryTransport("test-breaker", config, defaultTransport())}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal("Request returned error: " + err.Error())
+		}
+		resp.Body.Close()
+	}
+	_, err := client.Get(server.URL)
+	if err == nil || !strings.Contains(err.Error(), "Circuit breaker for test-breaker is open") {
+		t.Fatalf("Expected the breaker to be open but got: %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal("Expected a trial request after the cooldown but got: " + err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Unexpected status of the trial request: %d", resp.StatusCode)
+	}
+}
+
+func TestRetryTransportKeepsCallersRequest(t *testing.T) {
+	failures := 1
+	server := newFlakyServer(&failures)
+	defer server.Close()
+	transport := newRetryTransport("test-body", testRetryConfig(), defaultTransport())
+
+	req, _ := http.NewRequest("PUT", server.URL, strings.NewReader("{}"))
+	body := req.Body
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal("Request returned error: " + err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the request to succeed after retrying but got: %d", resp.StatusCode)
+	}
+	if req.Body != body {
+		t.Error("The retry replaced the body of the caller's request")
+	}
+}
+
+func TestCircuitBreakerIgnoresCancelledRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	config := brokerConfig{CircuitBreakerThreshold: 1, CircuitBreakerCooldown: time.Minute}
+	client := &http.Client{Transport: newRetryTransport("test-cancel", config, defaultTransport())}
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		_, err := client.Do(req.WithContext(ctx))
+		cancel()
+		if err == nil || strings.Contains(err.Error(), "Circuit breaker") {
+			t.Fatalf("Expected the request to time out without opening the breaker but got: %v", err)
+		}
+	}
+}
+
+func TestRetryTransportSendsOnceWithoutRetries(t *testing.T) {
+	failures := 1
+	server := newFlakyServer(&failures)
+	defer server.Close()
+	client := &http.Client{Transport: newRetryTransport("test-once", testRetryConfig(), defaultTransport())}
+
+	req, _ := http.NewRequest("PUT", server.URL, strings.NewReader("{}"))
+	resp, err := client.Do(req.WithContext(withoutRetries(context.Background())))
+	if err != nil {
+		t.Fatal("Request returned error: " + err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected the request not to be retried but got: %d", resp.StatusCode)
+	}
+}
+
+func TestCircuitBreakerKeepsTrialOfOtherRequests(t *testing.T) {
+	breaker := &circuitBreaker{upstream: "test-trial", threshold: 1, cooldown: time.Millisecond}
+	breaker.record(false, false)
+	time.Sleep(5 * time.Millisecond)
+
+	if allowed, trial := breaker.allow(); !allowed || !trial {
+		t.Fatalf("Expected a trial request after the cooldown but got allowed %t, trial %t", allowed, trial)
+	}
+	breaker.release(false)
+	if allowed, _ := breaker.allow(); allowed {
+		t.Error("Expected a second trial request to be refused while the first one is pending")
+	}
+	breaker.release(true)
+	if allowed, trial := breaker.allow(); !allowed || !trial {
+		t.Errorf("Expected a new trial request once the first one ended but got allowed %t, trial %t", allowed, trial)
+	}
+}
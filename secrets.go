@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// secretReference matches ((name)) in configuration values.
+var secretReference = regexp.MustCompile(`\(\(([^()\s]+)\)\)`)
+
+// IsecretSource resolves the ((name)) references in configuration values.
+// Sources report whether they know a secret, so the next one can be asked.
+type IsecretSource interface {
+	Secret(name string) (string, bool, error)
+}
+
+// newSecretSources returns the sources configured by the raw, not yet
+// resolved, configuration values, in the order they are asked. secrets_dir
+// may itself refer to VCAP_SERVICES, it is replaced by the resolved directory.
+func newSecretSources(values map[string]string) ([]IsecretSource, error) {
+	var sources []IsecretSource
+	if vcap := os.Getenv("VCAP_SERVICES"); vcap != "" {
+		source, err := newVCAPSecretSource(vcap)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+	dir, err := resolveSecretReferences(values["secrets_dir"], sources)
+	if err != nil {
+		return sources, fmt.Errorf("SECRETS_DIR: %v", err)
+	}
+	if dir != "" {
+		values["secrets_dir"] = dir
+		sources = append([]IsecretSource{fileSecretSource{dir: dir}}, sources...)
+	}
+	return sources, nil
+}
+
+// resolveSecretReferences replaces every ((name)) in value by the secret of
+// the first source that knows it.
+func resolveSecretReferences(value string, sources []IsecretSource) (string, error) {
+	var problems []string
+	resolved := secretReference.ReplaceAllStringFunc(value, func(reference string) string {
+		name := secretReference.FindStringSubmatch(reference)[1]
+		for _, source := range sources {
+			secret, found, err := source.Secret(name)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("resolving ((%s)): %v", name, err))
+				return reference
+			}
+			if found {
+				return secret
+			}
+		}
+		problems = append(problems, fmt.Sprintf("secret ((%s)) not found", name))
+		return reference
+	})
+	if len(problems) > 0 {
+		return "", fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+	return resolved, nil
+}
+
+// fileSecretSource reads secrets from files named after them, like the ones
+// mounted from Kubernetes secrets.
+type fileSecretSource struct {
+	dir string
+}
+
+func (s fileSecretSource) Secret(name string) (string, bool, error) {
+	if strings.Contains(name, "..") {
+		return "", false, fmt.Errorf("invalid secret name")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// vcapSecretSource looks secrets up in the credentials of the user-provided
+// services bound to the broker. ((service/key)) picks the key of the named
+// service, ((key)) the key of any of them.
+type vcapSecretSource struct {
+	services []vcapService
+}
+
+type vcapService struct {
+	Name        string                 `json:"name"`
+	Credentials map[string]interface{} `json:"credentials"`
+}
+
+func newVCAPSecretSource(vcap string) (*vcapSecretSource, error) {
+	var services map[string][]vcapService
+	err := json.Unmarshal([]byte(vcap), &services)
+	if err != nil {
+		return nil, fmt.Errorf("VCAP_SERVICES: %v", err)
+	}
+	return &vcapSecretSource{services: services["user-provided"]}, nil
+}
+
+func (s *vcapSecretSource) Secret(name string) (string, bool, error) {
+	serviceName, key := "", name
+	if i := strings.Index(name, "/"); i >= 0 {
+		serviceName, key = name[:i], name[i+1:]
+	}
+	for _, service := range s.services {
+		if serviceName != "" && service.Name != serviceName {
+			continue
+		}
+		if value, ok := service.Credentials[key]; ok {
+			return fmt.Sprint(value), true, nil
+		}
+	}
+	return "", false, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// serviceKeyCredentials get developers onto the team with fly. Service keys of
+// plans with dedicated workers carry the worker registration as well.
+type serviceKeyCredentials struct {
+	ConcourseURL      string `json:"concourse_url"`
+	Team              string `json:"team"`
+	CACert            string `json:"ca_cert,omitempty"`
+	Flyrc             string `json:"flyrc"`
+	FlyLogin          string `json:"fly_login"`
+	BasicAuthUsername string `json:"basic_auth_username,omitempty"`
+	BasicAuthPassword string `json:"basic_auth_password,omitempty"`
+
+	*workerCredentials
+}
+
+// flyrc mirrors the ~/.flyrc of fly, without the token fly login adds.
+type flyrc struct {
+	Targets map[string]flyTarget `yaml:"targets"`
+}
+
+type flyTarget struct {
+	API    string `yaml:"api"`
+	Team   string `yaml:"team"`
+	CACert string `yaml:"ca_cert,omitempty"`
+}
+
+func newServiceKeyCredentials(config brokerConfig, record instanceRecord) (serviceKeyCredentials, error) {
+	url := strings.TrimSuffix(config.ConcourseURL, "/")
+	snippet, err := yaml.Marshal(flyrc{Targets: map[string]flyTarget{
+		record.TeamName: {API: url, Team: record.TeamName, CACert: config.ConcourseCACert},
+	}})
+	if err != nil {
+		return serviceKeyCredentials{}, err
+	}
+	login := fmt.Sprintf("fly -t %s login -c %s -n %s", record.TeamName, url, record.TeamName)
+	if config.ConcourseCACert != "" {
+		login += " --ca-cert concourse-ca.pem"
+	}
+	credentials := serviceKeyCredentials{
+		ConcourseURL: url,
+		Team:         record.TeamName,
+		CACert:       config.ConcourseCACert,
+		Flyrc:        string(snippet),
+		FlyLogin:     login,
+	}
+	if record.Auth != nil && record.Auth.BasicAuth != nil {
+		credentials.BasicAuthUsername = record.Auth.BasicAuth.Username
+		credentials.BasicAuthPassword = record.Auth.BasicAuth.Password
+	}
+	if record.Workers != nil {
+		workers := newWorkerCredentials(config, record)
+		credentials.workerCredentials = &workers
+	}
+	return credentials, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestNewServiceKeyCredentials(t *testing.T) {
+	config := brokerConfig{ConcourseURL: "https://ci.example.com/", ConcourseCACert: "-----BEGIN CERTIFICATE-----\n...\n-----END CERTIFICATE-----\n"}
+	record := instanceRecord{TeamName: "my-org", Auth: &teamAuthConfig{BasicAuth: &basicAuthConfig{Username: "ci", Password: "generated"}}}
+
+	credentials, err := newServiceKeyCredentials(config, record)
+	if err != nil {
+		t.Fatal("newServiceKeyCredentials returned error: " + err.Error())
+	}
+	if credentials.FlyLogin != "fly -t my-org login -c https://ci.example.com -n my-org --ca-cert concourse-ca.pem" {
+		t.Error("Unexpected fly login command: " + credentials.FlyLogin)
+	}
+	var rc flyrc
+	err = yaml.Unmarshal([]byte(credentials.Flyrc), &rc)
+	if err != nil {
+		t.Fatal("The flyrc snippet is not valid YAML: " + err.Error())
+	}
+	if target := rc.Targets["my-org"]; target.API != "https://ci.example.com" || target.Team != "my-org" || target.CACert != config.ConcourseCACert {
+		t.Errorf("Unexpected flyrc target: %+v", target)
+	}
+	if credentials.BasicAuthPassword != "generated" {
+		t.Error("Expected the basic auth password of the team")
+	}
+
+	data, _ := json.Marshal(credentials)
+	if strings.Contains(string(data), "tsa_host") {
+		t.Error("Expected no worker registration without dedicated workers: " + string(data))
+	}
+}
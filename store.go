@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// instanceRecord is the state the broker keeps for a provisioned instance.
+type instanceRecord struct {
+	InstanceID string          `json:"instance_id"`
+	ServiceID  string          `json:"service_id"`
+	PlanID     string          `json:"plan_id"`
+	OrgGUID    string          `json:"organization_guid,omitempty"`
+	SpaceGUID  string          `json:"space_guid,omitempty"`
+	Namespace  string          `json:"namespace,omitempty"`
+	Parameters json.RawMessage `json:"parameters,omitempty"`
+	TeamName   string          `json:"team_name"`
+	Details    platformDetails `json:"details"`
+	Workers    *workerKey      `json:"workers,omitempty"`
+	Auth       *teamAuthConfig `json:"auth,omitempty"`
+	// Credentials is set once the broker set up the secrets of the team in
+	// the credential manager, which it only deletes then.
+	Credentials bool `json:"credentials,omitempty"`
+
+	Bindings map[string]bindingRecord `json:"bindings,omitempty"`
+}
+
+// copy returns a copy of r that shares no map with it.
+func (r instanceRecord) copy() instanceRecord {
+	if r.Bindings != nil {
+		bindings := make(map[string]bindingRecord, len(r.Bindings))
+		for id, binding := range r.Bindings {
+			bindings[id] = binding
+		}
+		r.Bindings = bindings
+	}
+	return r
+}
+
+// bindingRecord is a service key or an app binding, keyed by its binding ID.
+// AppGUID is empty for service keys. Pipeline is the pipeline set by the
+// binding and Drain the URL build events are forwarded to, if any.
+type bindingRecord struct {
+	AppGUID  string `json:"app_guid,omitempty"`
+	Pipeline string `json:"pipeline,omitempty"`
+	Drain    string `json:"drain,omitempty"`
+}
+
+// sameRequest reports whether other was provisioned with identical details, in
+// which case a repeated provision is answered with 200 instead of 409.
+func (r instanceRecord) sameRequest(other instanceRecord) bool {
+	return r.ServiceID == other.ServiceID &&
+		r.PlanID == other.PlanID &&
+		r.OrgGUID == other.OrgGUID &&
+		r.SpaceGUID == other.SpaceGUID &&
+		r.Namespace == other.Namespace &&
+		compactJSON(r.Parameters) == compactJSON(other.Parameters)
+}
+
+func compactJSON(data json.RawMessage) string {
+	var buf bytes.Buffer
+	if json.Compact(&buf, data) != nil {
+		return string(data)
+	}
+	return buf.String()
+}
+
+// IinstanceStore persists the records of provisioned instances.
+type IinstanceStore interface {
+	Get(instanceID string) (instanceRecord, bool, error)
+	FindByTeam(teamName string) (instanceRecord, bool, error)
+	List() ([]instanceRecord, error)
+	Put(record instanceRecord) error
+	// Update stores the record of instanceID as changed by update, unless
+	// update fails. No other change to the record happens in between. It
+	// reports whether there is a record, update is only called if there is.
+	Update(instanceID string, update func(record *instanceRecord) error) (bool, error)
+	Delete(instanceID string) error
+}
+
+// newInstanceStore returns a store backed by the file at path, or an in-memory
+// store if path is empty. The secrets of the records are encrypted in the file
+// with key. Secrets written in plain text by earlier versions are encrypted
+// right away.
+func newInstanceStore(path, key string) (IinstanceStore, error) {
+	sealKey, err := newStoreKey(key)
+	if err != nil {
+		return nil, err
+	}
+	store := &fileInstanceStore{path: path, key: sealKey, records: make(map[string]instanceRecord)}
+	if path == "" {
+		return store, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records map[string]instanceRecord
+	err = json.Unmarshal(data, &records)
+	if err != nil {
+		return nil, err
+	}
+	plain := false
+	for instanceID, record := range records {
+		plain = plain || record.hasPlainSecrets()
+		store.records[instanceID], err = record.mapSecrets(sealKey.open)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if plain {
+		if sealKey == nil {
+			return nil, fmt.Errorf("INSTANCE_STORE_KEY is required, the instance store holds secrets")
+		}
+		err = store.save()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// checkInstanceStore rejects an in-memory store if a plan relies on records
+// that have to survive a restart: the worker keys and auth of its teams, or
+// its quotas, which are counted from the records.
+func checkInstanceStore(config brokerConfig, plans map[string]planConfig) error {
+	if config.InstanceStorePath != "" {
+		return checkInstanceStoreKey(config, plans)
+	}
+	var planIDs []string
+	for planID, plan := range plans {
+		if plan.DedicatedWorkers || len(plan.Auth) > 0 || plan.Quota != (quotaConfig{}) {
+			planIDs = append(planIDs, planID)
+		}
+	}
+	if len(planIDs) == 0 {
+		return nil
+	}
+	sort.Strings(planIDs)
+	return fmt.Errorf("INSTANCE_STORE_PATH is required by plans %s, whose worker keys, auth or quotas are kept in the instance store", strings.Join(planIDs, ", "))
+}
+
+// checkInstanceStoreKey rejects a store file without a key if a plan keeps
+// secrets in the records: the worker keys or the auth of its teams.
+func checkInstanceStoreKey(config brokerConfig, plans map[string]planConfig) error {
+	if config.InstanceStoreKey != "" {
+		return nil
+	}
+	var planIDs []string
+	for planID, plan := range plans {
+		if plan.DedicatedWorkers || len(plan.Auth) > 0 {
+			planIDs = append(planIDs, planID)
+		}
+	}
+	if len(planIDs) == 0 {
+		return nil
+	}
+	sort.Strings(planIDs)
+	return fmt.Errorf("INSTANCE_STORE_KEY is required by plans %s, whose secrets are kept in the instance store", strings.Join(planIDs, ", "))
+}
+
+// fileInstanceStore keeps the records in memory and writes all of them to the
+// file on every change. It has a single writer: brokers sharing the file
+// overwrite each other's records.
+type fileInstanceStore struct {
+	path    string
+	key     *storeKey
+	mu      sync.Mutex
+	records map[string]instanceRecord
+}
+
+// The records handed out and taken in are copies, so the maps they hold are
+// never shared with the store.
+
+func (s *fileInstanceStore) Get(instanceID string) (instanceRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, found := s.records[instanceID]
+	return record.copy(), found, nil
+}
+
+func (s *fileInstanceStore) FindByTeam(teamName string) (instanceRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, record := range s.records {
+		if record.TeamName == teamName {
+			return record.copy(), true, nil
+		}
+	}
+	return instanceRecord{}, false, nil
+}
+
+func (s *fileInstanceStore) List() ([]instanceRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]instanceRecord, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, record.copy())
+	}
+	return records, nil
+}
+
+func (s *fileInstanceStore) Put(record instanceRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.put(record.copy())
+}
+
+func (s *fileInstanceStore) Update(instanceID string, update func(record *instanceRecord) error) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, found := s.records[instanceID]
+	if !found {
+		return false, nil
+	}
+	record = record.copy()
+	err := update(&record)
+	if err != nil {
+		return true, err
+	}
+	return true, s.put(record.copy())
+}
+
+// put stores record and saves the records, restoring the previous record if
+// that fails. The caller must hold s.mu.
+func (s *fileInstanceStore) put(record instanceRecord) error {
+	previous, existed := s.records[record.InstanceID]
+	s.records[record.InstanceID] = record
+	err := s.save()
+	if err != nil {
+		if existed {
+			s.records[record.InstanceID] = previous
+		} else {
+			delete(s.records, record.InstanceID)
+		}
+	}
+	return err
+}
+
+func (s *fileInstanceStore) Delete(instanceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, existed := s.records[instanceID]
+	if !existed {
+		return nil
+	}
+	delete(s.records, instanceID)
+	err := s.save()
+	if err != nil {
+		s.records[instanceID] = previous
+	}
+	return err
+}
+
+// save writes the records to a temporary file first, so a crash never leaves
+// a truncated store behind. The caller must hold s.mu.
+func (s *fileInstanceStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	sealed := make(map[string]instanceRecord, len(s.records))
+	for instanceID, record := range s.records {
+		var err error
+		sealed[instanceID], err = record.mapSecrets(s.key.seal)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(sealed, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
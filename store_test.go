@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileInstanceStorePersistsRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "instance-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "instances.json")
+
+	store, err := newInstanceStore(path, "")
+	if err != nil {
+		t.Fatal("Unable to create store: " + err.Error())
+	}
+	err = store.Put(instanceRecord{InstanceID: "instance-id", TeamName: "my-org"})
+	if err != nil {
+		t.Fatal("Unable to put record: " + err.Error())
+	}
+
+	reloaded, err := newInstanceStore(path, "")
+	if err != nil {
+		t.Fatal("Unable to reload store: " + err.Error())
+	}
+	record, found, _ := reloaded.FindByTeam("my-org")
+	if !found || record.InstanceID != "instance-id" {
+		t.Error("Reloaded store didn't contain the record for team my-org")
+	}
+
+	err = reloaded.Delete("instance-id")
+	if err != nil {
+		t.Fatal("Unable to delete record: " + err.Error())
+	}
+	reloaded, _ = newInstanceStore(path, "")
+	if _, found, _ := reloaded.Get("instance-id"); found {
+		t.Error("Deleted record is still in the store")
+	}
+}
+
+func TestInstanceRecordSameRequest(t *testing.T) {
+	record := instanceRecord{ServiceID: "service", PlanID: "plan", Parameters: json.RawMessage(`{"a": 1}`)}
+	if !record.sameRequest(instanceRecord{ServiceID: "service", PlanID: "plan", Parameters: json.RawMessage(`{"a":1}`)}) {
+		t.Error("Records differing only in parameter whitespace should be the same request")
+	}
+	if record.sameRequest(instanceRecord{ServiceID: "service", PlanID: "other-plan", Parameters: json.RawMessage(`{"a": 1}`)}) {
+		t.Error("Records with different plans should not be the same request")
+	}
+}
+
+func TestCheckInstanceStore(t *testing.T) {
+	plans := map[string]planConfig{
+		"small":     {},
+		"dedicated": {DedicatedWorkers: true},
+		"limited":   {Quota: quotaConfig{MaxPipelinesPerTeam: 5}},
+		"sso":       {Auth: json.RawMessage(`{"github": {"organizations": ["my-org"]}}`)},
+	}
+	err := checkInstanceStore(brokerConfig{}, plans)
+	if err == nil || !strings.Contains(err.Error(), "dedicated, limited, sso") {
+		t.Errorf("Expected the plans needing the store to be rejected but got: %v", err)
+	}
+	if err := checkInstanceStore(brokerConfig{InstanceStorePath: "instances.json", InstanceStoreKey: "key"}, plans); err != nil {
+		t.Error("A file store was rejected: " + err.Error())
+	}
+	err = checkInstanceStore(brokerConfig{InstanceStorePath: "instances.json"}, plans)
+	if err == nil || !strings.Contains(err.Error(), "INSTANCE_STORE_KEY is required by plans dedicated, sso") {
+		t.Errorf("Expected the plans keeping secrets to require a key but got: %v", err)
+	}
+	if err := checkInstanceStore(brokerConfig{}, map[string]planConfig{"small": {}}); err != nil {
+		t.Error("An in-memory store was rejected for plans that don't need it: " + err.Error())
+	}
+}
+
+func TestFileInstanceStoreSealsSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "instance-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "instances.json")
+	record := instanceRecord{InstanceID: "instance-id", TeamName: "my-org", Workers: &workerKey{PrivateKey: "private-key", PublicKey: "ssh-rsa public-key"}}
+
+	keyless, _ := newInstanceStore(path, "")
+	if err := keyless.Put(record); err == nil {
+		t.Error("A store without a key wrote a secret")
+	}
+	store, _ := newInstanceStore(path, "store-key")
+	err = store.Put(record)
+	if err != nil {
+		t.Fatal("Unable to put record: " + err.Error())
+	}
+	if cached, _, _ := store.Get("instance-id"); cached.Workers.PrivateKey != "private-key" {
+		t.Error("Sealing changed the record in memory")
+	}
+	data, _ := ioutil.ReadFile(path)
+	if strings.Contains(string(data), "private-key") || !strings.Contains(string(data), "ssh-rsa public-key") {
+		t.Errorf("Expected only the private key to be sealed in: %s", data)
+	}
+
+	reloaded, err := newInstanceStore(path, "store-key")
+	if err != nil {
+		t.Fatal("Unable to reload store: " + err.Error())
+	}
+	if reloadedRecord, _, _ := reloaded.Get("instance-id"); reloadedRecord.Workers.PrivateKey != "private-key" {
+		t.Error("The sealed private key wasn't opened: " + reloadedRecord.Workers.PrivateKey)
+	}
+	if _, err := newInstanceStore(path, ""); err == nil {
+		t.Error("A sealed store was read without a key")
+	}
+	if _, err := newInstanceStore(path, "other-key"); err == nil {
+		t.Error("A sealed store was read with the wrong key")
+	}
+}
+
+func TestFileInstanceStoreSealsAuthSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "instance-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "instances.json")
+	record := instanceRecord{InstanceID: "instance-id", TeamName: "my-org", Auth: &teamAuthConfig{
+		GitHub:       &githubAuthConfig{ClientID: "github-client", ClientSecret: "github-secret"},
+		GenericOAuth: &genericOAuthAuthConfig{ClientID: "oauth-client", ClientSecret: "oauth-secret"},
+		BasicAuth:    &basicAuthConfig{Username: "ci", Password: "basic-password"},
+	}}
+
+	store, _ := newInstanceStore(path, "store-key")
+	err = store.Put(record)
+	if err != nil {
+		t.Fatal("Unable to put record: " + err.Error())
+	}
+	if record.Auth.GitHub.ClientSecret != "github-secret" {
+		t.Error("Sealing changed the record put")
+	}
+	data, _ := ioutil.ReadFile(path)
+	for _, secret := range []string{"github-secret", "oauth-secret", "basic-password"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("%s wasn't sealed in: %s", secret, data)
+		}
+	}
+	if !strings.Contains(string(data), "github-client") || !strings.Contains(string(data), `"username": "ci"`) {
+		t.Errorf("Expected only the secrets to be sealed in: %s", data)
+	}
+
+	reloaded, err := newInstanceStore(path, "store-key")
+	if err != nil {
+		t.Fatal("Unable to reload store: " + err.Error())
+	}
+	reloadedRecord, _, _ := reloaded.Get("instance-id")
+	auth := reloadedRecord.Auth
+	if auth.GitHub.ClientSecret != "github-secret" || auth.GenericOAuth.ClientSecret != "oauth-secret" || auth.BasicAuth.Password != "basic-password" {
+		t.Errorf("The sealed auth secrets weren't opened: %+v %+v %+v", auth.GitHub, auth.GenericOAuth, auth.BasicAuth)
+	}
+}
+
+func TestFileInstanceStoreSealsPlainSecretsOnLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "instance-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "instances.json")
+	ioutil.WriteFile(path, []byte(`{"instance-id": {"instance_id": "instance-id", "workers": {"private_key": "private-key"}}}`), 0600)
+
+	if _, err := newInstanceStore(path, ""); err == nil {
+		t.Error("A store holding plain secrets was loaded without a key")
+	}
+	store, err := newInstanceStore(path, "store-key")
+	if err != nil {
+		t.Fatal("Unable to load store: " + err.Error())
+	}
+	if record, _, _ := store.Get("instance-id"); record.Workers.PrivateKey != "private-key" {
+		t.Error("Unexpected private key: " + record.Workers.PrivateKey)
+	}
+	if data, _ := ioutil.ReadFile(path); strings.Contains(string(data), "private-key") {
+		t.Error("The plain secrets weren't sealed on load")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// sealedPrefix marks the secrets in the store file that are encrypted. Values
+// without it were written before the store encrypted them.
+const sealedPrefix = "sealed:"
+
+var errStoreKeyMissing = classify(errors.New("INSTANCE_STORE_KEY is not set"), "", "The broker can't keep the secrets of this instance")
+
+// storeKey encrypts the secrets of instance records, the private keys of
+// dedicated workers and the secrets of auth providers, with AES-GCM before
+// they are written to the store file. Records in memory hold them in plain text.
+type storeKey struct {
+	aead cipher.AEAD
+}
+
+// newStoreKey derives an AES-256 key from key, or returns nil if key is empty.
+func newStoreKey(key string) (*storeKey, error) {
+	if key == "" {
+		return nil, nil
+	}
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &storeKey{aead: aead}, nil
+}
+
+// seal encrypts value. It fails without a key rather than writing a secret in
+// plain text.
+func (k *storeKey) seal(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if k == nil {
+		return "", errStoreKeyMissing
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, []byte(value), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a value sealed by seal. Values that aren't sealed are
+// returned as they are.
+func (k *storeKey) open(value string) (string, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return value, nil
+	}
+	if k == nil {
+		return "", errors.New("INSTANCE_STORE_KEY is required to read the secrets in the instance store")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, sealedPrefix))
+	if err != nil || len(sealed) < k.aead.NonceSize() {
+		return "", errors.New("Invalid sealed secret in the instance store")
+	}
+	nonce, ciphertext := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+	plain, err := k.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("Unable to decrypt a secret in the instance store, is INSTANCE_STORE_KEY correct?")
+	}
+	return string(plain), nil
+}
+
+// mapSecrets returns a copy of the record with fn applied to each of its
+// secrets. The copy shares nothing holding a secret with r.
+func (r instanceRecord) mapSecrets(fn func(value string) (string, error)) (instanceRecord, error) {
+	var err error
+	if r.Workers != nil {
+		workers := *r.Workers
+		workers.PrivateKey, err = fn(workers.PrivateKey)
+		if err != nil {
+			return r, err
+		}
+		r.Workers = &workers
+	}
+	if r.Auth != nil {
+		auth := *r.Auth
+		if auth.GitHub != nil {
+			github := *auth.GitHub
+			github.ClientSecret, err = fn(github.ClientSecret)
+			if err != nil {
+				return r, err
+			}
+			auth.GitHub = &github
+		}
+		if auth.GenericOAuth != nil {
+			genericOAuth := *auth.GenericOAuth
+			genericOAuth.ClientSecret, err = fn(genericOAuth.ClientSecret)
+			if err != nil {
+				return r, err
+			}
+			auth.GenericOAuth = &genericOAuth
+		}
+		if auth.BasicAuth != nil {
+			basicAuth := *auth.BasicAuth
+			basicAuth.Password, err = fn(basicAuth.Password)
+			if err != nil {
+				return r, err
+			}
+			auth.BasicAuth = &basicAuth
+		}
+		r.Auth = &auth
+	}
+	return r, nil
+}
+
+// hasPlainSecrets reports whether the record holds secrets that aren't sealed.
+func (r instanceRecord) hasPlainSecrets() bool {
+	plain := false
+	r.mapSecrets(func(value string) (string, error) {
+		if value != "" && !strings.HasPrefix(value, sealedPrefix) {
+			plain = true
+		}
+		return value, nil
+	})
+	return plain
+}
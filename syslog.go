@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	syslogFacilityUser = 1
+	syslogSeverityErr  = 3
+	syslogSeverityInfo = 6
+)
+
+// syslogMessage is an RFC 5424 message without structured data.
+type syslogMessage struct {
+	Severity int
+	Time     time.Time
+	Hostname string
+	AppName  string
+	ProcID   string
+	MsgID    string
+	Message  string
+}
+
+func (m syslogMessage) String() string {
+	return fmt.Sprintf("<%d>1 %s %s %s %s %s - %s",
+		syslogFacilityUser*8+m.Severity,
+		m.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(m.Hostname, 255),
+		syslogHeaderField(m.AppName, 48),
+		syslogHeaderField(m.ProcID, 128),
+		syslogHeaderField(m.MsgID, 32),
+		m.Message,
+	)
+}
+
+// syslogHeaderField makes value fit a header field of at most max printable
+// ASCII characters, or the nil value if it is empty.
+func syslogHeaderField(value string, max int) string {
+	if value == "" {
+		return "-"
+	}
+	field := []byte(value)
+	for i, c := range field {
+		if c < 33 || c > 126 {
+			field[i] = '_'
+		}
+	}
+	if len(field) > max {
+		field = field[:max]
+	}
+	return string(field)
+}
+
+// IlogDrain sends syslog messages to a drain.
+type IlogDrain interface {
+	Send(message syslogMessage) error
+	Close() error
+}
+
+// parseDrainURL checks that raw is a drain the broker can send to: syslog://
+// and syslog-tls:// for syslog over TCP, http:// and https:// for HTTP drains.
+func parseDrainURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.Errorf("Invalid drain URL")
+	}
+	switch u.Scheme {
+	case "syslog", "syslog-tls", "http", "https":
+	default:
+		return nil, errors.Errorf("Unsupported drain scheme %q, use syslog, syslog-tls, http or https", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.Errorf("The drain URL needs a host")
+	}
+	if strings.HasPrefix(u.Scheme, "syslog") && u.Port() == "" {
+		return nil, errors.Errorf("The syslog drain URL needs a port")
+	}
+	return u, nil
+}
+
+func newLogDrain(raw string, timeout time.Duration) (IlogDrain, error) {
+	u, err := parseDrainURL(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return &httpLogDrain{url: u.String(), client: &http.Client{Timeout: timeout}}, nil
+	}
+	return &syslogDrain{addr: u.Host, tls: u.Scheme == "syslog-tls", timeout: timeout}, nil
+}
+
+// syslogDrain sends messages over TCP, framed by octet counting as in RFC
+// 6587. It connects on first use and reconnects after a failed write.
+type syslogDrain struct {
+	addr    string
+	tls     bool
+	timeout time.Duration
+	conn    net.Conn
+}
+
+func (d *syslogDrain) Send(message syslogMessage) error {
+	line := message.String()
+	frame := []byte(fmt.Sprintf("%d %s", len(line), line))
+	err := d.write(frame)
+	if err != nil {
+		// The drain may have closed an idle connection, try a fresh one.
+		d.Close()
+		err = d.write(frame)
+	}
+	return err
+}
+
+func (d *syslogDrain) write(frame []byte) error {
+	if d.conn == nil {
+		dialer := &net.Dialer{Timeout: d.timeout}
+		var conn net.Conn
+		var err error
+		if d.tls {
+			conn, err = tls.DialWithDialer(dialer, "tcp", d.addr, &tls.Config{})
+		} else {
+			conn, err = dialer.Dial("tcp", d.addr)
+		}
+		if err != nil {
+			return errors.Wrap(err, "Error connecting to drain")
+		}
+		d.conn = conn
+	}
+	d.conn.SetWriteDeadline(time.Now().Add(d.timeout))
+	_, err := d.conn.Write(frame)
+	return errors.Wrap(err, "Error writing to drain")
+}
+
+func (d *syslogDrain) Close() error {
+	if d.conn == nil {
+		return nil
+	}
+	err := d.conn.Close()
+	d.conn = nil
+	return err
+}
+
+// httpLogDrain posts every message to an HTTP drain.
+type httpLogDrain struct {
+	url    string
+	client *http.Client
+}
+
+func (d *httpLogDrain) Send(message syslogMessage) error {
+	resp, err := d.client.Post(d.url, "text/plain", bytes.NewBufferString(message.String()))
+	if err != nil {
+		return errors.Wrap(err, "Error posting to drain")
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("Drain responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func (d *httpLogDrain) Close() error {
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/concourse/atc"
+	"github.com/pkg/errors"
+)
+
+// teamAuthConfig holds the auth providers of a team besides the one granting
+// the CF space or the Kubernetes groups access, so people who are not platform
+// users can be let in.
+type teamAuthConfig struct {
+	GitHub       *githubAuthConfig       `json:"github,omitempty"`
+	GenericOAuth *genericOAuthAuthConfig `json:"generic_oauth,omitempty"`
+	BasicAuth    *basicAuthConfig        `json:"basic_auth,omitempty"`
+}
+
+// githubAuthConfig mirrors the team auth config of Concourse's GitHub
+// provider, which is not part of the vendored atc.
+type githubAuthConfig struct {
+	ClientID      string       `json:"client_id"`
+	ClientSecret  string       `json:"client_secret"`
+	Organizations []string     `json:"organizations,omitempty"`
+	Teams         []githubTeam `json:"teams,omitempty"`
+	Users         []string     `json:"users,omitempty"`
+	AuthURL       string       `json:"auth_url,omitempty"`
+	TokenURL      string       `json:"token_url,omitempty"`
+	APIURL        string       `json:"api_url,omitempty"`
+	CACert        string       `json:"ca_cert,omitempty"`
+}
+
+type githubTeam struct {
+	OrganizationName string `json:"organization_name"`
+	TeamName         string `json:"team_name"`
+}
+
+// genericOAuthAuthConfig mirrors the team auth config of Concourse's generic
+// OAuth provider.
+type genericOAuthAuthConfig struct {
+	DisplayName   string            `json:"display_name"`
+	ClientID      string            `json:"client_id"`
+	ClientSecret  string            `json:"client_secret"`
+	AuthURL       string            `json:"auth_url"`
+	AuthURLParams map[string]string `json:"auth_url_params,omitempty"`
+	Scope         string            `json:"scope,omitempty"`
+	TokenURL      string            `json:"token_url"`
+	CACert        string            `json:"ca_cert,omitempty"`
+}
+
+// basicAuthConfig grants access with a username and a password generated by
+// the broker.
+type basicAuthConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+}
+
+func (c *githubAuthConfig) validate() []string {
+	var problems []string
+	if c.ClientID == "" || c.ClientSecret == "" {
+		problems = append(problems, "github: client_id and client_secret are required")
+	}
+	if len(c.Organizations) == 0 && len(c.Teams) == 0 && len(c.Users) == 0 {
+		problems = append(problems, "github: at least one of organizations, teams or users is required")
+	}
+	for _, team := range c.Teams {
+		if team.OrganizationName == "" || team.TeamName == "" {
+			problems = append(problems, "github: teams need an organization_name and a team_name")
+			break
+		}
+	}
+	if (c.AuthURL != "" || c.TokenURL != "" || c.APIURL != "") && (c.AuthURL == "" || c.TokenURL == "" || c.APIURL == "") {
+		problems = append(problems, "github: auth_url, token_url and api_url must be set together")
+	}
+	return problems
+}
+
+func (c *genericOAuthAuthConfig) validate() []string {
+	var problems []string
+	if c.ClientID == "" || c.ClientSecret == "" {
+		problems = append(problems, "generic_oauth: client_id and client_secret are required")
+	}
+	if c.AuthURL == "" || c.TokenURL == "" {
+		problems = append(problems, "generic_oauth: auth_url and token_url are required")
+	}
+	if c.DisplayName == "" {
+		problems = append(problems, "generic_oauth: display_name is required")
+	}
+	return problems
+}
+
+func (c *basicAuthConfig) validate() []string {
+	var problems []string
+	if c.Username == "" {
+		problems = append(problems, "basic_auth: username is required")
+	}
+	if c.Password != "" {
+		problems = append(problems, "basic_auth: password can't be set, it is generated by the broker")
+	}
+	return problems
+}
+
+// newTeamAuthConfig merges the auth providers requested in the parameters
+// over the ones of the plan, field by field, so a plan can carry the OAuth
+// client and the parameters name the users. It returns nil if neither sets any
+// provider, and generates the basic auth password.
+func newTeamAuthConfig(plan, params json.RawMessage) (*teamAuthConfig, error) {
+	merged := make(map[string]map[string]json.RawMessage)
+	for _, raw := range []json.RawMessage{plan, params} {
+		if len(raw) == 0 {
+			continue
+		}
+		var providers map[string]map[string]json.RawMessage
+		err := json.Unmarshal(raw, &providers)
+		if err != nil {
+			return nil, invalidTeamAuth(errors.Wrap(err, "Invalid auth"))
+		}
+		for name, fields := range providers {
+			if merged[name] == nil {
+				merged[name] = make(map[string]json.RawMessage)
+			}
+			for field, value := range fields {
+				merged[name][field] = value
+			}
+		}
+	}
+	if len(merged) == 0 {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	config, err := decodeTeamAuth(data)
+	if err != nil {
+		return nil, invalidTeamAuth(err)
+	}
+
+	var problems []string
+	if config.GitHub != nil {
+		problems = append(problems, config.GitHub.validate()...)
+	}
+	if config.GenericOAuth != nil {
+		problems = append(problems, config.GenericOAuth.validate()...)
+	}
+	if config.BasicAuth != nil {
+		problems = append(problems, config.BasicAuth.validate()...)
+	}
+	if len(problems) > 0 {
+		return nil, invalidTeamAuth(errors.New("Invalid auth: " + strings.Join(problems, ", ")))
+	}
+
+	if config.BasicAuth != nil {
+		config.BasicAuth.Password, err = generatePassword()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// decodeTeamAuth decodes auth providers, rejecting unknown providers and
+// settings.
+func decodeTeamAuth(data []byte) (teamAuthConfig, error) {
+	var config teamAuthConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&config)
+	if err != nil {
+		return teamAuthConfig{}, errors.Wrap(err, "Invalid auth")
+	}
+	return config, nil
+}
+
+func invalidTeamAuth(err error) error {
+	return classify(err, kindInvalidInput, err.Error())
+}
+
+// apply adds the providers to the auth of team.
+func (c *teamAuthConfig) apply(team *atc.Team) error {
+	if c == nil {
+		return nil
+	}
+	if c.GitHub != nil {
+		err := setTeamAuth(team, "github", c.GitHub)
+		if err != nil {
+			return err
+		}
+	}
+	if c.GenericOAuth != nil {
+		err := setTeamAuth(team, "generic_oauth", c.GenericOAuth)
+		if err != nil {
+			return err
+		}
+	}
+	if c.BasicAuth != nil {
+		team.BasicAuth = &atc.BasicAuth{
+			BasicAuthUsername: c.BasicAuth.Username,
+			BasicAuthPassword: c.BasicAuth.Password,
+		}
+	}
+	return nil
+}
+
+func setTeamAuth(team *atc.Team, providerName string, authConfig interface{}) error {
+	data, err := json.Marshal(authConfig)
+	if err != nil {
+		return err
+	}
+	team.Auth[providerName] = (*json.RawMessage)(&data)
+	return nil
+}
+
+func generatePassword() (string, error) {
+	buf := make([]byte, 24)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", errors.Wrap(err, "Error generating password")
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
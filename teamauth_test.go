@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNewTeamAuthConfig(t *testing.T) {
+	plan := json.RawMessage(`{"github": {"client_id": "id", "client_secret": "secret"}, "basic_auth": {"username": "ci"}}`)
+
+	config, err := newTeamAuthConfig(plan, json.RawMessage(`{"github": {"users": ["octocat"]}}`))
+	if err != nil {
+		t.Fatal("newTeamAuthConfig returned error: " + err.Error())
+	}
+	if config.GitHub.ClientID != "id" || len(config.GitHub.Users) != 1 {
+		t.Errorf("Expected the parameters to be merged over the plan but got: %+v", config.GitHub)
+	}
+	if config.BasicAuth.Password == "" {
+		t.Error("Expected a basic auth password to be generated")
+	}
+
+	_, err = newTeamAuthConfig(plan, nil)
+	if kind, _ := errorKindOf(err); kind != kindInvalidInput {
+		t.Errorf("Expected an invalid input error for GitHub auth without users but got: %v", err)
+	}
+	_, err = newTeamAuthConfig(nil, json.RawMessage(`{"gitlab": {"client_id": "id"}}`))
+	if kind, _ := errorKindOf(err); kind != kindInvalidInput {
+		t.Errorf("Expected an invalid input error for an unknown provider but got: %v", err)
+	}
+	_, err = newTeamAuthConfig(nil, json.RawMessage(`{"basic_auth": {"username": "ci", "password": "chosen"}}`))
+	if kind, _ := errorKindOf(err); kind != kindInvalidInput {
+		t.Errorf("Expected an invalid input error for a chosen password but got: %v", err)
+	}
+
+	config, err = newTeamAuthConfig(nil, nil)
+	if err != nil || config != nil {
+		t.Errorf("Expected no auth without providers but got: %v, %v", config, err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// vaultClient gives every team a KV mount of its own under the path prefix
+// Concourse looks up ((vars)) in, a policy granting access to it and a token
+// role issuing tokens with that policy.
+type vaultClient struct {
+	httpClient *http.Client
+	addr       string
+	token      string
+	prefix     string
+}
+
+func newVaultClient(config brokerConfig) *vaultClient {
+	return &vaultClient{
+		httpClient: &http.Client{
+			Transport: newRetryTransport(upstreamVault, config, defaultTransport()),
+			Timeout:   config.VaultTimeout,
+		},
+		addr:   strings.TrimSuffix(config.VaultAddr, "/"),
+		token:  config.VaultToken,
+		prefix: strings.Trim(config.VaultPathPrefix, "/"),
+	}
+}
+
+// mountPath is the path of the team's mount, which its policy grants access
+// to, so both are built from it. Vault lists mounts and matches policies by
+// raw paths, which are only escaped in request URLs, see escapePath.
+func (v *vaultClient) mountPath(teamName string) string {
+	return v.prefix + "/" + teamName
+}
+
+func (v *vaultClient) policyName(teamName string) string {
+	return v.prefix + "-" + teamName
+}
+
+// escapePath escapes every segment of path for a request URL.
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// CreateTeam mounts the team's KV backend, writes its policy and token role
+// and seeds the secrets. Scalar secrets are stored under the "value" key
+// Concourse reads. A mount that exists already is a conflict, unless owned
+// says the broker created it.
+func (v *vaultClient) CreateTeam(ctx context.Context, teamName string, secrets map[string]interface{}, owned bool) error {
+	mount := v.mountPath(teamName)
+	mounted, err := v.mounted(ctx, mount)
+	if err != nil {
+		return err
+	}
+	if mounted && !owned {
+		err := errors.Errorf("Vault path %s is mounted already", mount)
+		return classify(err, kindConflict, err.Error())
+	}
+	if !mounted {
+		err = v.do(ctx, "POST", "/v1/sys/mounts/"+escapePath(mount), map[string]interface{}{
+			"type":        "kv",
+			"description": "Secrets of Concourse team " + teamName,
+			"options":     map[string]string{"version": "1"},
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	policy := fmt.Sprintf("path %q {\n  capabilities = [\"create\", \"read\", \"update\", \"delete\", \"list\"]\n}\n", mount+"/*")
+	err = v.do(ctx, "PUT", "/v1/sys/policies/acl/"+url.PathEscape(v.policyName(teamName)), map[string]string{"policy": policy}, nil)
+	if err != nil {
+		return err
+	}
+	err = v.do(ctx, "POST", "/v1/auth/token/roles/"+url.PathEscape(v.policyName(teamName)), map[string]interface{}{
+		"allowed_policies": []string{v.policyName(teamName)},
+	}, nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range secrets {
+		data, ok := value.(map[string]interface{})
+		if !ok {
+			data = map[string]interface{}{"value": value}
+		}
+		err = v.do(ctx, "PUT", "/v1/"+escapePath(mount+"/"+name), data, nil)
+		if err != nil {
+			return errors.Wrapf(err, "Error writing secret %s", name)
+		}
+	}
+	return nil
+}
+
+// DeleteTeam unmounts the team's KV backend, which deletes all its secrets,
+// and deletes its token role and policy. All succeed if they are gone
+// already.
+func (v *vaultClient) DeleteTeam(ctx context.Context, teamName string) error {
+	err := v.do(ctx, "DELETE", "/v1/sys/mounts/"+escapePath(v.mountPath(teamName)), nil, nil)
+	if err != nil {
+		return err
+	}
+	err = v.do(ctx, "DELETE", "/v1/auth/token/roles/"+url.PathEscape(v.policyName(teamName)), nil, nil)
+	if err != nil {
+		return err
+	}
+	return v.do(ctx, "DELETE", "/v1/sys/policies/acl/"+url.PathEscape(v.policyName(teamName)), nil, nil)
+}
+
+// mounted reports whether a secrets engine is mounted at path.
+func (v *vaultClient) mounted(ctx context.Context, path string) (bool, error) {
+	var mounts struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	err := v.do(ctx, "GET", "/v1/sys/mounts", nil, &mounts)
+	if err != nil {
+		return false, err
+	}
+	_, found := mounts.Data[path+"/"]
+	return found, nil
+}
+
+type vaultErrorResponse struct {
+	Errors []string `json:"errors"`
+}
+
+// do sends a request to Vault and decodes the response into result, unless
+// it is nil. Failures are classified by their status code.
+func (v *vaultClient) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, v.addr+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := v.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return classify(errors.Wrap(err, "Error requesting Vault"), kindUnavailable, "Vault is unavailable")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		if result == nil {
+			return nil
+		}
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	var vaultErr vaultErrorResponse
+	json.NewDecoder(resp.Body).Decode(&vaultErr)
+	err = errors.Errorf("Vault %s %s: %s %s", method, path, resp.Status, strings.Join(vaultErr.Errors, ", "))
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return classify(err, kindUnauthorized, "The broker is not authorized to manage Vault")
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return classify(err, kindUnavailable, "Vault is unavailable")
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/vchrisr/cf-concourse-broker/fakes/fakevault"
+)
+
+func newTestVault() (*fakevault.Server, *vaultClient) {
+	server := fakevault.New("root-token")
+	config := brokerConfig{VaultAddr: server.URL, VaultToken: "root-token", VaultPathPrefix: "concourse"}
+	return server, newVaultClient(config)
+}
+
+func TestVaultCreateAndDeleteTeam(t *testing.T) {
+	server, client := newTestVault()
+	defer server.Close()
+
+	err := client.CreateTeam(context.Background(), "my-org", map[string]interface{}{
+		"docker-password": "hunter2",
+		"deploy/aws":      map[string]interface{}{"access_key": "key", "secret_key": "secret"},
+	}, false)
+	if err != nil {
+		t.Fatal("CreateTeam returned error: " + err.Error())
+	}
+	if mounts := server.Mounts(); len(mounts) != 1 || mounts[0] != "concourse/my-org" {
+		t.Errorf("Expected mount concourse/my-org but got: %v", mounts)
+	}
+	policy, found := server.Policy("concourse-my-org")
+	if !found || !strings.Contains(policy, `path "concourse/my-org/*"`) {
+		t.Error("Expected a policy scoped to concourse/my-org but got: " + policy)
+	}
+	if policies, _ := server.TokenRole("concourse-my-org"); len(policies) != 1 || policies[0] != "concourse-my-org" {
+		t.Errorf("Expected a token role issuing the policy of the team but got: %v", policies)
+	}
+	secret, _ := server.Secret("concourse/my-org/docker-password")
+	if secret["value"] != "hunter2" {
+		t.Errorf("Expected the scalar secret under value but got: %v", secret)
+	}
+	secret, _ = server.Secret("concourse/my-org/deploy/aws")
+	if secret["access_key"] != "key" {
+		t.Errorf("Expected the fields of the secret but got: %v", secret)
+	}
+
+	err = client.CreateTeam(context.Background(), "my-org", nil, false)
+	if kind, _ := errorKindOf(err); kind != kindConflict {
+		t.Errorf("Expected a conflict for a mount the broker doesn't own but got: %v", err)
+	}
+	err = client.CreateTeam(context.Background(), "my-org", nil, true)
+	if err != nil {
+		t.Error("CreateTeam returned error for a mount the broker owns: " + err.Error())
+	}
+	if _, found := server.Secret("concourse/my-org/docker-password"); !found {
+		t.Error("CreateTeam replaced the mount the broker owns")
+	}
+
+	err = client.DeleteTeam(context.Background(), "my-org")
+	if err != nil {
+		t.Fatal("DeleteTeam returned error: " + err.Error())
+	}
+	if len(server.Mounts()) != 0 {
+		t.Error("DeleteTeam didn't unmount the team")
+	}
+	if _, found := server.Secret("concourse/my-org/docker-password"); found {
+		t.Error("DeleteTeam left the secrets of the team behind")
+	}
+	if _, found := server.Policy("concourse-my-org"); found {
+		t.Error("DeleteTeam didn't delete the policy of the team")
+	}
+	if _, found := server.TokenRole("concourse-my-org"); found {
+		t.Error("DeleteTeam didn't delete the token role of the team")
+	}
+}
+
+func TestVaultTeamNameWithSpace(t *testing.T) {
+	server, client := newTestVault()
+	defer server.Close()
+
+	err := client.CreateTeam(context.Background(), "My Org", map[string]interface{}{"docker-password": "hunter2"}, false)
+	if err != nil {
+		t.Fatal("CreateTeam returned error: " + err.Error())
+	}
+	if mounts := server.Mounts(); len(mounts) != 1 || mounts[0] != "concourse/My Org" {
+		t.Errorf("Expected mount concourse/My Org but got: %v", mounts)
+	}
+	policy, _ := server.Policy("concourse-My Org")
+	if !strings.Contains(policy, `path "concourse/My Org/*"`) {
+		t.Error("Expected a policy scoped to concourse/My Org but got: " + policy)
+	}
+	if _, found := server.Secret("concourse/My Org/docker-password"); !found {
+		t.Error("The secret of team My Org was not written")
+	}
+	err = client.CreateTeam(context.Background(), "My Org", nil, false)
+	if kind, _ := errorKindOf(err); kind != kindConflict {
+		t.Errorf("Expected a conflict for a mount the broker doesn't own but got: %v", err)
+	}
+
+	err = client.DeleteTeam(context.Background(), "My Org")
+	if err != nil {
+		t.Fatal("DeleteTeam returned error: " + err.Error())
+	}
+	if len(server.Mounts()) != 0 {
+		t.Error("DeleteTeam didn't unmount team My Org")
+	}
+}
+
+func TestVaultBadToken(t *testing.T) {
+	server, client := newTestVault()
+	defer server.Close()
+	client.token = "wrong"
+
+	err := client.CreateTeam(context.Background(), "my-org", nil, false)
+	if kind, _ := errorKindOf(err); kind != kindUnauthorized {
+		t.Errorf("Expected an unauthorized error but got: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+const workerKeyBits = 2048
+
+var errWorkersNotConfigured = classify(errors.New("TSA_HOST is not set"), "", "Dedicated workers are not available")
+
+// workerKey is the key pair the workers of a team register with at the TSA,
+// and the tags they have to be registered with.
+type workerKey struct {
+	PrivateKey string   `json:"private_key"`
+	PublicKey  string   `json:"public_key"`
+	Tags       []string `json:"tags,omitempty"`
+}
+
+// workerCredentials are handed out in bindings, with everything needed to
+// deploy a worker for the team.
+type workerCredentials struct {
+	TSAHost          string   `json:"tsa_host"`
+	TSAPublicKey     string   `json:"tsa_public_key,omitempty"`
+	Team             string   `json:"team"`
+	Tags             []string `json:"tags,omitempty"`
+	WorkerPrivateKey string   `json:"worker_private_key"`
+	WorkerPublicKey  string   `json:"worker_public_key"`
+}
+
+// addTo adds the worker registration to the credentials of an app bound
+// through a credential manager.
+func (c workerCredentials) addTo(credentials map[string]interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &credentials)
+	return credentials, err
+}
+
+func newWorkerKey(tags []string) (*workerKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, workerKeyBits)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating worker key")
+	}
+	privateKey := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	return &workerKey{
+		PrivateKey: string(privateKey),
+		PublicKey:  sshPublicKey(&key.PublicKey),
+		Tags:       tags,
+	}, nil
+}
+
+// sshPublicKey encodes key in the authorized_keys format the TSA reads.
+func sshPublicKey(key *rsa.PublicKey) string {
+	var buf bytes.Buffer
+	writeSSHBytes(&buf, []byte("ssh-rsa"))
+	writeSSHBytes(&buf, sshMPInt(big.NewInt(int64(key.E))))
+	writeSSHBytes(&buf, sshMPInt(key.N))
+	return "ssh-rsa " + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func writeSSHBytes(buf *bytes.Buffer, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+}
+
+// sshMPInt returns the bytes of a positive mpint, which are padded to keep the
+// sign bit clear.
+func sshMPInt(n *big.Int) []byte {
+	data := n.Bytes()
+	if len(data) > 0 && data[0]&0x80 != 0 {
+		return append([]byte{0}, data...)
+	}
+	return data
+}
+
+func newWorkerCredentials(config brokerConfig, record instanceRecord) workerCredentials {
+	return workerCredentials{
+		TSAHost:          config.TSAHost,
+		TSAPublicKey:     config.TSAPublicKey,
+		Team:             record.TeamName,
+		Tags:             record.Workers.Tags,
+		WorkerPrivateKey: record.Workers.PrivateKey,
+		WorkerPublicKey:  record.Workers.PublicKey,
+	}
+}
+
+// authorizeWorkers writes the public key of the team's workers to the file the
+// TSA is pointed to with --team-authorized-keys=<team>:<dir>/<team>.
+func authorizeWorkers(config brokerConfig, teamName string, key *workerKey) error {
+	if config.TSATeamAuthorizedKeysDir == "" {
+		return nil
+	}
+	path := filepath.Join(config.TSATeamAuthorizedKeysDir, filepath.Base(teamName))
+	err := ioutil.WriteFile(path, []byte(key.PublicKey+"\n"), 0644)
+	return errors.Wrap(err, "Error writing the authorized key of the team")
+}
+
+func unauthorizeWorkers(config brokerConfig, teamName string) error {
+	if config.TSATeamAuthorizedKeysDir == "" {
+		return nil
+	}
+	err := os.Remove(filepath.Join(config.TSATeamAuthorizedKeysDir, filepath.Base(teamName)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
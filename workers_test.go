@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+func TestNewWorkerKey(t *testing.T) {
+	key, err := newWorkerKey([]string{"large"})
+	if err != nil {
+		t.Fatal("newWorkerKey returned error: " + err.Error())
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		t.Fatal("The private key is not PEM encoded")
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal("Unable to parse the private key: " + err.Error())
+	}
+
+	fields := strings.Fields(key.PublicKey)
+	if len(fields) != 2 || fields[0] != "ssh-rsa" {
+		t.Fatal("Expected an ssh-rsa public key but got: " + key.PublicKey)
+	}
+	data, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		t.Fatal("Unable to decode the public key: " + err.Error())
+	}
+	if !bytes.HasSuffix(data, sshMPInt(privateKey.N)) {
+		t.Error("The public key doesn't match the private key")
+	}
+}